@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -30,6 +32,7 @@ func NewCommand(version, commit string) *cobra.Command {
 		SilenceErrors:     true,
 		DisableAutoGenTag: true,
 	}
+	cmd.AddCommand(newTrashCommand())
 	return cmd
 }
 
@@ -65,17 +68,50 @@ func runRoot(cmd *cobra.Command, _ []string) error {
 		return fmt.Errorf("failed to create server router: %w", err)
 	}
 
+	var tlsConfig *tls.Config
+	if cfg.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to parse client CA file")
+		}
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  pool,
+		}
+	}
+
 	serverCtx, serverStopCtx := context.WithCancel(ctx)
+	r.Start(serverCtx)
 
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%d", cfg.Port),
 		ReadHeaderTimeout: 60 * time.Second,
 		IdleTimeout:       60 * time.Second,
 		Handler:           r,
+		TLSConfig:         tlsConfig,
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("received SIGHUP, reloading config")
+			newCfg, err := c.Load()
+			if err != nil {
+				slog.Error("failed to reload config, keeping the current one", "error", err)
+				continue
+			}
+			r.Reload(newCfg)
+		}
+	}()
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		signal := <-sig
 
@@ -100,8 +136,13 @@ func runRoot(cmd *cobra.Command, _ []string) error {
 		serverStopCtx()
 	}()
 
-	slog.Info("server started", "address", server.Addr)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	slog.Info("server started", "address", server.Addr, "tls", cfg.TLS.CertFile != "")
+	if cfg.TLS.CertFile != "" {
+		err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
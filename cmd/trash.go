@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/USA-RedDragon/configulator"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/spf13/cobra"
+)
+
+var errAdminRequest = errors.New("admin API request failed")
+
+type trashEntry struct {
+	Repository  string    `json:"repository"`
+	Tag         string    `json:"tag"`
+	OriginalTag string    `json:"original-tag"`
+	Digest      string    `json:"digest"`
+	DeletedAt   time.Time `json:"deleted-at"`
+}
+
+func newTrashCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage soft-deleted manifests through the admin API",
+	}
+	cmd.PersistentFlags().String("url", "", "URL of the proxy. Defaults to my-url from the config")
+	cmd.PersistentFlags().String("token", "", "Admin API token. Defaults to admin.token from the config")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List trashed manifests",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var entries []trashEntry
+			if err := adminRequest(cmd, http.MethodGet, "/trash", nil, &entries); err != nil {
+				return err
+			}
+			return printTrash(cmd.OutOrStdout(), entries)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "restore <repository> <tag>",
+		Short: "Restore a trashed manifest to its original tag or digest",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body := map[string]string{"repository": args[0], "tag": args[1]}
+			var entry trashEntry
+			if err := adminRequest(cmd, http.MethodPost, "/trash/restore", body, &entry); err != nil {
+				return err
+			}
+			reference := ":" + entry.OriginalTag
+			if entry.OriginalTag == "" {
+				reference = "@" + entry.Digest
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Restored %s%s\n", entry.Repository, reference)
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "purge",
+		Short: "Delete trashed manifests older than the retention period",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var purged []trashEntry
+			if err := adminRequest(cmd, http.MethodPost, "/trash/purge", nil, &purged); err != nil {
+				return err
+			}
+			return printTrash(cmd.OutOrStdout(), purged)
+		},
+	})
+	return cmd
+}
+
+func printTrash(out io.Writer, entries []trashEntry) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tTRASH TAG\tORIGINAL\tDELETED")
+	for _, entry := range entries {
+		original := entry.OriginalTag
+		if original == "" {
+			original = entry.Digest
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entry.Repository, entry.Tag, original, entry.DeletedAt.Format(time.RFC3339))
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// adminEndpoint returns the proxy URL and admin token from the flags,
+// falling back to the config for whichever is missing.
+func adminEndpoint(cmd *cobra.Command) (string, string, error) {
+	url, _ := cmd.Flags().GetString("url")
+	token, _ := cmd.Flags().GetString("token")
+	if url == "" || token == "" {
+		c, err := configulator.FromContext[config.Config](cmd.Context())
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get config from context")
+		}
+		cfg, err := c.Load()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to load config: %w", err)
+		}
+		if url == "" {
+			url = cfg.MyURL
+		}
+		if token == "" {
+			token = cfg.Admin.Token
+		}
+	}
+	return strings.TrimSuffix(url, "/"), token, nil
+}
+
+func adminRequest(cmd *cobra.Command, method, path string, body, out any) error {
+	url, token, err := adminEndpoint(cmd)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(cmd.Context(), method, url+"/_proxy/admin"+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s", errAdminRequest, resp.Status, adminErrorMessage(resp.Body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// adminErrorMessage returns the messages of an OCI error body, or the body
+// itself when it is not one.
+func adminErrorMessage(body io.Reader) string {
+	raw, _ := io.ReadAll(io.LimitReader(body, 4096))
+	var parsed struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Detail  any    `json:"detail"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(raw, &parsed) != nil || len(parsed.Errors) == 0 {
+		return strings.TrimSpace(string(raw))
+	}
+	messages := make([]string, 0, len(parsed.Errors))
+	for _, e := range parsed.Errors {
+		if detail, ok := e.Detail.(string); ok && detail != "" {
+			messages = append(messages, e.Message+": "+detail)
+			continue
+		}
+		messages = append(messages, e.Message)
+	}
+	return strings.Join(messages, "; ")
+}
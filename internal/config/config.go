@@ -2,7 +2,15 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/policy"
 )
 
 var (
@@ -13,17 +21,453 @@ var (
 	ErrMyURLRequired   = errors.New("my-url is required if cors-allowed-origins is not set to default")
 	ErrInvalidMyURL    = errors.New("my-url must be a valid URL starting with http:// or https://")
 	ErrSecretRequired  = errors.New("secret is required")
+
+	ErrInvalidAnonymousPolicy       = errors.New("anonymous.policy must be one of disabled, pull, or pull-repositories")
+	ErrAnonymousRepositoriesMissing = errors.New("anonymous.repositories is required when anonymous.policy is pull-repositories")
+	ErrInvalidAnonymousRepository   = errors.New("anonymous.repositories contains an invalid glob")
+
+	ErrInvalidClientProfile   = errors.New("clients[].profile must be one of token, passthrough, or deny")
+	ErrClientRuleEmpty        = errors.New("clients[] rules must set at least one of user-agent, header, or cidrs")
+	ErrInvalidClientUserAgent = errors.New("clients[].user-agent must be a valid regular expression")
+	ErrInvalidClientCIDR      = errors.New("clients[].cidrs must contain valid CIDRs")
+
+	ErrInvalidAuthMode          = errors.New("auth.mode must be one of first-match or all-required")
+	ErrInvalidAuthenticatorType = errors.New("auth.chain[].type must be one of anonymous, basic, htpasswd, jwt, or mtls")
+	ErrHtpasswdFileRequired     = errors.New("auth.chain[].htpasswd-file is required for htpasswd authenticators")
+	ErrJWTKeyRequired           = errors.New("auth.chain[].jwt-secret or auth.chain[].jwt-public-key-file is required for jwt authenticators")
+	ErrMTLSRequiresClientCA     = errors.New("tls.client-ca-file is required for mtls authenticators")
+	ErrTLSCertAndKeyRequired    = errors.New("tls.cert-file and tls.key-file must be set together")
+
+	ErrInvalidAccessAction        = errors.New("access-rules[].actions must contain only pull, push, delete, or catalog")
+	ErrAccessActionsRequired      = errors.New("access-rules[].actions is required")
+	ErrAccessRepositoriesRequired = errors.New("access-rules[].repositories is required for pull, push, and delete rules")
+	ErrInvalidAccessRepository    = errors.New("access-rules[].repositories contains an invalid glob")
+	ErrAccessPrincipalsRequired   = errors.New("access-rules[] must list identities or groups")
+
+	ErrPolicyNameRequired       = errors.New("policies.rules[].name is required")
+	ErrPolicyExpressionRequired = errors.New("policies.rules[].expression is required")
+	ErrInvalidPolicy            = errors.New("policies.rules[].expression is invalid")
+
+	ErrInvalidReadOnlyRepository    = errors.New("read-only.repositories contains an invalid glob")
+	ErrInvalidMaintenanceRepository = errors.New("maintenance.repositories contains an invalid glob")
+	ErrInvalidRetryAfter            = errors.New("retry-after must not be negative")
+
+	ErrImmutableRepositoriesRequired = errors.New("immutable-tags[].repositories is required")
+	ErrImmutableTagsRequired         = errors.New("immutable-tags[].tags is required")
+	ErrInvalidImmutableRepository    = errors.New("immutable-tags[].repositories contains an invalid glob")
+	ErrInvalidImmutableTag           = errors.New("immutable-tags[].tags contains an invalid glob")
+
+	ErrInvalidVulnerabilitySeverity   = errors.New("vulnerability-gate.severity must be one of LOW, MEDIUM, HIGH, or CRITICAL")
+	ErrInvalidVulnerabilityRepository = errors.New("vulnerability-gate.allowed-repositories contains an invalid glob")
+	ErrInvalidVulnerabilityCacheTTL   = errors.New("vulnerability-gate.cache-ttl must not be negative")
+
+	ErrSignatureRepositoriesRequired = errors.New("signatures.rules[].repositories is required")
+	ErrInvalidSignatureRepository    = errors.New("signatures.rules[].repositories contains an invalid glob")
+	ErrSignatureKeysRequired         = errors.New("signatures.rules[].keys is required")
+	ErrInvalidSignatureCacheTTL      = errors.New("signatures.cache-ttl must not be negative")
+
+	ErrAdmissionRepositoriesRequired = errors.New("admission[].repositories is required")
+	ErrInvalidAdmissionRepository    = errors.New("admission[].repositories contains an invalid glob")
+	ErrInvalidAdmissionLimit         = errors.New("admission[] size and layer limits must not be negative")
+	ErrInvalidAdmissionPlatform      = errors.New("admission[].required-platforms must be formatted as os/arch or os/arch/variant")
+
+	ErrQuotaPrefixRequired           = errors.New("quotas.namespaces[].prefix is required")
+	ErrInvalidQuotaLimit             = errors.New("quotas.namespaces[] limits must not be negative")
+	ErrInvalidQuotaReconcileInterval = errors.New("quotas.reconcile-interval must not be negative")
+
+	ErrInvalidTrashPrefix     = errors.New("soft-delete.trash-prefix must be a valid repository name")
+	ErrInvalidTrashRetention  = errors.New("soft-delete.retention must not be negative")
+	ErrInvalidTrashPurgeEvery = errors.New("soft-delete.purge-interval must not be negative")
+
+	ErrInvalidTrustedProxy         = errors.New("trusted-proxies must contain valid CIDRs")
+	ErrNetworkActionsRequired      = errors.New("network-rules[].actions is required")
+	ErrInvalidNetworkAction        = errors.New("network-rules[].actions must contain only pull, push, delete, or catalog")
+	ErrNetworkRepositoriesRequired = errors.New("network-rules[].repositories is required for pull, push, and delete rules")
+	ErrInvalidNetworkRepository    = errors.New("network-rules[].repositories contains an invalid glob")
+	ErrNetworkRuleEmpty            = errors.New("network-rules[] must set allow or deny")
+	ErrInvalidNetworkCIDR          = errors.New("network-rules[].allow and network-rules[].deny must contain valid CIDRs")
+
+	ErrInvalidDockerCompatCacheTTL = errors.New("docker-compat.cache-ttl must be positive when docker-compat is enabled")
+
+	ErrInvalidMirrorPrefix = errors.New("mirror.prefix must be a valid repository name")
+
+	ErrInvalidNamespaceRegistry = errors.New("ns.registries[].registry must be a registry host like ghcr.io")
+	ErrInvalidNamespacePrefix   = errors.New("ns.registries[].prefix must be a valid repository name")
+	ErrInvalidNamespaceUnknown  = errors.New("ns.unknown must be one of passthrough or deny")
+
+	ErrAliasMatchRequired = errors.New("aliases[] must set exactly one of prefix or regex")
+	ErrInvalidAliasPrefix = errors.New("aliases[].prefix must be a valid repository name")
+	ErrInvalidAliasRegex  = errors.New("aliases[].regex must be a valid regular expression")
+	ErrAliasUpstream      = errors.New("aliases[].upstream is required, and must be a valid repository name for prefix aliases")
+
+	ErrInvalidPlatformFilterCacheTTL   = errors.New("platform-filters.cache-ttl must be positive when rules are set")
+	ErrPlatformFilterEmpty             = errors.New("platform-filters.rules[] must set platforms or drop-attestations")
+	ErrInvalidPlatformFilterRepository = errors.New("platform-filters.rules[].repositories contains an invalid glob")
+	ErrInvalidPlatformFilterPlatform   = errors.New("platform-filters.rules[].platforms must be formatted as os/arch or os/arch/variant")
+	ErrUnknownPlatformFilterClient     = errors.New("platform-filters.rules[].clients must name client rules")
+
+	ErrInvalidStorageRedirectPolicy = errors.New("storage-redirects.policy must be one of passthrough, follow, or rewrite")
+	ErrInvalidStorageRewriteURL     = errors.New("storage-redirects.rewrite-url must be an http or https URL when the policy is rewrite")
 )
 
+// repositoryNameRegexp is the repository name grammar of the distribution
+// spec.
+var repositoryNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+// ValidRepositoryName reports whether a name follows the repository name
+// grammar of the distribution spec.
+func ValidRepositoryName(name string) bool {
+	return repositoryNameRegexp.MatchString(name)
+}
+
 type Config struct {
-	LogLevel           LogLevel `name:"log-level" description:"Logging level for the application. One of debug, info, warn, or error" default:"info"`
-	Port               int      `name:"port" description:"Port to listen on" default:"8080"`
-	CORSAllowedOrigins []string `name:"cors-allowed-origins" description:"CORS allowed origins" default:"https://*,http://*"`
-	MyURL              string   `name:"my-url" description:"The protocol, host (and port if necessary) where this proxy is running."`
-	ZotURL             string   `name:"zot-url" description:"The protocol, host (and port if necessary) where the Zot registry is running"`
-	Secret             string   `name:"secret" description:"Secret used to sign tokens, required"`
+	LogLevel           LogLevel           `name:"log-level" description:"Logging level for the application. One of debug, info, warn, or error" default:"info"`
+	Port               int                `name:"port" description:"Port to listen on" default:"8080"`
+	CORSAllowedOrigins []string           `name:"cors-allowed-origins" description:"CORS allowed origins" default:"https://*,http://*"`
+	MyURL              string             `name:"my-url" description:"The protocol, host (and port if necessary) where this proxy is running."`
+	ZotURL             string             `name:"zot-url" description:"The protocol, host (and port if necessary) where the Zot registry is running"`
+	Secret             string             `name:"secret" description:"Secret used to sign tokens, required"`
+	ZotUsername        string             `name:"zot-username" description:"Username the proxy uses for its own background requests to Zot"`
+	ZotPassword        string             `name:"zot-password" description:"Password the proxy uses for its own background requests to Zot"`
+	Anonymous          Anonymous          `name:"anonymous"`
+	Clients            []ClientRule       `name:"clients" description:"Ordered client matching rules. Defaults to the common container clients using the token flow"`
+	Auth               Auth               `name:"auth"`
+	TLS                TLS                `name:"tls"`
+	AccessRules        []AccessRule       `name:"access-rules" description:"Repository access rules enforced by the proxy"`
+	Policies           Policies           `name:"policies"`
+	ReadOnly           Mode               `name:"read-only"`
+	Maintenance        Mode               `name:"maintenance"`
+	Admin              Admin              `name:"admin"`
+	ImmutableTags      []ImmutableTagRule `name:"immutable-tags" description:"Tags that may not be overwritten once pushed"`
+	VulnerabilityGate  VulnerabilityGate  `name:"vulnerability-gate"`
+	Signatures         Signatures         `name:"signatures"`
+	Admission          []AdmissionRule    `name:"admission" description:"Checks manifests must pass before they are pushed"`
+	Quotas             Quotas             `name:"quotas"`
+	SoftDelete         SoftDelete         `name:"soft-delete"`
+	TrustedProxies     []string           `name:"trusted-proxies" description:"CIDRs of reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted"`
+	NetworkRules       []NetworkRule      `name:"network-rules" description:"Source network rules per repository and action"`
+	DockerCompat       DockerCompat       `name:"docker-compat"`
+	Mirror             Mirror             `name:"mirror"`
+	NS                 NamespaceMirror    `name:"ns"`
+	Aliases            []Alias            `name:"aliases" description:"Rewrite rules from repository names clients use to names in Zot. The first matching alias applies"`
+	ReferrersFallback  ReferrersFallback  `name:"referrers-fallback"`
+	PlatformFilters    PlatformFilters    `name:"platform-filters"`
+	StorageRedirects   StorageRedirects   `name:"storage-redirects"`
+}
+
+// StorageRedirects decides what clients get when Zot answers a blob pull
+// with a redirect to its storage, like a presigned S3 URL.
+type StorageRedirects struct {
+	Policy     StorageRedirectPolicy `name:"policy" description:"What to do with storage redirects. One of passthrough, follow, or rewrite" default:"passthrough"`
+	RewriteURL string                `name:"rewrite-url" description:"Storage endpoint the rewrite policy sends clients to, like http://minio.internal:9000"`
+}
+
+type StorageRedirectPolicy string
+
+const (
+	// StorageRedirectPassthrough sends the redirect to the client as is.
+	StorageRedirectPassthrough StorageRedirectPolicy = "passthrough"
+	// StorageRedirectFollow fetches the redirect target and streams it to
+	// the client.
+	StorageRedirectFollow StorageRedirectPolicy = "follow"
+	// StorageRedirectRewrite points the redirect at rewrite-url.
+	StorageRedirectRewrite StorageRedirectPolicy = "rewrite"
+)
+
+// PlatformFilters trims the image indexes and manifest lists served to
+// matching clients down to the platforms they run on.
+type PlatformFilters struct {
+	CacheTTL int                  `name:"cache-ttl" description:"Seconds to cache filtered indexes. Filtered indexes can only be pulled by digest while cached" default:"86400"`
+	Rules    []PlatformFilterRule `name:"rules" description:"Filters by repository and client. The first matching rule applies"`
+}
+
+type PlatformFilterRule struct {
+	Name             string   `name:"name" description:"Name of the rule, used in logs"`
+	Repositories     []string `name:"repositories" description:"Repository globs the rule covers. Empty covers every repository"`
+	Clients          []string `name:"clients" description:"Names of the client rules the rule covers. Empty covers every client"`
+	Platforms        []string `name:"platforms" description:"Platforms to keep, as os/arch or os/arch/variant. Empty keeps every platform"`
+	DropAttestations bool     `name:"drop-attestations" description:"Drop unknown/unknown entries, like BuildKit's attestation manifests" default:"false"`
+}
+
+// ReferrersFallback serves the referrers API from the referrers tag schema
+// when Zot does not answer it, and keeps the tag schema's indexes up to date
+// for clients that only read them.
+type ReferrersFallback struct {
+	Enabled bool `name:"enabled" description:"Serve the referrers API from sha256-<digest> index tags and keep those tags in sync on pushes" default:"false"`
+}
+
+// Alias maps repository names clients use to names in Zot, like the old
+// names of renamed repositories.
+type Alias struct {
+	Name       string `name:"name" description:"Name of the alias, used in logs"`
+	Prefix     string `name:"prefix" description:"Repository prefix clients use. The prefix and the names under it are mapped"`
+	Regex      string `name:"regex" description:"Regular expression matching whole repository names clients use"`
+	Upstream   string `name:"upstream" description:"Name in Zot. Replaces the prefix, or is the regex replacement and may use $1 style groups"`
+	Deprecated bool   `name:"deprecated" description:"Log a warning each time the alias is used" default:"false"`
+}
+
+// NamespaceMirror maps the origin registries containerd names in the ns
+// query parameter of mirror requests to the prefixes Zot stores them under.
+type NamespaceMirror struct {
+	Registries []NamespaceRegistry `name:"registries" description:"Origin registries and the repository prefixes they are stored under in Zot"`
+	Unknown    UnknownNamespace    `name:"unknown" description:"What to do with requests for registries not listed. One of passthrough or deny" default:"passthrough"`
+}
+
+type NamespaceRegistry struct {
+	Registry string `name:"registry" description:"Registry host as containerd sends it, like ghcr.io"`
+	Prefix   string `name:"prefix" description:"Repository prefix the registry is stored under in Zot, like ghcr"`
+}
+
+// UnknownNamespace is what happens to requests whose ns parameter names a
+// registry that is not listed.
+type UnknownNamespace string
+
+const (
+	// UnknownNamespacePassthrough forwards the request under the name the
+	// client sent.
+	UnknownNamespacePassthrough UnknownNamespace = "passthrough"
+	// UnknownNamespaceDeny refuses the request.
+	UnknownNamespaceDeny UnknownNamespace = "deny"
+)
+
+// Mirror serves Zot's copy of Docker Hub under the names the Docker daemon
+// uses when the proxy is one of its registry mirrors.
+type Mirror struct {
+	Enabled         bool   `name:"enabled" description:"Map Docker Hub repository names to their copies in Zot" default:"false"`
+	Prefix          string `name:"prefix" description:"Repository prefix Zot stores Docker Hub content under" default:"docker.io"`
+	ImplicitLibrary bool   `name:"implicit-library" description:"Map single-component names like alpine to library/alpine" default:"true"`
+}
+
+// DockerCompat converts OCI manifests and indexes into Docker schema2
+// manifests and manifest lists for clients that do not accept OCI types.
+type DockerCompat struct {
+	Enabled  bool `name:"enabled" description:"Convert OCI manifests for clients that only accept Docker schema2" default:"false"`
+	CacheTTL int  `name:"cache-ttl" description:"Seconds to cache converted manifests. Converted manifests can only be pulled by digest while cached" default:"86400"`
+}
+
+// NetworkRule restricts the source networks of actions on matching
+// repositories. Clients in a deny network are refused, and when allow is
+// set, so are clients outside every allow network. Every rule covering a
+// request must pass.
+type NetworkRule struct {
+	Name         string   `name:"name" description:"Name of the rule, used in logs"`
+	Repositories []string `name:"repositories" description:"Repository globs the rule covers"`
+	Actions      []Action `name:"actions" description:"Actions the rule covers. Any of pull, push, delete, or catalog"`
+	Allow        []string `name:"allow" description:"CIDRs allowed to perform the actions"`
+	Deny         []string `name:"deny" description:"CIDRs refused the actions"`
+}
+
+// SoftDelete copies manifests into a trash repository before they are
+// deleted, so they can be restored.
+type SoftDelete struct {
+	Enabled       bool   `name:"enabled" description:"Copy manifests into the trash before deleting them" default:"false"`
+	TrashPrefix   string `name:"trash-prefix" description:"Prefix of the trash repositories. Manifests from <name> go to <trash-prefix>/<name>" default:"trash"`
+	Retention     int    `name:"retention" description:"Seconds trashed manifests are kept. 0 keeps them forever" default:"604800"`
+	PurgeInterval int    `name:"purge-interval" description:"Seconds between purges of expired trash" default:"3600"`
+}
+
+// Quotas limit the storage and repositories of namespaces.
+type Quotas struct {
+	ReconcileInterval int              `name:"reconcile-interval" description:"Seconds between recounting usage from Zot. 0 disables reconciling" default:"3600"`
+	Namespaces        []QuotaNamespace `name:"namespaces" description:"Namespaces with quotas. The longest matching prefix applies"`
+}
+
+type QuotaNamespace struct {
+	Prefix          string `name:"prefix" description:"Repository prefix of the namespace, like team-a"`
+	MaxBytes        int64  `name:"max-bytes" description:"Most bytes of unique blobs the namespace may store. 0 is unlimited"`
+	MaxRepositories int    `name:"max-repositories" description:"Most repositories the namespace may have. 0 is unlimited"`
+}
+
+// AdmissionRule constrains the manifests pushed to matching repositories.
+// Every rule that matches a repository applies. Zero limits are not
+// enforced.
+type AdmissionRule struct {
+	Name                   string   `name:"name" description:"Name of the rule, used in errors and logs"`
+	Repositories           []string `name:"repositories" description:"Repository globs the rule covers"`
+	MaxManifestSize        int64    `name:"max-manifest-size" description:"Largest manifest in bytes"`
+	MaxTotalLayerSize      int64    `name:"max-total-layer-size" description:"Largest sum of the layer sizes of an image in bytes"`
+	MaxLayers              int      `name:"max-layers" description:"Most layers an image may have"`
+	AllowedMediaTypes      []string `name:"allowed-media-types" description:"Manifest media types that may be pushed"`
+	AllowedLayerMediaTypes []string `name:"allowed-layer-media-types" description:"Layer media types an image may contain"`
+	RequiredPlatforms      []string `name:"required-platforms" description:"Platforms, as os/arch or os/arch/variant, an index must contain"`
+	RequiredAnnotations    []string `name:"required-annotations" description:"Keys that must be set as manifest annotations or image config labels"`
+}
+
+// Signatures requires images in protected repositories to be signed with
+// cosign or Notation before they are served.
+type Signatures struct {
+	CacheTTL int             `name:"cache-ttl" description:"Seconds to cache the verification result of a digest" default:"300"`
+	Rules    []SignatureRule `name:"rules" description:"Repositories that require signatures. The first matching rule applies"`
+}
+
+type SignatureRule struct {
+	Repositories []string `name:"repositories" description:"Repository globs the rule covers"`
+	Keys         []string `name:"keys" description:"PEM files with the public keys or certificates trusted to sign images"`
+}
+
+// VulnerabilityGate denies pulls of images Zot's scanner found
+// vulnerabilities in.
+type VulnerabilityGate struct {
+	Enabled             bool     `name:"enabled" description:"Deny pulls of images with vulnerabilities at or above the severity" default:"false"`
+	Severity            Severity `name:"severity" description:"Lowest severity that denies a pull. One of LOW, MEDIUM, HIGH, or CRITICAL" default:"CRITICAL"`
+	AllowedCVEs         []string `name:"allowed-cves" description:"CVE IDs that never deny a pull"`
+	AllowedRepositories []string `name:"allowed-repositories" description:"Repository globs exempt from the gate"`
+	CacheTTL            int      `name:"cache-ttl" description:"Seconds to cache the scan results of an image" default:"300"`
+	FailOpen            bool     `name:"fail-open" description:"Allow pulls when the scan results cannot be fetched" default:"false"`
+}
+
+type Severity string
+
+const (
+	SeverityLow      Severity = "LOW"
+	SeverityMedium   Severity = "MEDIUM"
+	SeverityHigh     Severity = "HIGH"
+	SeverityCritical Severity = "CRITICAL"
+)
+
+// Rank orders severities from 1 for LOW to 4 for CRITICAL. Unknown
+// severities rank 0.
+func (s Severity) Rank() int {
+	switch s {
+	case SeverityLow:
+		return 1
+	case SeverityMedium:
+		return 2
+	case SeverityHigh:
+		return 3
+	case SeverityCritical:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// ImmutableTagRule makes matching tags write-once. Pushing a tag again is
+// only allowed with the digest it already points to.
+type ImmutableTagRule struct {
+	Repositories     []string `name:"repositories" description:"Repository globs the rule covers"`
+	Tags             []string `name:"tags" description:"Tag globs that are write-once"`
+	ExemptIdentities []string `name:"exempt-identities" description:"Identity names allowed to overwrite matching tags"`
+}
+
+// Mode is a switchable registry mode, like read-only or maintenance.
+type Mode struct {
+	Enabled      bool     `name:"enabled" json:"enabled" description:"Whether the mode is on" default:"false"`
+	Repositories []string `name:"repositories" json:"repositories,omitempty" description:"Repository globs the mode applies to. Applies to all repositories when empty"`
+	Message      string   `name:"message" json:"message,omitempty" description:"Message returned to clients"`
+	RetryAfter   int      `name:"retry-after" json:"retry-after" description:"Seconds sent in the Retry-After header" default:"300"`
+	StatusBody   string   `name:"status-body" json:"status-body,omitempty" description:"Static status page served to pulls in maintenance mode. Pulls get the OCI error when empty"`
+}
+
+type Admin struct {
+	Token string `name:"token" description:"Bearer token for the admin API. The admin API is disabled when empty"`
 }
 
+// Policies are CEL expressions evaluated for every distribution API request.
+type Policies struct {
+	DryRun bool         `name:"dry-run" description:"Log requests policies would deny instead of denying them" default:"false"`
+	Rules  []PolicyRule `name:"rules" description:"CEL policies that must all evaluate to true for a request to be allowed"`
+}
+
+type PolicyRule struct {
+	Name       string `name:"name" description:"Name of the policy, used in logs"`
+	Expression string `name:"expression" description:"CEL expression that must evaluate to true to allow the request"`
+	Message    string `name:"message" description:"Message returned to clients when the policy denies a request"`
+}
+
+// AccessRule grants actions on matching repositories to identities and
+// groups. Once any rule covers a repository and action, only the callers
+// listed by a covering rule are allowed.
+type AccessRule struct {
+	Repositories []string `name:"repositories" description:"Repository globs the rule covers"`
+	Actions      []Action `name:"actions" description:"Actions the rule covers. Any of pull, push, delete, or catalog"`
+	Identities   []string `name:"identities" description:"Identity names allowed. anonymous matches unauthenticated callers, * matches any authenticated caller"`
+	Groups       []string `name:"groups" description:"Groups allowed"`
+}
+
+type Action string
+
+const (
+	ActionPull    Action = "pull"
+	ActionPush    Action = "push"
+	ActionDelete  Action = "delete"
+	ActionCatalog Action = "catalog"
+)
+
+type TLS struct {
+	CertFile     string `name:"cert-file" description:"TLS certificate file. Serves HTTPS when set"`
+	KeyFile      string `name:"key-file" description:"TLS private key file"`
+	ClientCAFile string `name:"client-ca-file" description:"CA bundle used to verify client certificates for mtls authentication"`
+}
+
+type Auth struct {
+	Mode             AuthMode              `name:"mode" description:"How the authenticator chain is evaluated. One of first-match or all-required" default:"first-match"`
+	Chain            []AuthenticatorConfig `name:"chain" description:"Ordered authenticators. Defaults to basic followed by anonymous"`
+	TrustPassthrough bool                  `name:"trust-passthrough" description:"Let access rules, policies, and immutable tag exemptions match identities from the basic authenticator. Only set when Zot verifies the same credentials" default:"false"`
+}
+
+type AuthMode string
+
+const (
+	// AuthModeFirstMatch uses the identity of the first authenticator that
+	// recognizes the request.
+	AuthModeFirstMatch AuthMode = "first-match"
+	// AuthModeAllRequired requires every authenticator to accept the request.
+	AuthModeAllRequired AuthMode = "all-required"
+)
+
+type AuthenticatorConfig struct {
+	Type   AuthenticatorType `name:"type" description:"One of anonymous, basic, htpasswd, jwt, or mtls"`
+	Name   string            `name:"name" description:"Name used in logs. Defaults to the type"`
+	Groups []string          `name:"groups" description:"Groups added to every identity from this authenticator"`
+
+	HtpasswdFile string `name:"htpasswd-file" description:"htpasswd file with bcrypt hashes"`
+
+	JWTSecret        string `name:"jwt-secret" description:"HMAC secret for HS256, HS384, and HS512 tokens"`
+	JWTPublicKeyFile string `name:"jwt-public-key-file" description:"PEM public key or certificate for RSA, ECDSA, and Ed25519 tokens"`
+	JWTIssuer        string `name:"jwt-issuer" description:"Required iss claim"`
+	JWTAudience      string `name:"jwt-audience" description:"Required aud claim"`
+	JWTUsernameClaim string `name:"jwt-username-claim" description:"Claim holding the username. Defaults to sub"`
+	JWTGroupsClaim   string `name:"jwt-groups-claim" description:"Claim holding the groups. Defaults to groups"`
+}
+
+type AuthenticatorType string
+
+const (
+	// AuthenticatorAnonymous accepts requests without credentials.
+	AuthenticatorAnonymous AuthenticatorType = "anonymous"
+	// AuthenticatorBasic accepts any Basic credentials and forwards them to Zot.
+	AuthenticatorBasic AuthenticatorType = "basic"
+	// AuthenticatorHtpasswd verifies Basic credentials against an htpasswd file.
+	AuthenticatorHtpasswd AuthenticatorType = "htpasswd"
+	// AuthenticatorJWT verifies bearer JWTs, or JWTs passed as a Basic password.
+	AuthenticatorJWT AuthenticatorType = "jwt"
+	// AuthenticatorMTLS uses verified TLS client certificates.
+	AuthenticatorMTLS AuthenticatorType = "mtls"
+)
+
+// DefaultAuthChain is used when no authenticators are configured, and
+// matches the original proxy behavior.
+func DefaultAuthChain() []AuthenticatorConfig {
+	return []AuthenticatorConfig{
+		{Type: AuthenticatorBasic},
+		{Type: AuthenticatorAnonymous},
+	}
+}
+
+type Anonymous struct {
+	Policy       AnonymousPolicy `name:"policy" description:"Anonymous access policy. One of disabled, pull, or pull-repositories" default:"pull"`
+	Repositories []string        `name:"repositories" description:"Repository globs anonymous users may pull from when policy is pull-repositories"`
+}
+
+type AnonymousPolicy string
+
+const (
+	AnonymousPolicyDisabled         AnonymousPolicy = "disabled"
+	AnonymousPolicyPull             AnonymousPolicy = "pull"
+	AnonymousPolicyPullRepositories AnonymousPolicy = "pull-repositories"
+)
+
 type LogLevel string
 
 const (
@@ -33,6 +477,39 @@ const (
 	LogLevelError LogLevel = "error"
 )
 
+// ClientRule selects how requests from matching clients are handled. All
+// conditions that are set must match.
+type ClientRule struct {
+	Name      string        `name:"name" description:"Name of the rule, used in logs"`
+	UserAgent string        `name:"user-agent" description:"Regular expression matched against the User-Agent header"`
+	Header    string        `name:"header" description:"Header that must be present on the request"`
+	CIDRs     []string      `name:"cidrs" description:"Source networks the client must connect from"`
+	Profile   ClientProfile `name:"profile" description:"Handling profile. One of token, passthrough, or deny"`
+}
+
+type ClientProfile string
+
+const (
+	// ClientProfileToken runs the Docker token flow in front of Zot.
+	ClientProfileToken ClientProfile = "token"
+	// ClientProfilePassthrough forwards requests to Zot unmodified.
+	ClientProfilePassthrough ClientProfile = "passthrough"
+	// ClientProfileDeny refuses requests.
+	ClientProfileDeny ClientProfile = "deny"
+)
+
+// DefaultClientRules are used when no client rules are configured.
+func DefaultClientRules() []ClientRule {
+	return []ClientRule{
+		{Name: "docker", UserAgent: `^docker/`, Profile: ClientProfileToken},
+		{Name: "buildkit", UserAgent: `^buildkit/`, Profile: ClientProfileToken},
+		{Name: "containerd", UserAgent: `^containerd/`, Profile: ClientProfileToken},
+		{Name: "nerdctl", UserAgent: `^nerdctl/`, Profile: ClientProfileToken},
+		{Name: "podman", UserAgent: `^(containers|[Pp]odman|[Bb]uildah|[Ss]kopeo)/`, Profile: ClientProfileToken},
+		{Name: "kaniko", UserAgent: `^kaniko/`, Profile: ClientProfileToken},
+	}
+}
+
 func (c Config) Validate() error {
 	if c.LogLevel != LogLevelDebug &&
 		c.LogLevel != LogLevelInfo &&
@@ -67,5 +544,459 @@ func (c Config) Validate() error {
 		return ErrSecretRequired
 	}
 
+	switch c.Anonymous.Policy {
+	case "", AnonymousPolicyDisabled, AnonymousPolicyPull:
+	case AnonymousPolicyPullRepositories:
+		if len(c.Anonymous.Repositories) == 0 {
+			return ErrAnonymousRepositoriesMissing
+		}
+	default:
+		return ErrInvalidAnonymousPolicy
+	}
+
+	for _, pattern := range c.Anonymous.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidAnonymousRepository
+		}
+	}
+
+	for _, rule := range c.Clients {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return ErrTLSCertAndKeyRequired
+	}
+
+	switch c.Auth.Mode {
+	case "", AuthModeFirstMatch, AuthModeAllRequired:
+	default:
+		return ErrInvalidAuthMode
+	}
+
+	for _, authenticator := range c.Auth.Chain {
+		if err := authenticator.validate(c); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range c.AccessRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range c.Policies.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.ReadOnly.validate(ErrInvalidReadOnlyRepository); err != nil {
+		return err
+	}
+
+	if err := c.Maintenance.validate(ErrInvalidMaintenanceRepository); err != nil {
+		return err
+	}
+
+	for _, rule := range c.ImmutableTags {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.VulnerabilityGate.validate(); err != nil {
+		return err
+	}
+
+	if c.Signatures.CacheTTL < 0 {
+		return ErrInvalidSignatureCacheTTL
+	}
+
+	for _, rule := range c.Signatures.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range c.Admission {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Quotas.ReconcileInterval < 0 {
+		return ErrInvalidQuotaReconcileInterval
+	}
+
+	for _, namespace := range c.Quotas.Namespaces {
+		if err := namespace.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.SoftDelete.validate(); err != nil {
+		return err
+	}
+
+	if c.DockerCompat.Enabled && c.DockerCompat.CacheTTL <= 0 {
+		return ErrInvalidDockerCompatCacheTTL
+	}
+
+	if c.Mirror.Enabled && !repositoryNameRegexp.MatchString(c.Mirror.Prefix) {
+		return ErrInvalidMirrorPrefix
+	}
+
+	if err := c.NS.validate(); err != nil {
+		return err
+	}
+
+	for _, alias := range c.Aliases {
+		if err := alias.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.PlatformFilters.validate(c); err != nil {
+		return err
+	}
+
+	if err := c.StorageRedirects.validate(); err != nil {
+		return err
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return ErrInvalidTrustedProxy
+		}
+	}
+
+	for _, rule := range c.NetworkRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r ClientRule) validate() error {
+	switch r.Profile {
+	case ClientProfileToken, ClientProfilePassthrough, ClientProfileDeny:
+	default:
+		return ErrInvalidClientProfile
+	}
+
+	if r.UserAgent == "" && r.Header == "" && len(r.CIDRs) == 0 {
+		return ErrClientRuleEmpty
+	}
+
+	if r.UserAgent != "" {
+		if _, err := regexp.Compile(r.UserAgent); err != nil {
+			return ErrInvalidClientUserAgent
+		}
+	}
+
+	for _, cidr := range r.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return ErrInvalidClientCIDR
+		}
+	}
+
+	return nil
+}
+
+func (a AuthenticatorConfig) validate(c Config) error {
+	switch a.Type {
+	case AuthenticatorAnonymous, AuthenticatorBasic:
+	case AuthenticatorHtpasswd:
+		if a.HtpasswdFile == "" {
+			return ErrHtpasswdFileRequired
+		}
+	case AuthenticatorJWT:
+		if a.JWTSecret == "" && a.JWTPublicKeyFile == "" {
+			return ErrJWTKeyRequired
+		}
+	case AuthenticatorMTLS:
+		if c.TLS.ClientCAFile == "" {
+			return ErrMTLSRequiresClientCA
+		}
+	default:
+		return ErrInvalidAuthenticatorType
+	}
+	return nil
+}
+
+func (r AccessRule) validate() error {
+	if len(r.Actions) == 0 {
+		return ErrAccessActionsRequired
+	}
+	catalogOnly := true
+	for _, action := range r.Actions {
+		switch action {
+		case ActionPull, ActionPush, ActionDelete:
+			catalogOnly = false
+		case ActionCatalog:
+		default:
+			return ErrInvalidAccessAction
+		}
+	}
+	if !catalogOnly && len(r.Repositories) == 0 {
+		return ErrAccessRepositoriesRequired
+	}
+	for _, pattern := range r.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidAccessRepository
+		}
+	}
+	if len(r.Identities) == 0 && len(r.Groups) == 0 {
+		return ErrAccessPrincipalsRequired
+	}
+	return nil
+}
+
+func (p PolicyRule) validate() error {
+	if p.Name == "" {
+		return ErrPolicyNameRequired
+	}
+	if p.Expression == "" {
+		return ErrPolicyExpressionRequired
+	}
+	if _, err := policy.Compile(p.Name, p.Expression, p.Message); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPolicy, err)
+	}
+	return nil
+}
+
+func (m Mode) validate(errInvalidRepository error) error {
+	if m.RetryAfter < 0 {
+		return ErrInvalidRetryAfter
+	}
+	for _, pattern := range m.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return errInvalidRepository
+		}
+	}
+	return nil
+}
+
+func (r ImmutableTagRule) validate() error {
+	if len(r.Repositories) == 0 {
+		return ErrImmutableRepositoriesRequired
+	}
+	if len(r.Tags) == 0 {
+		return ErrImmutableTagsRequired
+	}
+	for _, pattern := range r.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidImmutableRepository
+		}
+	}
+	for _, pattern := range r.Tags {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidImmutableTag
+		}
+	}
+	return nil
+}
+
+func (v VulnerabilityGate) validate() error {
+	if !v.Enabled {
+		return nil
+	}
+	if v.Severity.Rank() == 0 {
+		return ErrInvalidVulnerabilitySeverity
+	}
+	if v.CacheTTL < 0 {
+		return ErrInvalidVulnerabilityCacheTTL
+	}
+	for _, pattern := range v.AllowedRepositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidVulnerabilityRepository
+		}
+	}
+	return nil
+}
+
+func (r SignatureRule) validate() error {
+	if len(r.Repositories) == 0 {
+		return ErrSignatureRepositoriesRequired
+	}
+	for _, pattern := range r.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidSignatureRepository
+		}
+	}
+	if len(r.Keys) == 0 {
+		return ErrSignatureKeysRequired
+	}
+	return nil
+}
+
+func (r AdmissionRule) validate() error {
+	if len(r.Repositories) == 0 {
+		return ErrAdmissionRepositoriesRequired
+	}
+	for _, pattern := range r.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidAdmissionRepository
+		}
+	}
+	if r.MaxManifestSize < 0 || r.MaxTotalLayerSize < 0 || r.MaxLayers < 0 {
+		return ErrInvalidAdmissionLimit
+	}
+	for _, platform := range r.RequiredPlatforms {
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+			return ErrInvalidAdmissionPlatform
+		}
+	}
+	return nil
+}
+
+func (n QuotaNamespace) validate() error {
+	if strings.Trim(n.Prefix, "/") == "" {
+		return ErrQuotaPrefixRequired
+	}
+	if n.MaxBytes < 0 || n.MaxRepositories < 0 {
+		return ErrInvalidQuotaLimit
+	}
+	return nil
+}
+
+func (s SoftDelete) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if !repositoryNameRegexp.MatchString(s.TrashPrefix) {
+		return ErrInvalidTrashPrefix
+	}
+	if s.Retention < 0 {
+		return ErrInvalidTrashRetention
+	}
+	if s.PurgeInterval < 0 {
+		return ErrInvalidTrashPurgeEvery
+	}
+	return nil
+}
+
+func (n NamespaceMirror) validate() error {
+	switch n.Unknown {
+	case "", UnknownNamespacePassthrough, UnknownNamespaceDeny:
+	default:
+		return ErrInvalidNamespaceUnknown
+	}
+	for _, registry := range n.Registries {
+		if registry.Registry == "" || strings.ContainsAny(registry.Registry, "/ ") {
+			return ErrInvalidNamespaceRegistry
+		}
+		if !repositoryNameRegexp.MatchString(registry.Prefix) {
+			return ErrInvalidNamespacePrefix
+		}
+	}
+	return nil
+}
+
+func (a Alias) validate() error {
+	switch {
+	case (a.Prefix == "") == (a.Regex == ""):
+		return ErrAliasMatchRequired
+	case a.Prefix != "":
+		if !repositoryNameRegexp.MatchString(a.Prefix) {
+			return ErrInvalidAliasPrefix
+		}
+		if !repositoryNameRegexp.MatchString(a.Upstream) {
+			return ErrAliasUpstream
+		}
+	default:
+		if _, err := regexp.Compile(a.Regex); err != nil {
+			return ErrInvalidAliasRegex
+		}
+		if a.Upstream == "" {
+			return ErrAliasUpstream
+		}
+	}
+	return nil
+}
+
+func (p PlatformFilters) validate(c Config) error {
+	if len(p.Rules) > 0 && p.CacheTTL <= 0 {
+		return ErrInvalidPlatformFilterCacheTTL
+	}
+	clients := c.Clients
+	if len(clients) == 0 {
+		clients = DefaultClientRules()
+	}
+	for _, rule := range p.Rules {
+		if len(rule.Platforms) == 0 && !rule.DropAttestations {
+			return ErrPlatformFilterEmpty
+		}
+		for _, pattern := range rule.Repositories {
+			if err := glob.Validate(pattern); err != nil {
+				return ErrInvalidPlatformFilterRepository
+			}
+		}
+		for _, platform := range rule.Platforms {
+			parts := strings.Split(platform, "/")
+			if len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+				return ErrInvalidPlatformFilterPlatform
+			}
+		}
+		for _, name := range rule.Clients {
+			if !slices.ContainsFunc(clients, func(client ClientRule) bool { return client.Name == name }) {
+				return ErrUnknownPlatformFilterClient
+			}
+		}
+	}
+	return nil
+}
+
+func (s StorageRedirects) validate() error {
+	switch s.Policy {
+	case "", StorageRedirectPassthrough, StorageRedirectFollow:
+	case StorageRedirectRewrite:
+		target, err := url.Parse(s.RewriteURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return ErrInvalidStorageRewriteURL
+		}
+	default:
+		return ErrInvalidStorageRedirectPolicy
+	}
+	return nil
+}
+
+func (r NetworkRule) validate() error {
+	if len(r.Actions) == 0 {
+		return ErrNetworkActionsRequired
+	}
+	catalogOnly := true
+	for _, action := range r.Actions {
+		switch action {
+		case ActionPull, ActionPush, ActionDelete:
+			catalogOnly = false
+		case ActionCatalog:
+		default:
+			return ErrInvalidNetworkAction
+		}
+	}
+	if !catalogOnly && len(r.Repositories) == 0 {
+		return ErrNetworkRepositoriesRequired
+	}
+	for _, pattern := range r.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			return ErrInvalidNetworkRepository
+		}
+	}
+	if len(r.Allow) == 0 && len(r.Deny) == 0 {
+		return ErrNetworkRuleEmpty
+	}
+	for _, cidr := range slices.Concat(r.Allow, r.Deny) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return ErrInvalidNetworkCIDR
+		}
+	}
 	return nil
 }
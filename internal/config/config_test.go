@@ -52,6 +52,431 @@ func TestConfigValidate(t *testing.T) {
 			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, CORSAllowedOrigins: []string{"*"}, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000"},
 			wantErr: ErrSecretRequired,
 		},
+		{
+			name:    "invalid anonymous policy",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Anonymous: Anonymous{Policy: "bad"}},
+			wantErr: ErrInvalidAnonymousPolicy,
+		},
+		{
+			name:    "pull-repositories without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Anonymous: Anonymous{Policy: AnonymousPolicyPullRepositories}},
+			wantErr: ErrAnonymousRepositoriesMissing,
+		},
+		{
+			name:    "pull-repositories with repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Anonymous: Anonymous{Policy: AnonymousPolicyPullRepositories, Repositories: []string{"public/**"}}},
+			wantErr: nil,
+		},
+		{
+			name:    "invalid client profile",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Clients: []ClientRule{{UserAgent: "^docker/", Profile: "bad"}}},
+			wantErr: ErrInvalidClientProfile,
+		},
+		{
+			name:    "empty client rule",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Clients: []ClientRule{{Profile: ClientProfileToken}}},
+			wantErr: ErrClientRuleEmpty,
+		},
+		{
+			name:    "invalid client user agent",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Clients: []ClientRule{{UserAgent: "(", Profile: ClientProfileToken}}},
+			wantErr: ErrInvalidClientUserAgent,
+		},
+		{
+			name:    "invalid client cidr",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Clients: []ClientRule{{CIDRs: []string{"10.0.0.0"}, Profile: ClientProfileDeny}}},
+			wantErr: ErrInvalidClientCIDR,
+		},
+		{
+			name:    "invalid auth mode",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Auth: Auth{Mode: "bad"}},
+			wantErr: ErrInvalidAuthMode,
+		},
+		{
+			name:    "invalid authenticator type",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Auth: Auth{Chain: []AuthenticatorConfig{{Type: "bad"}}}},
+			wantErr: ErrInvalidAuthenticatorType,
+		},
+		{
+			name:    "htpasswd without file",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Auth: Auth{Chain: []AuthenticatorConfig{{Type: AuthenticatorHtpasswd}}}},
+			wantErr: ErrHtpasswdFileRequired,
+		},
+		{
+			name:    "jwt without key",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Auth: Auth{Chain: []AuthenticatorConfig{{Type: AuthenticatorJWT}}}},
+			wantErr: ErrJWTKeyRequired,
+		},
+		{
+			name:    "mtls without client ca",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Auth: Auth{Chain: []AuthenticatorConfig{{Type: AuthenticatorMTLS}}}},
+			wantErr: ErrMTLSRequiresClientCA,
+		},
+		{
+			name:    "tls cert without key",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", TLS: TLS{CertFile: "cert.pem"}},
+			wantErr: ErrTLSCertAndKeyRequired,
+		},
+		{
+			name:    "access rule without actions",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", AccessRules: []AccessRule{{Repositories: []string{"a/*"}, Groups: []string{"g"}}}},
+			wantErr: ErrAccessActionsRequired,
+		},
+		{
+			name:    "access rule with invalid action",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", AccessRules: []AccessRule{{Repositories: []string{"a/*"}, Actions: []Action{"bad"}, Groups: []string{"g"}}}},
+			wantErr: ErrInvalidAccessAction,
+		},
+		{
+			name:    "access rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", AccessRules: []AccessRule{{Actions: []Action{ActionPull}, Groups: []string{"g"}}}},
+			wantErr: ErrAccessRepositoriesRequired,
+		},
+		{
+			name:    "catalog access rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", AccessRules: []AccessRule{{Actions: []Action{ActionCatalog}, Identities: []string{"admin"}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "access rule without principals",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", AccessRules: []AccessRule{{Repositories: []string{"a/*"}, Actions: []Action{ActionPull}}}},
+			wantErr: ErrAccessPrincipalsRequired,
+		},
+		{
+			name:    "policy without name",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Policies: Policies{Rules: []PolicyRule{{Expression: "true"}}}},
+			wantErr: ErrPolicyNameRequired,
+		},
+		{
+			name:    "policy with syntax error",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Policies: Policies{Rules: []PolicyRule{{Name: "broken", Expression: "action =="}}}},
+			wantErr: ErrInvalidPolicy,
+		},
+		{
+			name:    "valid policy",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Policies: Policies{Rules: []PolicyRule{{Name: "no-deletes", Expression: `action != "delete"`}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "read-only with invalid repository glob",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ReadOnly: Mode{Enabled: true, Repositories: []string{"a/***"}}},
+			wantErr: ErrInvalidReadOnlyRepository,
+		},
+		{
+			name:    "maintenance with invalid repository glob",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Maintenance: Mode{Enabled: true, Repositories: []string{""}}},
+			wantErr: ErrInvalidMaintenanceRepository,
+		},
+		{
+			name:    "negative retry-after",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ReadOnly: Mode{Enabled: true, RetryAfter: -1}},
+			wantErr: ErrInvalidRetryAfter,
+		},
+		{
+			name:    "valid read-only mode",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ReadOnly: Mode{Enabled: true, Repositories: []string{"archive/**"}, RetryAfter: 60}},
+			wantErr: nil,
+		},
+		{
+			name:    "immutable tag rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ImmutableTags: []ImmutableTagRule{{Tags: []string{"v*"}}}},
+			wantErr: ErrImmutableRepositoriesRequired,
+		},
+		{
+			name:    "immutable tag rule without tags",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ImmutableTags: []ImmutableTagRule{{Repositories: []string{"team/**"}}}},
+			wantErr: ErrImmutableTagsRequired,
+		},
+		{
+			name:    "immutable tag rule with invalid tag glob",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ImmutableTags: []ImmutableTagRule{{Repositories: []string{"team/**"}, Tags: []string{"v***"}}}},
+			wantErr: ErrInvalidImmutableTag,
+		},
+		{
+			name:    "valid immutable tag rule",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", ImmutableTags: []ImmutableTagRule{{Repositories: []string{"team/**"}, Tags: []string{"v*"}, ExemptIdentities: []string{"admin"}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "vulnerability gate with invalid severity",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", VulnerabilityGate: VulnerabilityGate{Enabled: true, Severity: "SEVERE"}},
+			wantErr: ErrInvalidVulnerabilitySeverity,
+		},
+		{
+			name:    "vulnerability gate with negative cache TTL",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", VulnerabilityGate: VulnerabilityGate{Enabled: true, Severity: SeverityHigh, CacheTTL: -1}},
+			wantErr: ErrInvalidVulnerabilityCacheTTL,
+		},
+		{
+			name:    "vulnerability gate with invalid repository glob",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", VulnerabilityGate: VulnerabilityGate{Enabled: true, Severity: SeverityHigh, AllowedRepositories: []string{"a/***"}}},
+			wantErr: ErrInvalidVulnerabilityRepository,
+		},
+		{
+			name:    "disabled vulnerability gate is not validated",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", VulnerabilityGate: VulnerabilityGate{Severity: "SEVERE"}},
+			wantErr: nil,
+		},
+		{
+			name:    "signature rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Signatures: Signatures{Rules: []SignatureRule{{Keys: []string{"cosign.pub"}}}}},
+			wantErr: ErrSignatureRepositoriesRequired,
+		},
+		{
+			name:    "signature rule without keys",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Signatures: Signatures{Rules: []SignatureRule{{Repositories: []string{"prod/**"}}}}},
+			wantErr: ErrSignatureKeysRequired,
+		},
+		{
+			name:    "signatures with negative cache TTL",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Signatures: Signatures{CacheTTL: -1}},
+			wantErr: ErrInvalidSignatureCacheTTL,
+		},
+		{
+			name:    "valid signature rule",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Signatures: Signatures{CacheTTL: 300, Rules: []SignatureRule{{Repositories: []string{"prod/**"}, Keys: []string{"cosign.pub"}}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "admission rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Admission: []AdmissionRule{{MaxLayers: 10}}},
+			wantErr: ErrAdmissionRepositoriesRequired,
+		},
+		{
+			name:    "admission rule with negative limit",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Admission: []AdmissionRule{{Repositories: []string{"prod/**"}, MaxTotalLayerSize: -1}}},
+			wantErr: ErrInvalidAdmissionLimit,
+		},
+		{
+			name:    "admission rule with invalid platform",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Admission: []AdmissionRule{{Repositories: []string{"prod/**"}, RequiredPlatforms: []string{"linux"}}}},
+			wantErr: ErrInvalidAdmissionPlatform,
+		},
+		{
+			name:    "valid admission rule",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Admission: []AdmissionRule{{Repositories: []string{"prod/**"}, MaxLayers: 10, RequiredPlatforms: []string{"linux/arm/v7"}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "quota namespace without prefix",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Quotas: Quotas{Namespaces: []QuotaNamespace{{Prefix: "/", MaxBytes: 1000}}}},
+			wantErr: ErrQuotaPrefixRequired,
+		},
+		{
+			name:    "quota namespace with negative limit",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Quotas: Quotas{Namespaces: []QuotaNamespace{{Prefix: "team-a", MaxRepositories: -1}}}},
+			wantErr: ErrInvalidQuotaLimit,
+		},
+		{
+			name:    "quotas with negative reconcile interval",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Quotas: Quotas{ReconcileInterval: -1}},
+			wantErr: ErrInvalidQuotaReconcileInterval,
+		},
+		{
+			name:    "valid quotas",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Quotas: Quotas{ReconcileInterval: 3600, Namespaces: []QuotaNamespace{{Prefix: "team-a", MaxBytes: 1000, MaxRepositories: 5}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "soft delete with invalid trash prefix",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", SoftDelete: SoftDelete{Enabled: true, TrashPrefix: "_trash"}},
+			wantErr: ErrInvalidTrashPrefix,
+		},
+		{
+			name:    "soft delete with negative retention",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", SoftDelete: SoftDelete{Enabled: true, TrashPrefix: "trash", Retention: -1}},
+			wantErr: ErrInvalidTrashRetention,
+		},
+		{
+			name:    "soft delete with negative purge interval",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", SoftDelete: SoftDelete{Enabled: true, TrashPrefix: "trash", PurgeInterval: -1}},
+			wantErr: ErrInvalidTrashPurgeEvery,
+		},
+		{
+			name:    "disabled soft delete is not validated",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", SoftDelete: SoftDelete{TrashPrefix: "_trash"}},
+			wantErr: nil,
+		},
+		{
+			name:    "valid soft delete",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", SoftDelete: SoftDelete{Enabled: true, TrashPrefix: "trash", Retention: 604800, PurgeInterval: 3600}},
+			wantErr: nil,
+		},
+		{
+			name:    "invalid trusted proxy",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", TrustedProxies: []string{"10.0.0.1"}},
+			wantErr: ErrInvalidTrustedProxy,
+		},
+		{
+			name:    "network rule without actions",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Repositories: []string{"**"}, Allow: []string{"10.0.0.0/8"}}}},
+			wantErr: ErrNetworkActionsRequired,
+		},
+		{
+			name:    "network rule with invalid action",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Repositories: []string{"**"}, Actions: []Action{"write"}, Allow: []string{"10.0.0.0/8"}}}},
+			wantErr: ErrInvalidNetworkAction,
+		},
+		{
+			name:    "network rule without repositories",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Actions: []Action{ActionPush}, Allow: []string{"10.0.0.0/8"}}}},
+			wantErr: ErrNetworkRepositoriesRequired,
+		},
+		{
+			name:    "network rule with invalid repository",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Repositories: []string{"a/***"}, Actions: []Action{ActionPush}, Allow: []string{"10.0.0.0/8"}}}},
+			wantErr: ErrInvalidNetworkRepository,
+		},
+		{
+			name:    "network rule without networks",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Repositories: []string{"**"}, Actions: []Action{ActionPush}}}},
+			wantErr: ErrNetworkRuleEmpty,
+		},
+		{
+			name:    "network rule with invalid CIDR",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NetworkRules: []NetworkRule{{Repositories: []string{"**"}, Actions: []Action{ActionPush}, Deny: []string{"not-a-cidr"}}}},
+			wantErr: ErrInvalidNetworkCIDR,
+		},
+		{
+			name:    "valid network rules",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", TrustedProxies: []string{"10.0.0.0/24"}, NetworkRules: []NetworkRule{{Actions: []Action{ActionCatalog}, Allow: []string{"10.0.0.0/8"}}, {Repositories: []string{"internal/**"}, Actions: []Action{ActionPull, ActionPush}, Allow: []string{"10.96.0.0/12"}, Deny: []string{"10.96.1.0/24"}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "docker compat without cache",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", DockerCompat: DockerCompat{Enabled: true}},
+			wantErr: ErrInvalidDockerCompatCacheTTL,
+		},
+		{
+			name:    "valid docker compat",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", DockerCompat: DockerCompat{Enabled: true, CacheTTL: 86400}},
+			wantErr: nil,
+		},
+		{
+			name:    "mirror with invalid prefix",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Mirror: Mirror{Enabled: true, Prefix: "_docker"}},
+			wantErr: ErrInvalidMirrorPrefix,
+		},
+		{
+			name:    "valid mirror",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Mirror: Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true}},
+			wantErr: nil,
+		},
+		{
+			name:    "ns registry with path",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NS: NamespaceMirror{Registries: []NamespaceRegistry{{Registry: "ghcr.io/org", Prefix: "ghcr"}}}},
+			wantErr: ErrInvalidNamespaceRegistry,
+		},
+		{
+			name:    "ns registry with invalid prefix",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NS: NamespaceMirror{Registries: []NamespaceRegistry{{Registry: "ghcr.io", Prefix: "GHCR"}}}},
+			wantErr: ErrInvalidNamespacePrefix,
+		},
+		{
+			name:    "invalid ns unknown policy",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NS: NamespaceMirror{Unknown: "drop"}},
+			wantErr: ErrInvalidNamespaceUnknown,
+		},
+		{
+			name:    "valid ns registries",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", NS: NamespaceMirror{Registries: []NamespaceRegistry{{Registry: "ghcr.io", Prefix: "ghcr"}, {Registry: "registry.k8s.io", Prefix: "mirrors/k8s"}}, Unknown: UnknownNamespaceDeny}},
+			wantErr: nil,
+		},
+		{
+			name:    "alias with prefix and regex",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Prefix: "old", Regex: "old-(.*)", Upstream: "new"}}},
+			wantErr: ErrAliasMatchRequired,
+		},
+		{
+			name:    "alias without match",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Upstream: "new"}}},
+			wantErr: ErrAliasMatchRequired,
+		},
+		{
+			name:    "alias with invalid prefix",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Prefix: "Old", Upstream: "new"}}},
+			wantErr: ErrInvalidAliasPrefix,
+		},
+		{
+			name:    "alias with invalid regex",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Regex: "old-(", Upstream: "new"}}},
+			wantErr: ErrInvalidAliasRegex,
+		},
+		{
+			name:    "prefix alias with invalid upstream",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Prefix: "old", Upstream: "new/"}}},
+			wantErr: ErrAliasUpstream,
+		},
+		{
+			name:    "regex alias without upstream",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Regex: "old-(.*)"}}},
+			wantErr: ErrAliasUpstream,
+		},
+		{
+			name:    "valid aliases",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Aliases: []Alias{{Prefix: "old", Upstream: "team/new"}, {Name: "legacy", Regex: "legacy-(.*)", Upstream: "team/$1", Deprecated: true}}},
+			wantErr: nil,
+		},
+		{
+			name:    "platform filter without cache ttl",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{Rules: []PlatformFilterRule{{DropAttestations: true}}}},
+			wantErr: ErrInvalidPlatformFilterCacheTTL,
+		},
+		{
+			name:    "platform filter without effect",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Repositories: []string{"app"}}}}},
+			wantErr: ErrPlatformFilterEmpty,
+		},
+		{
+			name:    "platform filter with invalid glob",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Repositories: []string{"app/***"}, DropAttestations: true}}}},
+			wantErr: ErrInvalidPlatformFilterRepository,
+		},
+		{
+			name:    "platform filter with invalid platform",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Platforms: []string{"arm64"}}}}},
+			wantErr: ErrInvalidPlatformFilterPlatform,
+		},
+		{
+			name:    "platform filter with unknown client",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Clients: []string{"edge"}, Platforms: []string{"linux/arm64"}}}}},
+			wantErr: ErrUnknownPlatformFilterClient,
+		},
+		{
+			name:    "platform filter for a default client",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Clients: []string{"containerd"}, Platforms: []string{"linux/arm64", "linux/arm/v7"}, DropAttestations: true}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "platform filter for a configured client",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", Clients: []ClientRule{{Name: "edge", UserAgent: "^edge/", Profile: ClientProfileToken}}, PlatformFilters: PlatformFilters{CacheTTL: 60, Rules: []PlatformFilterRule{{Clients: []string{"edge"}, DropAttestations: true}}}},
+			wantErr: nil,
+		},
+		{
+			name:    "invalid storage redirect policy",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", StorageRedirects: StorageRedirects{Policy: "proxy"}},
+			wantErr: ErrInvalidStorageRedirectPolicy,
+		},
+		{
+			name:    "storage rewrite without url",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", StorageRedirects: StorageRedirects{Policy: StorageRedirectRewrite}},
+			wantErr: ErrInvalidStorageRewriteURL,
+		},
+		{
+			name:    "storage rewrite with relative url",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", StorageRedirects: StorageRedirects{Policy: StorageRedirectRewrite, RewriteURL: "/storage"}},
+			wantErr: ErrInvalidStorageRewriteURL,
+		},
+		{
+			name:    "storage redirects followed",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", StorageRedirects: StorageRedirects{Policy: StorageRedirectFollow}},
+			wantErr: nil,
+		},
+		{
+			name:    "storage redirects rewritten",
+			cfg:     Config{LogLevel: LogLevelInfo, Port: 8080, MyURL: "http://localhost:8080", ZotURL: "http://localhost:5000", Secret: "supersecret", StorageRedirects: StorageRedirects{Policy: StorageRedirectRewrite, RewriteURL: "http://minio.internal:9000"}},
+			wantErr: nil,
+		},
 	}
 
 	for _, tt := range tests {
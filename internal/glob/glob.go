@@ -0,0 +1,75 @@
+package glob
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPattern = errors.New("invalid glob pattern")
+
+// Match reports whether name matches the glob pattern.
+//
+// Patterns are matched against slash-separated repository paths:
+//   - `*` matches any sequence of characters except `/`
+//   - `**` matches any sequence of characters, including `/`
+//   - `?` matches any single character except `/`
+//
+// All other characters match themselves.
+func Match(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			if strings.HasPrefix(pattern, "**") {
+				rest := strings.TrimLeft(pattern, "*")
+				for i := 0; i <= len(name); i++ {
+					if Match(rest, name[i:]) {
+						return true
+					}
+				}
+				return false
+			}
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if Match(rest, name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == '/' {
+					break
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 || name[0] == '/' {
+				return false
+			}
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// MatchAny reports whether name matches any of the glob patterns.
+func MatchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that a pattern is usable with Match.
+func Validate(pattern string) error {
+	if pattern == "" {
+		return ErrInvalidPattern
+	}
+	if strings.Contains(pattern, "***") {
+		return ErrInvalidPattern
+	}
+	return nil
+}
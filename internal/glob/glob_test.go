@@ -0,0 +1,67 @@
+package glob
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"library/alpine", "library/alpine", true},
+		{"library/alpine", "library/alpine2", false},
+		{"library/*", "library/alpine", true},
+		{"library/*", "library/alpine/sub", false},
+		{"library/**", "library/alpine/sub", true},
+		{"**", "anything/at/all", true},
+		{"**/cache", "team/app/cache", true},
+		{"**/cache", "team/app/cache2", false},
+		{"team-?/app", "team-a/app", true},
+		{"team-?/app", "team-/app", false},
+		{"team-?/app", "team-ab/app", false},
+		{"*-rc*", "1.0-rc1", true},
+		{"v*", "v1.2.3", true},
+		{"v*", "latest", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"_"+tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := Match(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	t.Parallel()
+	if !MatchAny([]string{"a/*", "b/**"}, "b/c/d") {
+		t.Error("expected b/c/d to match b/**")
+	}
+	if MatchAny([]string{"a/*", "b/*"}, "b/c/d") {
+		t.Error("expected b/c/d not to match")
+	}
+	if MatchAny(nil, "a") {
+		t.Error("expected no match against empty pattern list")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	if err := Validate("library/**"); err != nil {
+		t.Errorf("expected valid pattern, got %v", err)
+	}
+	if err := Validate(""); !errors.Is(err, ErrInvalidPattern) {
+		t.Errorf("expected ErrInvalidPattern for empty pattern, got %v", err)
+	}
+	if err := Validate("a/***"); !errors.Is(err, ErrInvalidPattern) {
+		t.Errorf("expected ErrInvalidPattern for ***, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+var (
+	ErrNotBoolean = errors.New("policy expression must evaluate to a bool")
+	ErrEvaluation = errors.New("policy evaluation failed")
+)
+
+// Input holds the request attributes exposed to policy expressions.
+type Input struct {
+	Identity   string
+	Groups     []string
+	Anonymous  bool
+	Repository string
+	Reference  string
+	Kind       string
+	Action     string
+	ClientIP   string
+	UserAgent  string
+	Time       time.Time
+}
+
+func (i Input) activation() map[string]any {
+	groups := i.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return map[string]any{
+		"identity":   i.Identity,
+		"groups":     groups,
+		"anonymous":  i.Anonymous,
+		"repository": i.Repository,
+		"reference":  i.Reference,
+		"kind":       i.Kind,
+		"action":     i.Action,
+		"client_ip":  i.ClientIP,
+		"user_agent": i.UserAgent,
+		"now":        i.Time,
+	}
+}
+
+// Policy is a compiled CEL expression that must evaluate to true for a
+// request to be allowed.
+type Policy struct {
+	Name    string
+	Message string
+	program cel.Program
+}
+
+func newEnv() (*cel.Env, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("identity", cel.StringType),
+		cel.Variable("groups", cel.ListType(cel.StringType)),
+		cel.Variable("anonymous", cel.BoolType),
+		cel.Variable("repository", cel.StringType),
+		cel.Variable("reference", cel.StringType),
+		cel.Variable("kind", cel.StringType),
+		cel.Variable("action", cel.StringType),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Variable("user_agent", cel.StringType),
+		cel.Variable("now", cel.TimestampType),
+		cel.Function("inCIDR",
+			cel.Overload("inCIDR_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inCIDR),
+			),
+		),
+		cel.Function("glob",
+			cel.Overload("glob_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(globMatch),
+			),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+	return env, nil
+}
+
+// inCIDR implements `inCIDR(ip, cidr)`.
+func inCIDR(ipVal, cidrVal ref.Val) ref.Val {
+	ipStr, ok := ipVal.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(ipVal)
+	}
+	cidrStr, ok := cidrVal.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(cidrVal)
+	}
+	_, network, err := net.ParseCIDR(string(cidrStr))
+	if err != nil {
+		return types.NewErr("invalid CIDR %q", string(cidrStr))
+	}
+	ip := net.ParseIP(string(ipStr))
+	return types.Bool(ip != nil && network.Contains(ip))
+}
+
+// globMatch implements `glob(pattern, value)`.
+func globMatch(patternVal, value ref.Val) ref.Val {
+	pattern, ok := patternVal.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(patternVal)
+	}
+	str, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Bool(glob.Match(string(pattern), string(str)))
+}
+
+// Compile parses and type-checks a policy expression.
+func Compile(name, expression, message string) (*Policy, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile policy %q: %w", name, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("policy %q: %w", name, ErrNotBoolean)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build policy %q: %w", name, err)
+	}
+	return &Policy{Name: name, Message: message, program: program}, nil
+}
+
+// Allows evaluates the policy against the input.
+func (p *Policy) Allows(input Input) (bool, error) {
+	out, _, err := p.program.Eval(input.activation())
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %w", ErrEvaluation, p.Name, err)
+	}
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("%w: %s: %w", ErrEvaluation, p.Name, ErrNotBoolean)
+	}
+	return allowed, nil
+}
+
+// Engine evaluates a list of policies in order.
+type Engine struct {
+	policies []*Policy
+}
+
+// NewEngine creates an engine from compiled policies.
+func NewEngine(policies ...*Policy) *Engine {
+	return &Engine{policies: policies}
+}
+
+// Empty reports whether the engine has no policies.
+func (e *Engine) Empty() bool {
+	return e == nil || len(e.policies) == 0
+}
+
+// Evaluate returns the first policy that denies the input, or nil if every
+// policy allows it. Policies that fail to evaluate deny the request.
+func (e *Engine) Evaluate(input Input) (*Policy, error) {
+	for _, p := range e.policies {
+		allowed, err := p.Allows(input)
+		if err != nil {
+			return p, err
+		}
+		if !allowed {
+			return p, nil
+		}
+	}
+	return nil, nil //nolint:nilnil // nil policy means allowed
+}
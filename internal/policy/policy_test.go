@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// ciPolicy lets CI robots push only release candidate tags, from the build
+// subnet, on weekdays.
+const ciPolicy = `!("ci" in groups) || action != "push" || (
+	glob("*-rc*", reference) &&
+	inCIDR(client_ip, "10.20.0.0/16") &&
+	now.getDayOfWeek() >= 1 && now.getDayOfWeek() <= 5
+)`
+
+func TestCompile_Errors(t *testing.T) {
+	t.Parallel()
+	if _, err := Compile("syntax", "action ==", ""); err == nil {
+		t.Error("expected syntax error")
+	}
+	if _, err := Compile("unknown", "nope == 1", ""); err == nil {
+		t.Error("expected undeclared variable error")
+	}
+	if _, err := Compile("type", `repository`, ""); !errors.Is(err, ErrNotBoolean) {
+		t.Errorf("expected ErrNotBoolean, got %v", err)
+	}
+}
+
+func TestPolicy_CIRobots(t *testing.T) {
+	t.Parallel()
+	p, err := Compile("ci", ciPolicy, "")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	wednesday := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	saturday := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+	base := Input{Identity: "robot", Groups: []string{"ci"}, Repository: "team/app", Action: "push", ClientIP: "10.20.1.5", Time: wednesday}
+
+	tests := []struct {
+		name   string
+		modify func(*Input)
+		want   bool
+	}{
+		{"rc tag from build subnet on weekday", func(i *Input) { i.Reference = "1.2.0-rc1" }, true},
+		{"release tag", func(i *Input) { i.Reference = "1.2.0" }, false},
+		{"outside build subnet", func(i *Input) { i.Reference = "1.2.0-rc1"; i.ClientIP = "192.168.1.1" }, false},
+		{"weekend", func(i *Input) { i.Reference = "1.2.0-rc1"; i.Time = saturday }, false},
+		{"pull is unaffected", func(i *Input) { i.Reference = "1.2.0"; i.Action = "pull" }, true},
+		{"other groups are unaffected", func(i *Input) { i.Reference = "1.2.0"; i.Groups = []string{"developers"} }, true},
+	}
+	for _, tt := range tests {
+		input := base
+		tt.modify(&input)
+		allowed, err := p.Allows(input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if allowed != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, allowed)
+		}
+	}
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	t.Parallel()
+	allowAll, err := Compile("allow", "true", "")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	noDeletes, err := Compile("no-deletes", `action != "delete"`, "deletes are disabled")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	badCIDR, err := Compile("bad-cidr", `inCIDR(client_ip, "nope")`, "")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	engine := NewEngine(allowAll, noDeletes)
+	if denied, err := engine.Evaluate(Input{Action: "pull"}); denied != nil || err != nil {
+		t.Errorf("expected pull to be allowed, got %v, %v", denied, err)
+	}
+	denied, err := engine.Evaluate(Input{Action: "delete"})
+	if err != nil || denied == nil || denied.Name != "no-deletes" || denied.Message != "deletes are disabled" {
+		t.Errorf("expected no-deletes to deny, got %v, %v", denied, err)
+	}
+
+	denied, err = NewEngine(badCIDR).Evaluate(Input{ClientIP: "10.0.0.1"})
+	if denied == nil || !errors.Is(err, ErrEvaluation) {
+		t.Errorf("expected evaluation errors to deny, got %v, %v", denied, err)
+	}
+
+	if !NewEngine().Empty() {
+		t.Error("expected engine without policies to be empty")
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
+)
+
+const (
+	actionPull    = "pull"
+	actionPush    = "push"
+	actionDelete  = "delete"
+	actionCatalog = "catalog"
+
+	scopeTypeRepository = "repository"
+	scopeTypeRegistry   = "registry"
+	scopeNameCatalog    = "catalog"
+
+	kindManifests = "manifests"
+	kindBlobs     = "blobs"
+	kindUploads   = "uploads"
+	kindTags      = "tags"
+	kindReferrers = "referrers"
+
+	anonymousSubject = "anonymous"
+)
+
+// target describes what a /v2/ request operates on.
+type target struct {
+	Repository string
+	Kind       string
+	Reference  string
+	Action     string
+	// MountFrom is the source repository of a cross-repository blob mount.
+	MountFrom string
+}
+
+// parseTarget works out the repository and action of a distribution API
+// request. It returns false for requests that are not scoped to a
+// repository or the catalog, like the /v2/ ping.
+func parseTarget(r *http.Request) (target, bool) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		return target{}, false
+	}
+	if rest == "_catalog" {
+		return target{Action: actionCatalog}, true
+	}
+
+	segs := strings.Split(rest, "/")
+	n := len(segs)
+	if n < 3 {
+		return target{}, false
+	}
+
+	var t target
+	switch {
+	case n >= 4 && segs[n-3] == kindBlobs && segs[n-2] == kindUploads:
+		t = target{Repository: strings.Join(segs[:n-3], "/"), Kind: kindUploads, Reference: segs[n-1]}
+	case segs[n-2] == kindBlobs && segs[n-1] == kindUploads:
+		t = target{Repository: strings.Join(segs[:n-2], "/"), Kind: kindUploads}
+	case segs[n-2] == kindManifests, segs[n-2] == kindBlobs, segs[n-2] == kindReferrers:
+		t = target{Repository: strings.Join(segs[:n-2], "/"), Kind: segs[n-2], Reference: segs[n-1]}
+	case segs[n-2] == kindTags && segs[n-1] == "list":
+		t = target{Repository: strings.Join(segs[:n-2], "/"), Kind: kindTags}
+	default:
+		return target{}, false
+	}
+	if t.Repository == "" {
+		return target{}, false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if t.Kind == kindUploads {
+			t.Action = actionPush
+		} else {
+			t.Action = actionPull
+		}
+	case http.MethodDelete:
+		if t.Kind == kindUploads {
+			t.Action = actionPush
+		} else {
+			t.Action = actionDelete
+		}
+	default:
+		t.Action = actionPush
+	}
+
+	if t.Kind == kindUploads && r.Method == http.MethodPost {
+		t.MountFrom = r.URL.Query().Get("from")
+	}
+
+	return t, true
+}
+
+// scopeString renders the token scope a client needs for the target.
+func (t target) scopeString() string {
+	if t.Action == actionCatalog {
+		return scopeTypeRegistry + ":" + scopeNameCatalog + ":*"
+	}
+	return scopeTypeRepository + ":" + t.Repository + ":" + t.Action
+}
+
+// allowedBy reports whether the token claims grant the target, including
+// pull access to the source of a blob mount.
+func (t target) allowedBy(claims *tokenforge.Claims) bool {
+	if t.Action == actionCatalog {
+		return claims.Allows(scopeTypeRegistry, scopeNameCatalog, "*")
+	}
+	if !claims.Allows(scopeTypeRepository, t.Repository, t.Action) {
+		return false
+	}
+	if t.MountFrom != "" {
+		return claims.Allows(scopeTypeRepository, t.MountFrom, actionPull)
+	}
+	return true
+}
+
+// anonymousAllowed reports whether the anonymous policy permits the action
+// on the repository.
+func anonymousAllowed(cfg *config.Config, repository, action string) bool {
+	if action != actionPull {
+		return false
+	}
+	switch cfg.Anonymous.Policy {
+	case config.AnonymousPolicyDisabled:
+		return false
+	case config.AnonymousPolicyPullRepositories:
+		return glob.MatchAny(cfg.Anonymous.Repositories, repository)
+	default:
+		return true
+	}
+}
+
+// anonymousTargetAllowed is anonymousAllowed for a parsed request target.
+func anonymousTargetAllowed(cfg *config.Config, t target) bool {
+	if t.Action == actionCatalog {
+		return false
+	}
+	if !anonymousAllowed(cfg, t.Repository, t.Action) {
+		return false
+	}
+	if t.MountFrom != "" {
+		return anonymousAllowed(cfg, t.MountFrom, actionPull)
+	}
+	return true
+}
+
+// parseScope parses a token request scope such as
+// `repository:library/alpine:pull,push`.
+func parseScope(scope string) (tokenforge.Access, bool) {
+	typ, rest, ok := strings.Cut(scope, ":")
+	if !ok {
+		return tokenforge.Access{}, false
+	}
+	idx := strings.LastIndex(rest, ":")
+	if idx <= 0 {
+		return tokenforge.Access{}, false
+	}
+	return tokenforge.Access{
+		Type:    typ,
+		Name:    rest[:idx],
+		Actions: strings.Split(rest[idx+1:], ","),
+	}, true
+}
+
+// anonymousGrants narrows the requested scopes down to what the anonymous
+// policy allows.
+func anonymousGrants(cfg *config.Config, scopes []string) []tokenforge.Access {
+	grants := []tokenforge.Access{}
+	for _, raw := range scopes {
+		for _, scope := range strings.Fields(raw) {
+			access, ok := parseScope(scope)
+			if !ok || access.Type != scopeTypeRepository {
+				continue
+			}
+			actions := []string{}
+			for _, action := range access.Actions {
+				if anonymousAllowed(cfg, access.Name, action) {
+					actions = append(actions, action)
+				}
+			}
+			if len(actions) > 0 {
+				grants = append(grants, tokenforge.Access{Type: access.Type, Name: access.Name, Actions: actions})
+			}
+		}
+	}
+	return grants
+}
+
+// requestedGrants returns every scope the client asked for.
+func requestedGrants(scopes []string) []tokenforge.Access {
+	grants := []tokenforge.Access{}
+	for _, raw := range scopes {
+		for _, scope := range strings.Fields(raw) {
+			if access, ok := parseScope(scope); ok {
+				grants = append(grants, access)
+			}
+		}
+	}
+	return grants
+}
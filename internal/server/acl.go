@@ -0,0 +1,150 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
+)
+
+// accessRules evaluates the repository ACLs from config.
+type accessRules []config.AccessRule
+
+// ruleApplies reports whether the rule covers the action on the repository.
+// Catalog rules cover the whole registry.
+func ruleApplies(rule config.AccessRule, repository, action string) bool {
+	if !slices.Contains(rule.Actions, config.Action(action)) {
+		return false
+	}
+	if action == actionCatalog {
+		return true
+	}
+	return glob.MatchAny(rule.Repositories, repository)
+}
+
+// ruleGrants reports whether the rule lists the identity.
+func ruleGrants(rule config.AccessRule, identity *Identity) bool {
+	name := anonymousSubject
+	var groups []string
+	if identity != nil {
+		name = identity.Name
+		groups = identity.Groups
+	}
+	for _, allowed := range rule.Identities {
+		if allowed == name || (allowed == "*" && identity != nil && !identity.Anonymous) {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		if slices.Contains(groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the identity may perform the action. Repositories
+// and actions not covered by any rule are unprotected.
+func (a accessRules) allowed(identity *Identity, repository, action string) bool {
+	protected := false
+	for _, rule := range a {
+		if !ruleApplies(rule, repository, action) {
+			continue
+		}
+		protected = true
+		if ruleGrants(rule, identity) {
+			return true
+		}
+	}
+	return !protected
+}
+
+// allowedTarget is allowed for a parsed request, including pull access to
+// the source of a blob mount.
+func (a accessRules) allowedTarget(identity *Identity, t target) bool {
+	if !a.allowed(identity, t.Repository, t.Action) {
+		return false
+	}
+	if t.MountFrom != "" {
+		return a.allowed(identity, t.MountFrom, actionPull)
+	}
+	return true
+}
+
+// filterGrants removes the actions the identity may not perform from the
+// requested token scopes.
+func (a accessRules) filterGrants(identity *Identity, grants []tokenforge.Access) []tokenforge.Access {
+	filtered := []tokenforge.Access{}
+	for _, grant := range grants {
+		actions := []string{}
+		for _, action := range grant.Actions {
+			var ok bool
+			switch {
+			case grant.Type == scopeTypeRegistry && grant.Name == scopeNameCatalog:
+				ok = a.allowed(identity, "", actionCatalog)
+			case grant.Type == scopeTypeRepository && action == "*":
+				ok = a.allowed(identity, grant.Name, actionPull) &&
+					a.allowed(identity, grant.Name, actionPush) &&
+					a.allowed(identity, grant.Name, actionDelete)
+			case grant.Type == scopeTypeRepository:
+				ok = a.allowed(identity, grant.Name, action)
+			}
+			if ok {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) > 0 {
+			filtered = append(filtered, tokenforge.Access{Type: grant.Type, Name: grant.Name, Actions: actions})
+		}
+	}
+	return filtered
+}
+
+// accessMiddleware enforces the repository ACLs on every distribution API
+// request, whichever client profile it arrived through.
+func accessMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.access) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity := IdentityFromContext(r.Context())
+			if g.access.allowedTarget(g.trustedIdentity(identity), t) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			slog.Info("Access denied by repository rules", "identity", identityName(identity), "repository", t.Repository, "action", t.Action, "method", r.Method, "path", r.URL.Path)
+			g.denyAccess(w, r, t, "requested access to the resource is denied")
+		})
+	}
+}
+
+// denyAccess refuses a request. Anonymous Docker clients get a Bearer
+// challenge so they prompt for `docker login`, everyone else an OCI DENIED
+// error.
+func (g *gateway) denyAccess(w http.ResponseWriter, r *http.Request, t target, message string) {
+	identity := IdentityFromContext(r.Context())
+	if (identity == nil || identity.Anonymous) && clientProfileFromContext(r.Context()) == config.ClientProfileToken {
+		g.dockerChallenge(w, t.scopeString(), "insufficient_scope")
+		return
+	}
+	writeRegistryError(w, http.StatusForbidden, errCodeDenied, message, map[string]string{
+		"repository": t.Repository,
+		"action":     t.Action,
+	})
+}
+
+// identityName names the caller in logs.
+func identityName(identity *Identity) string {
+	if identity == nil {
+		return anonymousSubject
+	}
+	return identity.Name
+}
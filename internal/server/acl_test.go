@@ -0,0 +1,188 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
+)
+
+func aclTestConfig(t *testing.T, backendURL string) *config.Config {
+	t.Helper()
+	return &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backendURL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorHtpasswd, HtpasswdFile: writeHtpasswd(t, "alice", "hunter2"), Groups: []string{"developers"}},
+				{Type: config.AuthenticatorBasic},
+				{Type: config.AuthenticatorAnonymous},
+			},
+		},
+		AccessRules: []config.AccessRule{
+			{Repositories: []string{"secret/**"}, Actions: []config.Action{config.ActionPull, config.ActionPush}, Groups: []string{"developers"}},
+			{Actions: []config.Action{config.ActionCatalog}, Identities: []string{"admin"}},
+		},
+	}
+}
+
+func TestAccessRules_DeniesWithOCIError(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	router, err := server.NewRouter(aclTestConfig(t, backend.URL))
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ua   string
+		auth string
+		path string
+		want int
+	}{
+		{"passthrough user denied", "curl/8.0.0", basicAuth("bob", "pw"), "/v2/secret/app/manifests/latest", http.StatusForbidden},
+		{"passthrough anonymous denied", "curl/8.0.0", "", "/v2/secret/app/manifests/latest", http.StatusForbidden},
+		{"token anonymous challenged", "docker/24.0.0", "", "/v2/secret/app/manifests/latest", http.StatusUnauthorized},
+		{"group member allowed", "curl/8.0.0", basicAuth("alice", "hunter2"), "/v2/secret/app/manifests/latest", http.StatusOK},
+		{"unprotected repository", "curl/8.0.0", "", "/v2/public/app/manifests/latest", http.StatusOK},
+		{"catalog denied", "curl/8.0.0", basicAuth("alice", "hunter2"), "/v2/_catalog", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("User-Agent", tt.ua)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+			continue
+		}
+		if tt.want != http.StatusForbidden {
+			continue
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected JSON error, got %s", tt.name, rec.Header().Get("Content-Type"))
+		}
+		var body struct {
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Errors) != 1 || body.Errors[0].Code != "DENIED" {
+			t.Errorf("%s: expected DENIED error, got %s", tt.name, rec.Body.String())
+		}
+	}
+}
+
+func TestAccessRules_UnverifiedBasicIdentity(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	newRouter := func(trust bool) http.Handler {
+		router, err := server.NewRouter(&config.Config{
+			LogLevel: config.LogLevelInfo,
+			MyURL:    "http://localhost:8080",
+			ZotURL:   backend.URL,
+			Secret:   "test-secret",
+			Auth:     config.Auth{TrustPassthrough: trust},
+			AccessRules: []config.AccessRule{
+				{Repositories: []string{"secret/**"}, Actions: []config.Action{config.ActionPull}, Identities: []string{"admin"}},
+				{Repositories: []string{"internal/**"}, Actions: []config.Action{config.ActionPull}, Identities: []string{"*"}},
+				{Repositories: []string{"public/**"}, Actions: []config.Action{config.ActionPull}, Identities: []string{"anonymous"}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create router: %v", err)
+		}
+		return router
+	}
+	untrusted, trusted := newRouter(false), newRouter(true)
+
+	// The default chain accepts any Basic credentials and leaves them to
+	// Zot, so the claimed name is not proof of anything.
+	tests := []struct {
+		name   string
+		router http.Handler
+		path   string
+		want   int
+	}{
+		{"spoofed identity", untrusted, "/v2/secret/app/manifests/latest", http.StatusForbidden},
+		{"spoofed authenticated caller", untrusted, "/v2/internal/app/manifests/latest", http.StatusForbidden},
+		{"anonymous rights kept", untrusted, "/v2/public/app/manifests/latest", http.StatusOK},
+		{"trusted identity", trusted, "/v2/secret/app/manifests/latest", http.StatusOK},
+		{"trusted authenticated caller", trusted, "/v2/internal/app/manifests/latest", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("User-Agent", "curl/8.0.0")
+		req.Header.Set("Authorization", basicAuth("admin", "x"))
+		rec := httptest.NewRecorder()
+		tt.router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestAccessRules_TokenScopesFiltered(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := aclTestConfig(t, backend.URL)
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/docker-token?scope=repository:secret/app:pull,push,delete&scope=registry:catalog:*", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", basicAuth("alice", "hunter2"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	claims, err := tokenforge.ParseToken(cfg.Secret, resp["token"])
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if !claims.Allows("repository", "secret/app", "pull") || !claims.Allows("repository", "secret/app", "push") {
+		t.Errorf("expected pull and push to be granted, got %+v", claims.Access)
+	}
+	// delete is not covered by any rule, so it stays unprotected
+	if !claims.Allows("repository", "secret/app", "delete") {
+		t.Errorf("expected delete to be granted, got %+v", claims.Access)
+	}
+	if claims.Allows("registry", "catalog", "*") {
+		t.Errorf("expected catalog not to be granted, got %+v", claims.Access)
+	}
+
+	anonymous := fetchAnonymousToken(t, router, "repository:secret/app:pull")
+	anonymousClaims, err := tokenforge.ParseToken(cfg.Secret, anonymous)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if anonymousClaims.Allows("repository", "secret/app", "pull") {
+		t.Errorf("expected anonymous pull not to be granted, got %+v", anonymousClaims.Access)
+	}
+}
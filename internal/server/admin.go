@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+	"github.com/go-chi/chi/v5"
+)
+
+// adminRouter serves the proxy's admin API. It is disabled, and answers 404,
+// unless an admin token is configured.
+func adminRouter(g *gateway) http.Handler {
+	r := chi.NewRouter()
+	r.Use(adminAuthMiddleware(g.cfg.Admin.Token))
+	r.NotFound(func(w http.ResponseWriter, _ *http.Request) {
+		writeRegistryError(w, http.StatusNotFound, errCodeUnsupported, "unknown admin API endpoint", nil)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, _ *http.Request) {
+		writeRegistryError(w, http.StatusMethodNotAllowed, errCodeUnsupported, "method not allowed for this admin API endpoint", nil)
+	})
+
+	r.Get("/read-only", func(w http.ResponseWriter, _ *http.Request) {
+		readOnly, _ := g.modes.get()
+		writeJSON(w, http.StatusOK, readOnly)
+	})
+	r.Put("/read-only", func(w http.ResponseWriter, r *http.Request) {
+		mode, ok := decodeMode(w, r)
+		if !ok {
+			return
+		}
+		g.modes.setReadOnly(mode)
+		slog.Info("Read-only mode changed through the admin API", "enabled", mode.Enabled, "repositories", mode.Repositories)
+		writeJSON(w, http.StatusOK, mode)
+	})
+	r.Get("/maintenance", func(w http.ResponseWriter, _ *http.Request) {
+		_, maintenance := g.modes.get()
+		writeJSON(w, http.StatusOK, maintenance)
+	})
+	r.Put("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		mode, ok := decodeMode(w, r)
+		if !ok {
+			return
+		}
+		g.modes.setMaintenance(mode)
+		slog.Info("Maintenance mode changed through the admin API", "enabled", mode.Enabled, "repositories", mode.Repositories)
+		writeJSON(w, http.StatusOK, mode)
+	})
+
+	r.Get("/quotas", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, g.quotas.report())
+	})
+	r.Post("/quotas/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if err := g.reconcileQuotas(r.Context()); err != nil {
+			slog.Error("Failed to reconcile quota usage", "error", err.Error())
+			writeRegistryError(w, http.StatusBadGateway, errCodeUnknown, "failed to reconcile quota usage", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, g.quotas.report())
+	})
+
+	r.Route("/trash", func(r chi.Router) {
+		r.Use(softDeleteEnabledMiddleware(g))
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			entries, err := g.listTrash(r.Context())
+			if err != nil {
+				slog.Error("Failed to list the trash", "error", err.Error())
+				writeRegistryError(w, http.StatusBadGateway, errCodeUnknown, "failed to list the trash", err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+		})
+		r.Post("/restore", func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Repository string `json:"repository"`
+				Tag        string `json:"tag"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeRegistryError(w, http.StatusBadRequest, errCodeUnsupported, "invalid restore request", err.Error())
+				return
+			}
+			if !config.ValidRepositoryName(req.Repository) {
+				writeRegistryError(w, http.StatusBadRequest, errCodeNameInvalid, "invalid restore request: a valid repository is required", map[string]string{"repository": req.Repository})
+				return
+			}
+			if !tagRegexp.MatchString(req.Tag) {
+				writeRegistryError(w, http.StatusBadRequest, errCodeTagInvalid, "invalid restore request: a valid tag is required", map[string]string{"tag": req.Tag})
+				return
+			}
+			entry, err := g.restoreTrash(r.Context(), req.Repository, req.Tag)
+			switch {
+			case errors.Is(err, errNotTrashed):
+				writeRegistryError(w, http.StatusBadRequest, errCodeTagInvalid, err.Error(), map[string]string{"tag": req.Tag})
+			case errors.Is(err, errUpstreamNotFound):
+				writeRegistryError(w, http.StatusNotFound, errCodeManifestUnknown, "trashed manifest not found", map[string]string{"repository": req.Repository, "tag": req.Tag})
+			case err != nil:
+				slog.Error("Failed to restore from the trash", "repository", req.Repository, "tag", req.Tag, "error", err.Error())
+				writeRegistryError(w, http.StatusBadGateway, errCodeUnknown, "failed to restore from the trash", err.Error())
+			default:
+				writeJSON(w, http.StatusOK, entry)
+			}
+		})
+		r.Post("/purge", func(w http.ResponseWriter, r *http.Request) {
+			purged, err := g.purgeTrash(r.Context())
+			if err != nil {
+				slog.Error("Failed to purge expired trash", "error", err.Error())
+				writeRegistryError(w, http.StatusBadGateway, errCodeUnknown, "failed to purge expired trash", err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, purged)
+		})
+	})
+
+	return r
+}
+
+// softDeleteEnabledMiddleware hides the trash endpoints when soft delete is
+// disabled.
+func softDeleteEnabledMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !g.cfg.SoftDelete.Enabled {
+				writeRegistryError(w, http.StatusNotFound, errCodeUnsupported, errSoftDeleteDisabled.Error(), nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func adminAuthMiddleware(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				writeRegistryError(w, http.StatusNotFound, errCodeUnsupported, "the admin API is not enabled", nil)
+				return
+			}
+			scheme, value := credentials(r)
+			if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeRegistryError(w, http.StatusUnauthorized, errCodeUnauthorized, "admin token required", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decodeMode reads a mode from the request body, with the same defaults and
+// validation as the config file.
+func decodeMode(w http.ResponseWriter, r *http.Request) (config.Mode, bool) {
+	mode := config.Mode{RetryAfter: defaultRetryAfter}
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errCodeUnsupported, "invalid mode", err.Error())
+		return config.Mode{}, false
+	}
+	if mode.RetryAfter < 0 {
+		writeRegistryError(w, http.StatusBadRequest, errCodeUnsupported, "invalid mode", config.ErrInvalidRetryAfter.Error())
+		return config.Mode{}, false
+	}
+	for _, pattern := range mode.Repositories {
+		if err := glob.Validate(pattern); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, errCodeUnsupported, "invalid mode", err.Error())
+			return config.Mode{}, false
+		}
+	}
+	return mode, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "error", err.Error())
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+type imageConfig struct {
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+func isIndex(mediaType string, manifest ociManifest) bool {
+	return mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerManifestList || len(manifest.Manifests) > 0
+}
+
+func platformString(p *ociPlatform) string {
+	if p == nil {
+		return ""
+	}
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// admissionViolation checks a pushed manifest against a rule and explains
+// the first check it fails. An empty explanation means the manifest passes.
+func (g *gateway) admissionViolation(r *http.Request, rule config.AdmissionRule, repository string, raw []byte) (string, error) {
+	if rule.MaxManifestSize > 0 && int64(len(raw)) > rule.MaxManifestSize {
+		return fmt.Sprintf("manifest is %d bytes, the limit is %d", len(raw), rule.MaxManifestSize), nil
+	}
+
+	var manifest ociManifest
+	if json.Unmarshal(raw, &manifest) != nil {
+		return "manifest is not valid JSON", nil
+	}
+	mediaType := manifest.MediaType
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+	}
+	if len(rule.AllowedMediaTypes) > 0 && !slices.Contains(rule.AllowedMediaTypes, mediaType) {
+		return fmt.Sprintf("media type %q is not allowed", mediaType), nil
+	}
+
+	if isIndex(mediaType, manifest) {
+		platforms := make([]string, 0, len(manifest.Manifests))
+		for _, desc := range manifest.Manifests {
+			platforms = append(platforms, platformString(desc.Platform))
+		}
+		for _, required := range rule.RequiredPlatforms {
+			if !slices.Contains(platforms, required) {
+				return fmt.Sprintf("index is missing platform %s", required), nil
+			}
+		}
+		for _, key := range rule.RequiredAnnotations {
+			if _, ok := manifest.Annotations[key]; !ok {
+				return fmt.Sprintf("annotation %s is required", key), nil
+			}
+		}
+		return "", nil
+	}
+
+	if rule.MaxLayers > 0 && len(manifest.Layers) > rule.MaxLayers {
+		return fmt.Sprintf("image has %d layers, the limit is %d", len(manifest.Layers), rule.MaxLayers), nil
+	}
+	var total int64
+	for _, layer := range manifest.Layers {
+		if layer.Size < 0 {
+			return fmt.Sprintf("layer %s has a negative size", layer.Digest), nil
+		}
+		// Saturate instead of overflowing, so huge sizes cannot wrap
+		// around under the limit.
+		if layer.Size > math.MaxInt64-total {
+			total = math.MaxInt64
+		} else {
+			total += layer.Size
+		}
+		if len(rule.AllowedLayerMediaTypes) > 0 && !slices.Contains(rule.AllowedLayerMediaTypes, layer.MediaType) {
+			return fmt.Sprintf("layer media type %q is not allowed", layer.MediaType), nil
+		}
+	}
+	if rule.MaxTotalLayerSize > 0 && total > rule.MaxTotalLayerSize {
+		return fmt.Sprintf("layers total %d bytes, the limit is %d", total, rule.MaxTotalLayerSize), nil
+	}
+
+	var labels map[string]string
+	for _, key := range rule.RequiredAnnotations {
+		if _, ok := manifest.Annotations[key]; ok {
+			continue
+		}
+		if labels == nil {
+			var err error
+			if labels, err = g.imageLabels(r, repository, manifest); err != nil {
+				return "", err
+			}
+		}
+		if _, ok := labels[key]; !ok {
+			return fmt.Sprintf("annotation or label %s is required", key), nil
+		}
+	}
+	return "", nil
+}
+
+// imageLabels fetches the labels from the config blob of an image, which
+// clients upload before the manifest.
+func (g *gateway) imageLabels(r *http.Request, repository string, manifest ociManifest) (map[string]string, error) {
+	if manifest.Config == nil || manifest.Config.Digest == "" {
+		return map[string]string{}, nil
+	}
+	body, err := g.fetchBlob(r, repository, manifest.Config.Digest, maxManifestSize)
+	if errors.Is(err, errUpstreamNotFound) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg imageConfig
+	if json.Unmarshal(body, &cfg) != nil || cfg.Config.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return cfg.Config.Labels, nil
+}
+
+// admissionMiddleware checks manifest pushes against the admission rules
+// before they reach Zot.
+func admissionMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.cfg.Admission) == 0 || r.Method != http.MethodPut || t.Kind != kindManifests {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var manifest []byte
+			for i, rule := range g.cfg.Admission {
+				if !glob.MatchAny(rule.Repositories, t.Repository) {
+					continue
+				}
+				if manifest == nil {
+					var err error
+					if manifest, err = readManifest(r); err != nil {
+						writeManifestReadError(w, err)
+						return
+					}
+				}
+
+				violation, err := g.admissionViolation(r, rule, t.Repository, manifest)
+				if err != nil {
+					slog.Error("Failed to check manifest admission", "repository", t.Repository, "reference", t.Reference, "error", err.Error())
+					writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not check the manifest against the admission rules", nil)
+					return
+				}
+				if violation == "" {
+					continue
+				}
+
+				name := rule.Name
+				if name == "" {
+					name = fmt.Sprintf("admission[%d]", i)
+				}
+				slog.Info("Manifest rejected by admission rule", "rule", name, "identity", identityName(IdentityFromContext(r.Context())), "repository", t.Repository, "reference", t.Reference, "violation", violation)
+				writeRegistryError(w, http.StatusBadRequest, errCodeManifestInvalid, "manifest rejected by admission rule "+name+": "+violation, map[string]string{
+					"repository": t.Repository,
+					"rule":       name,
+					"violation":  violation,
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestAdmission(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	labeledConfig := registry.putBlob([]byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"org.opencontainers.image.source":"https://example.com/app"}}}`))
+	unlabeledConfig := registry.putBlob([]byte(`{"architecture":"amd64","os":"linux","config":{}}`))
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Admission: []config.AdmissionRule{
+			{
+				Name:                   "prod",
+				Repositories:           []string{"prod/**"},
+				MaxManifestSize:        2048,
+				MaxTotalLayerSize:      1000,
+				MaxLayers:              2,
+				AllowedMediaTypes:      []string{"application/vnd.oci.image.manifest.v1+json", "application/vnd.oci.image.index.v1+json"},
+				AllowedLayerMediaTypes: []string{"application/vnd.oci.image.layer.v1.tar+gzip"},
+				RequiredPlatforms:      []string{"linux/amd64", "linux/arm64"},
+				RequiredAnnotations:    []string{"org.opencontainers.image.source"},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	layer := func(mediaType string, size string) string {
+		return `{"mediaType":"` + mediaType + `","digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","size":` + size + `}`
+	}
+	gzipLayer := layer("application/vnd.oci.image.layer.v1.tar+gzip", "100")
+	image := func(config string, layers ...string) string {
+		return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` +
+			config + `","size":10},"layers":[` + strings.Join(layers, ",") + `]}`
+	}
+	index := func(platforms ...string) string {
+		manifests := []string{}
+		for _, platform := range platforms {
+			os, arch, _ := strings.Cut(platform, "/")
+			manifests = append(manifests, `{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:1111111111111111111111111111111111111111111111111111111111111111","size":10,"platform":{"os":"`+os+`","architecture":"`+arch+`"}}`)
+		}
+		return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + strings.Join(manifests, ",") +
+			`],"annotations":{"org.opencontainers.image.source":"https://example.com/app"}}`
+	}
+
+	tests := []struct {
+		name        string
+		repository  string
+		contentType string
+		manifest    string
+		wantError   string
+	}{
+		{name: "valid image", repository: "prod/app", manifest: image(labeledConfig, gzipLayer)},
+		{name: "valid index", repository: "prod/app", contentType: "application/vnd.oci.image.index.v1+json", manifest: index("linux/amd64", "linux/arm64")},
+		{name: "manifest too large", repository: "prod/app", manifest: image(labeledConfig, gzipLayer) + strings.Repeat(" ", 2048), wantError: "bytes, the limit is 2048"},
+		{name: "too many layers", repository: "prod/app", manifest: image(labeledConfig, gzipLayer, gzipLayer, gzipLayer), wantError: "3 layers"},
+		{name: "layers too large", repository: "prod/app", manifest: image(labeledConfig, layer("application/vnd.oci.image.layer.v1.tar+gzip", "2000")), wantError: "layers total 2000 bytes"},
+		{name: "negative layer size", repository: "prod/app", manifest: image(labeledConfig, layer("application/vnd.oci.image.layer.v1.tar+gzip", "-4611686018427387904"), layer("application/vnd.oci.image.layer.v1.tar+gzip", "2000")), wantError: "negative size"},
+		{name: "layer sizes overflow", repository: "prod/app", manifest: image(labeledConfig, layer("application/vnd.oci.image.layer.v1.tar+gzip", "9223372036854775807"), layer("application/vnd.oci.image.layer.v1.tar+gzip", "9223372036854775807")), wantError: "layers total 9223372036854775807 bytes"},
+		{name: "media type not allowed", repository: "prod/app", contentType: "application/vnd.docker.distribution.manifest.v2+json", manifest: image(labeledConfig, gzipLayer), wantError: "media type"},
+		{name: "layer media type not allowed", repository: "prod/app", manifest: image(labeledConfig, layer("application/vnd.oci.image.layer.v1.tar+zstd", "100")), wantError: "layer media type"},
+		{name: "index missing platform", repository: "prod/app", contentType: "application/vnd.oci.image.index.v1+json", manifest: index("linux/amd64"), wantError: "missing platform linux/arm64"},
+		{name: "missing label", repository: "prod/app", manifest: image(unlabeledConfig, gzipLayer), wantError: "org.opencontainers.image.source"},
+		{name: "other repository", repository: "dev/app", manifest: image(unlabeledConfig, gzipLayer, gzipLayer, gzipLayer)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/vnd.oci.image.manifest.v1+json"
+			}
+			rec := serve(router, http.MethodPut, "/v2/"+tt.repository+"/manifests/"+strings.ReplaceAll(tt.name, " ", "-"),
+				withBody(tt.manifest), withHeader("Content-Type", contentType))
+
+			if tt.wantError == "" {
+				if rec.Code != http.StatusCreated {
+					t.Errorf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), `"MANIFEST_INVALID"`) || !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("expected MANIFEST_INVALID mentioning %q, got %s", tt.wantError, rec.Body.String())
+			}
+		})
+	}
+}
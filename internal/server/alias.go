@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// repositoryAlias maps repository names clients use to names in Zot.
+type repositoryAlias struct {
+	name       string
+	prefix     string
+	regex      *regexp.Regexp
+	upstream   string
+	deprecated bool
+}
+
+func compileAliases(aliases []config.Alias) ([]repositoryAlias, error) {
+	compiled := make([]repositoryAlias, 0, len(aliases))
+	for i, alias := range aliases {
+		name := alias.Name
+		if name == "" {
+			name = fmt.Sprintf("aliases[%d]", i)
+		}
+		rule := repositoryAlias{
+			name:       name,
+			prefix:     alias.Prefix,
+			upstream:   alias.Upstream,
+			deprecated: alias.Deprecated,
+		}
+		if alias.Regex != "" {
+			// Aliases match whole names, so a regex for app does not also
+			// rename team/app-tools.
+			regex, err := regexp.Compile(`^(?:` + alias.Regex + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("alias %q: %w", name, err)
+			}
+			rule.regex = regex
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// apply maps a repository name clients use, reporting whether the alias
+// matched it.
+func (a repositoryAlias) apply(name string) (string, bool) {
+	if a.regex != nil {
+		if !a.regex.MatchString(name) {
+			return "", false
+		}
+		return a.regex.ReplaceAllString(name, a.upstream), true
+	}
+	if rest, ok := cutRepositoryPrefix(name, a.prefix); ok {
+		return a.upstream + rest, true
+	}
+	return "", false
+}
+
+// reverse maps a name in Zot back to the name clients use. Only prefix
+// aliases can be reversed.
+func (a repositoryAlias) reverse(name string) (string, bool) {
+	if a.regex != nil {
+		return "", false
+	}
+	if rest, ok := cutRepositoryPrefix(name, a.upstream); ok {
+		return a.prefix + rest, true
+	}
+	return "", false
+}
+
+// cutRepositoryPrefix cuts prefix from a repository name, which may be the
+// prefix itself or a name under it. The rest keeps its leading slash.
+func cutRepositoryPrefix(name, prefix string) (string, bool) {
+	if name == prefix {
+		return "", true
+	}
+	rest, ok := strings.CutPrefix(name, prefix+"/")
+	if !ok {
+		return "", false
+	}
+	return "/" + rest, true
+}
+
+// matchAlias returns the first alias matching a repository name clients use,
+// and the name it maps to.
+func (g *gateway) matchAlias(name string) (repositoryAlias, string, bool) {
+	for _, alias := range g.aliases {
+		if upstream, ok := alias.apply(name); ok {
+			return alias, upstream, true
+		}
+	}
+	return repositoryAlias{}, "", false
+}
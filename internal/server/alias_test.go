@@ -0,0 +1,99 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func aliasTestRouter(t *testing.T, backendURL string) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backendURL,
+		Secret:   "test-secret",
+		Aliases: []config.Alias{
+			{Name: "team rename", Prefix: "team-a", Upstream: "platform"},
+			{Regex: `legacy-([a-z]+)`, Upstream: "platform/$1", Deprecated: true},
+		},
+	})
+}
+
+func TestAliases_Requests(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("platform/app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	registry.putManifest("platform/app-tools", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("20")))
+	router := aliasTestRouter(t, backend.URL)
+
+	tests := []struct {
+		path     string
+		wantName string
+	}{
+		{path: "/v2/team-a/app/tags/list", wantName: "team-a/app"},
+		{path: "/v2/legacy-app/tags/list", wantName: "legacy-app"},
+		{path: "/v2/platform/app/tags/list", wantName: "platform/app"},
+		{path: "/v2/team-a/app-tools/tags/list", wantName: "team-a/app-tools"},
+	}
+	for _, tt := range tests {
+		rec := serve(router, http.MethodGet, tt.path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d: %s", tt.path, rec.Code, rec.Body.String())
+			continue
+		}
+		var list tagList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GET %s: failed to decode tag list: %v", tt.path, err)
+		}
+		if list.Name != tt.wantName || !slices.Equal(list.Tags, []string{"1.0"}) {
+			t.Errorf("GET %s: expected %s with tag 1.0, got %+v", tt.path, tt.wantName, list)
+		}
+	}
+
+	// Regex aliases match whole names.
+	serve(router, http.MethodGet, "/v2/legacy-app/tools/tags/list")
+	if registry.requested(http.MethodGet, "/v2/legacy-app/tools/tags/list") != 1 {
+		t.Error("expected legacy-app/tools to be forwarded unchanged")
+	}
+
+	if rec := serve(router, http.MethodGet, "/v2/legacy-app/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected the regex alias to pull platform/app, got %d", rec.Code)
+	}
+	if got := registry.requested(http.MethodGet, "/v2/platform/app/manifests/1.0"); got != 1 {
+		t.Errorf("expected Zot to serve the manifest from platform/app once, got %d", got)
+	}
+}
+
+func TestAliases_Catalog(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("platform/app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	registry.putManifest("platformer", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("20")))
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Aliases:  []config.Alias{{Prefix: "team-a", Upstream: "platform"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/_catalog")
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("failed to decode catalog: %v", err)
+	}
+	if !slices.Equal(catalog.Repositories, []string{"platformer", "team-a/app"}) {
+		t.Errorf("expected prefix aliases to be mapped back in lexical order, got %v", catalog.Repositories)
+	}
+}
@@ -0,0 +1,242 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
+)
+
+func anonymousTestConfig(backendURL string, anonymous config.Anonymous) *config.Config {
+	return &config.Config{
+		LogLevel:           config.LogLevelInfo,
+		Port:               8080,
+		CORSAllowedOrigins: []string{"*"},
+		MyURL:              "http://localhost:8080",
+		ZotURL:             backendURL,
+		Secret:             "test-secret",
+		Anonymous:          anonymous,
+	}
+}
+
+// fetchAnonymousToken requests a token for the given scope and returns it.
+func fetchAnonymousToken(t *testing.T, router http.Handler, scope string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/docker-token?scope="+scope, nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from token endpoint, got %d", rec.Code)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	return resp["token"]
+}
+
+func TestAnonymousToken_ScopedToPull(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := anonymousTestConfig(backend.URL, config.Anonymous{Policy: config.AnonymousPolicyPull})
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	token := fetchAnonymousToken(t, router, "repository:library/alpine:pull,push")
+	claims, err := tokenforge.ParseToken(cfg.Secret, token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if !claims.Allows("repository", "library/alpine", "pull") {
+		t.Errorf("expected pull to be granted, got %+v", claims.Access)
+	}
+	if claims.Allows("repository", "library/alpine", "push") {
+		t.Errorf("expected push not to be granted, got %+v", claims.Access)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for anonymous pull, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v2/library/alpine/blobs/uploads/", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for anonymous push, got %d", rec.Code)
+	}
+	challenge := rec.Header().Get("WWW-Authenticate")
+	if !strings.Contains(challenge, `scope="repository:library/alpine:push"`) {
+		t.Errorf("expected push scope in challenge, got %s", challenge)
+	}
+	if rec.Header().Get("X-Backend-Called") != "" {
+		t.Error("expected anonymous push not to reach the backend")
+	}
+}
+
+func TestAnonymousToken_DeleteAndCatalogChallenged(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := anonymousTestConfig(backend.URL, config.Anonymous{Policy: config.AnonymousPolicyPull})
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	token := fetchAnonymousToken(t, router, "repository:library/alpine:pull,delete")
+
+	tests := []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{http.MethodDelete, "/v2/library/alpine/manifests/sha256:abc", "repository:library/alpine:delete"},
+		{http.MethodGet, "/v2/_catalog", "registry:catalog:*"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("User-Agent", "docker/24.0.0")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401, got %d", tt.method, tt.path, rec.Code)
+		}
+		if !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="`+tt.scope+`"`) {
+			t.Errorf("%s %s: expected scope %s in challenge, got %s", tt.method, tt.path, tt.scope, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAnonymousToken_Disabled(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := anonymousTestConfig(backend.URL, config.Anonymous{Policy: config.AnonymousPolicyDisabled})
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/docker-token?scope=repository:library/alpine:pull", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 when anonymous access is disabled, got %d", rec.Code)
+	}
+
+	// Logged in users still get their credentials back as a token
+	req = httptest.NewRequest(http.MethodGet, "/docker-token", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for basic credentials, got %d", rec.Code)
+	}
+}
+
+func TestAnonymousToken_PullRepositories(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := anonymousTestConfig(backend.URL, config.Anonymous{
+		Policy:       config.AnonymousPolicyPullRepositories,
+		Repositories: []string{"public/**"},
+	})
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	token := fetchAnonymousToken(t, router, "repository:public/tools/curl:pull&scope=repository:private/app:pull")
+	claims, err := tokenforge.ParseToken(cfg.Secret, token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if !claims.Allows("repository", "public/tools/curl", "pull") {
+		t.Errorf("expected pull on public/tools/curl, got %+v", claims.Access)
+	}
+	if claims.Allows("repository", "private/app", "pull") {
+		t.Errorf("expected no pull on private/app, got %+v", claims.Access)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/private/app/manifests/latest", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for pull outside the listed repositories, got %d", rec.Code)
+	}
+}
+
+func TestAnonymousPolicy_NoCredentials(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := anonymousTestConfig(backend.URL, config.Anonymous{
+		Policy:       config.AnonymousPolicyPullRepositories,
+		Repositories: []string{"public/**"},
+	})
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		wantCode int
+		scope    string
+	}{
+		{http.MethodGet, "/v2/public/app/manifests/latest", http.StatusOK, ""},
+		{http.MethodGet, "/v2/private/app/manifests/latest", http.StatusUnauthorized, "repository:private/app:pull"},
+		{http.MethodPost, "/v2/public/app/blobs/uploads/", http.StatusUnauthorized, "repository:public/app:push"},
+		{http.MethodGet, "/v2/_catalog", http.StatusUnauthorized, "registry:catalog:*"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("User-Agent", "docker/24.0.0")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.wantCode, rec.Code)
+		}
+		if tt.scope == "" {
+			continue
+		}
+		if !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="`+tt.scope+`"`) {
+			t.Errorf("%s %s: expected scope %s in challenge, got %s", tt.method, tt.path, tt.scope, rec.Header().Get("WWW-Authenticate"))
+		}
+		if rec.Header().Get("X-Backend-Called") != "" {
+			t.Errorf("%s %s: expected the request not to reach the backend", tt.method, tt.path)
+		}
+	}
+}
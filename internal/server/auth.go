@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+var (
+	// ErrNotMine is returned by an Authenticator when the request carries no
+	// credentials it understands.
+	ErrNotMine = errors.New("request not handled by authenticator")
+	// ErrInvalidCredentials is returned by an Authenticator when the request
+	// carries credentials it understands, but they are wrong.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnauthenticated is returned by the chain when no authenticator
+	// produced an identity.
+	ErrUnauthenticated = errors.New("no authenticator accepted the request")
+)
+
+// Identity is the caller of a request.
+type Identity struct {
+	Name   string
+	Groups []string
+	// Anonymous is set for callers without credentials.
+	Anonymous bool
+	// Passthrough is set when the credentials are forwarded to Zot, which
+	// is responsible for verifying them.
+	Passthrough bool
+	// Authenticator is the name of the authenticator that produced the identity.
+	Authenticator string
+}
+
+// InGroup reports whether the identity is a member of the group.
+func (i *Identity) InGroup(group string) bool {
+	return slices.Contains(i.Groups, group)
+}
+
+// Authenticator turns a request into an Identity.
+type Authenticator interface {
+	// Name identifies the authenticator in logs.
+	Name() string
+	// Authenticate returns the identity of the caller, ErrNotMine if the
+	// request is not for this authenticator, or another error if the
+	// credentials are invalid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// IdentityFromContext returns the identity stored by the auth middleware,
+// or nil if the request was not authenticated.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(Identity_ContextKey).(*Identity)
+	return identity
+}
+
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), Identity_ContextKey, identity))
+}
+
+// trustedIdentity returns the identity rules may rely on. Identities whose
+// credentials only Zot verifies could claim any name, so they count as
+// anonymous unless auth.trust-passthrough says Zot checks the same
+// credentials.
+func (g *gateway) trustedIdentity(identity *Identity) *Identity {
+	if identity != nil && identity.Passthrough && !g.cfg.Auth.TrustPassthrough {
+		return nil
+	}
+	return identity
+}
+
+// authChain evaluates an ordered list of authenticators.
+type authChain struct {
+	mode           config.AuthMode
+	authenticators []Authenticator
+}
+
+func newAuthChain(cfg *config.Config) (*authChain, error) {
+	entries := cfg.Auth.Chain
+	if len(entries) == 0 {
+		entries = config.DefaultAuthChain()
+	}
+	chain := &authChain{mode: cfg.Auth.Mode}
+	for _, entry := range entries {
+		authenticator, err := newAuthenticator(cfg, entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s authenticator: %w", entry.Type, err)
+		}
+		chain.authenticators = append(chain.authenticators, authenticator)
+	}
+	return chain, nil
+}
+
+// authenticate runs the chain against the request and logs the decision.
+func (c *authChain) authenticate(r *http.Request) (*Identity, error) {
+	var (
+		identity *Identity
+		decider  string
+		err      error
+	)
+	if c.mode == config.AuthModeAllRequired {
+		identity, decider, err = c.allRequired(r)
+	} else {
+		identity, decider, err = c.firstMatch(r)
+	}
+
+	if err != nil {
+		slog.Info("Authentication decision", "result", "denied", "authenticator", decider, "error", err.Error(), "method", r.Method, "path", r.URL.Path)
+		return nil, err
+	}
+	slog.Info("Authentication decision", "result", "allowed", "authenticator", decider, "identity", identity.Name, "groups", identity.Groups, "method", r.Method, "path", r.URL.Path)
+	return identity, nil
+}
+
+func (c *authChain) firstMatch(r *http.Request) (*Identity, string, error) {
+	for _, authenticator := range c.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNotMine) {
+			continue
+		}
+		if err != nil {
+			return nil, authenticator.Name(), err
+		}
+		identity.Authenticator = authenticator.Name()
+		return identity, authenticator.Name(), nil
+	}
+	return nil, "", ErrUnauthenticated
+}
+
+func (c *authChain) allRequired(r *http.Request) (*Identity, string, error) {
+	var merged *Identity
+	for _, authenticator := range c.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNotMine) {
+			return nil, authenticator.Name(), ErrUnauthenticated
+		}
+		if err != nil {
+			return nil, authenticator.Name(), err
+		}
+		if merged == nil {
+			merged = identity
+			merged.Authenticator = authenticator.Name()
+			continue
+		}
+		for _, group := range identity.Groups {
+			if !merged.InGroup(group) {
+				merged.Groups = append(merged.Groups, group)
+			}
+		}
+		merged.Anonymous = merged.Anonymous && identity.Anonymous
+		merged.Passthrough = merged.Passthrough || identity.Passthrough
+	}
+	if merged == nil {
+		return nil, "", ErrUnauthenticated
+	}
+	return merged, merged.Authenticator, nil
+}
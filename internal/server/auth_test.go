@@ -0,0 +1,355 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createAuthCapturingBackend records the Authorization header it receives.
+func createAuthCapturingBackend(captured *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*captured = r.Header.Get("Authorization")
+		w.Header().Set("X-Backend-Called", "true")
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func writeHtpasswd(t *testing.T, username, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(username+":"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write htpasswd: %v", err)
+	}
+	return path
+}
+
+func makeHS256JWT(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// makeES256JWT signs claims with an ECDSA key, padding r and s to size
+// bytes each.
+func makeES256JWT(t *testing.T, key *ecdsa.PrivateKey, size int, claims map[string]any) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthChain_HtpasswdIssuesIdentityToken(t *testing.T) {
+	t.Parallel()
+
+	var capturedAuth string
+	backend := createAuthCapturingBackend(&capturedAuth)
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorHtpasswd, HtpasswdFile: writeHtpasswd(t, "alice", "hunter2"), Groups: []string{"developers"}},
+				{Type: config.AuthenticatorAnonymous},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/docker-token?scope=repository:team/app:pull,push", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", basicAuth("alice", "wrong"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong password, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/docker-token?scope=repository:team/app:pull,push", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", basicAuth("alice", "hunter2"))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for valid credentials, got %d", rec.Code)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	claims, err := tokenforge.ParseToken(cfg.Secret, resp["token"])
+	if err != nil {
+		t.Fatalf("expected a proxy token, got error: %v", err)
+	}
+	if claims.Subject != "alice" || len(claims.Groups) != 1 || claims.Groups[0] != "developers" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if !claims.Allows("repository", "team/app", "push") {
+		t.Errorf("expected push to be granted, got %+v", claims.Access)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/v2/team/app/manifests/latest", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", "Bearer "+resp["token"])
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for authenticated push, got %d", rec.Code)
+	}
+	if capturedAuth != "" {
+		t.Errorf("expected Authorization to be stripped, got %s", capturedAuth)
+	}
+}
+
+func TestAuthChain_JWT(t *testing.T) {
+	t.Parallel()
+
+	var capturedAuth string
+	backend := createAuthCapturingBackend(&capturedAuth)
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorJWT, JWTSecret: "jwt-secret", JWTIssuer: "ci"},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	valid := makeHS256JWT(t, "jwt-secret", map[string]any{"sub": "robot", "iss": "ci", "exp": time.Now().Add(time.Hour).Unix()})
+	wrongIssuer := makeHS256JWT(t, "jwt-secret", map[string]any{"sub": "robot", "iss": "other"})
+	expired := makeHS256JWT(t, "jwt-secret", map[string]any{"sub": "robot", "iss": "ci", "exp": time.Now().Add(-time.Hour).Unix()})
+	badSignature := makeHS256JWT(t, "other-secret", map[string]any{"sub": "robot", "iss": "ci"})
+	noExpiry := makeHS256JWT(t, "jwt-secret", map[string]any{"sub": "robot", "iss": "ci"})
+
+	tests := []struct {
+		name string
+		auth string
+		want int
+	}{
+		{"bearer", "Bearer " + valid, http.StatusOK},
+		{"basic password", basicAuth("oauth2", valid), http.StatusOK},
+		{"wrong issuer", "Bearer " + wrongIssuer, http.StatusUnauthorized},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized},
+		{"bad signature", "Bearer " + badSignature, http.StatusUnauthorized},
+		{"no exp", "Bearer " + noExpiry, http.StatusUnauthorized},
+		{"no credentials", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v2/team/app/manifests/latest", nil)
+		req.Header.Set("User-Agent", "docker/24.0.0")
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestAuthChain_JWTECDSA(t *testing.T) {
+	t.Parallel()
+
+	var capturedAuth string
+	backend := createAuthCapturingBackend(&capturedAuth)
+	defer backend.Close()
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	newRouter := func(key *ecdsa.PrivateKey) http.Handler {
+		router, err := server.NewRouter(&config.Config{
+			LogLevel: config.LogLevelInfo,
+			MyURL:    "http://localhost:8080",
+			ZotURL:   backend.URL,
+			Secret:   "test-secret",
+			Auth: config.Auth{
+				Chain: []config.AuthenticatorConfig{
+					{Type: config.AuthenticatorJWT, JWTPublicKeyFile: writePublicKey(t, key)},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create router: %v", err)
+		}
+		return router
+	}
+	p256Router, p384Router := newRouter(p256), newRouter(p384)
+
+	claims := map[string]any{"sub": "robot", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name   string
+		router http.Handler
+		token  string
+		want   int
+	}{
+		{"valid", p256Router, makeES256JWT(t, p256, 32, claims), http.StatusOK},
+		{"padded signature", p256Router, makeES256JWT(t, p256, 33, claims), http.StatusUnauthorized},
+		{"curve does not match alg", p384Router, makeES256JWT(t, p384, 48, claims), http.StatusUnauthorized},
+		{"no exp", p256Router, makeES256JWT(t, p256, 32, map[string]any{"sub": "robot"}), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v2/team/app/manifests/latest", nil)
+		req.Header.Set("User-Agent", "docker/24.0.0")
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		tt.router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestAuthChain_AllRequiredMTLSAndHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	var capturedAuth string
+	backend := createAuthCapturingBackend(&capturedAuth)
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		TLS:      config.TLS{ClientCAFile: "ca.pem"},
+		Auth: config.Auth{
+			Mode: config.AuthModeAllRequired,
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorMTLS},
+				{Type: config.AuthenticatorHtpasswd, HtpasswdFile: writeHtpasswd(t, "alice", "hunter2")},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"platform"}}}
+
+	req := httptest.NewRequest(http.MethodGet, "/docker-token", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", basicAuth("alice", "hunter2"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a client certificate, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/docker-token", nil)
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.Header.Set("Authorization", basicAuth("alice", "hunter2"))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with certificate and password, got %d", rec.Code)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	claims, err := tokenforge.ParseToken(cfg.Secret, resp["token"])
+	if err != nil {
+		t.Fatalf("expected a proxy token, got error: %v", err)
+	}
+	if claims.Subject != "alice" || len(claims.Groups) != 1 || claims.Groups[0] != "platform" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestIdentityFromContext_Passthrough(t *testing.T) {
+	t.Parallel()
+
+	var identity *server.Identity
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   "http://localhost:5000",
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	router.Get("/v2/test/identity", func(_ http.ResponseWriter, r *http.Request) {
+		identity = server.IdentityFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/test/identity", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	req.Header.Set("Authorization", basicAuth("bob", "secret"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if identity == nil || identity.Name != "bob" || !identity.Passthrough || identity.Authenticator != "basic" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+}
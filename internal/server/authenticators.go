@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newAuthenticator(cfg *config.Config, entry config.AuthenticatorConfig) (Authenticator, error) {
+	name := entry.Name
+	if name == "" {
+		name = string(entry.Type)
+	}
+	base := baseAuthenticator{name: name, groups: entry.Groups}
+
+	switch entry.Type {
+	case config.AuthenticatorAnonymous:
+		return &anonymousAuthenticator{baseAuthenticator: base}, nil
+	case config.AuthenticatorBasic:
+		return &basicAuthenticator{baseAuthenticator: base}, nil
+	case config.AuthenticatorHtpasswd:
+		users, err := loadHtpasswd(entry.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		return &htpasswdAuthenticator{baseAuthenticator: base, users: users}, nil
+	case config.AuthenticatorJWT:
+		verifier, err := newJWTVerifier(entry)
+		if err != nil {
+			return nil, err
+		}
+		return &jwtAuthenticator{baseAuthenticator: base, verifier: verifier}, nil
+	case config.AuthenticatorMTLS:
+		if cfg.TLS.ClientCAFile == "" {
+			return nil, config.ErrMTLSRequiresClientCA
+		}
+		return &mtlsAuthenticator{baseAuthenticator: base}, nil
+	default:
+		return nil, config.ErrInvalidAuthenticatorType
+	}
+}
+
+type baseAuthenticator struct {
+	name   string
+	groups []string
+}
+
+func (b baseAuthenticator) Name() string {
+	return b.name
+}
+
+func (b baseAuthenticator) identity(name string, groups ...string) *Identity {
+	return &Identity{Name: name, Groups: append(append([]string{}, groups...), b.groups...)}
+}
+
+// credentials returns the scheme and value of the Authorization header.
+func credentials(r *http.Request) (string, string) {
+	scheme, value, _ := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	return scheme, strings.TrimSpace(value)
+}
+
+// basicCredentials decodes Basic credentials from the request.
+func basicCredentials(r *http.Request) (string, string, bool) {
+	scheme, value := credentials(r)
+	if !strings.EqualFold(scheme, "Basic") || value == "" {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// anonymousAuthenticator accepts requests that carry no credentials.
+type anonymousAuthenticator struct {
+	baseAuthenticator
+}
+
+func (a *anonymousAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if _, value := credentials(r); value != "" {
+		return nil, ErrNotMine
+	}
+	identity := a.identity(anonymousSubject)
+	identity.Anonymous = true
+	return identity, nil
+}
+
+// basicAuthenticator accepts any Basic credentials and leaves verifying
+// them to Zot.
+type basicAuthenticator struct {
+	baseAuthenticator
+}
+
+func (a *basicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, value := credentials(r)
+	if !strings.EqualFold(scheme, "Basic") || value == "" {
+		return nil, ErrNotMine
+	}
+	username, _, _ := basicCredentials(r)
+	identity := a.identity(username)
+	identity.Passthrough = true
+	return identity, nil
+}
+
+// htpasswdAuthenticator verifies Basic credentials against bcrypt hashes.
+type htpasswdAuthenticator struct {
+	baseAuthenticator
+	users map[string][]byte
+}
+
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	return users, nil
+}
+
+func (a *htpasswdAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := basicCredentials(r)
+	if !ok {
+		return nil, ErrNotMine
+	}
+	hash, ok := a.users[username]
+	if !ok {
+		return nil, ErrNotMine
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return a.identity(username), nil
+}
+
+// jwtAuthenticator verifies JWTs sent as a bearer token, or as the password
+// of Basic credentials for clients that can only log in with a password.
+type jwtAuthenticator struct {
+	baseAuthenticator
+	verifier *jwtVerifier
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, value := credentials(r)
+	token := ""
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		token = value
+	case strings.EqualFold(scheme, "Basic"):
+		var ok bool
+		if _, token, ok = basicCredentials(r); !ok {
+			// The token flow forwards bearer tokens it did not issue as
+			// Basic, so a JWT can arrive as the raw Basic value.
+			token = value
+		}
+	}
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNotMine
+	}
+
+	username, groups, err := a.verifier.verify(token)
+	if err != nil {
+		if errors.Is(err, errJWTMalformed) {
+			return nil, ErrNotMine
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+	return a.identity(username, groups...), nil
+}
+
+// mtlsAuthenticator uses the verified TLS client certificate. The common
+// name becomes the identity and organizational units become groups.
+type mtlsAuthenticator struct {
+	baseAuthenticator
+}
+
+func (a *mtlsAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNotMine
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	return a.identity(leaf.Subject.CommonName, leaf.Subject.OrganizationalUnit...), nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the proxy's lookup caches. Expired entries are
+// dropped first, then the whole cache if it is still full.
+const maxCacheEntries = 10000
+
+// ttlCache is a small in-memory cache for the results of upstream lookups.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry[V]
+	// bounded caches are cleared when full. Others only drop expired
+	// entries, once they have grown to sweepAt.
+	bounded bool
+	sweepAt int
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, entries: make(map[string]cacheEntry[V]), bounded: true, sweepAt: maxCacheEntries}
+}
+
+// newUnboundedTTLCache returns a cache whose entries are only dropped when
+// they expire, for entries that must last their whole TTL.
+func newUnboundedTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, entries: make(map[string]cacheEntry[V]), sweepAt: maxCacheEntries}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.sweepAt {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if c.bounded && len(c.entries) >= maxCacheEntries {
+			clear(c.entries)
+		}
+		if !c.bounded {
+			c.sweepAt = max(maxCacheEntries, 2*len(c.entries))
+		}
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,112 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestUpstreamChallengeTranslation(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if challenge := r.Header.Get("X-Test-Challenge"); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(backend.Close)
+
+	tests := []struct {
+		name      string
+		zotPath   string
+		userAgent string
+		method    string
+		path      string
+		challenge string
+		want      string
+	}{
+		{
+			name:      "pull",
+			userAgent: "docker/27.0.0",
+			method:    http.MethodGet,
+			path:      "/v2/private/app/manifests/1.0",
+			challenge: `Basic realm="zot"`,
+			want:      `Bearer realm="http://localhost:8080/docker-token",service="localhost:8080",scope="repository:private/app:pull"`,
+		},
+		{
+			name:      "push",
+			userAgent: "docker/27.0.0",
+			method:    http.MethodPut,
+			path:      "/v2/private/app/manifests/1.0",
+			challenge: `basic realm="zot"`,
+			want:      `Bearer realm="http://localhost:8080/docker-token",service="localhost:8080",scope="repository:private/app:push"`,
+		},
+		{
+			name:      "catalog",
+			userAgent: "docker/27.0.0",
+			method:    http.MethodGet,
+			path:      "/v2/_catalog",
+			challenge: `Basic realm="zot"`,
+			want:      `Bearer realm="http://localhost:8080/docker-token",service="localhost:8080",scope="registry:catalog:*"`,
+		},
+		{
+			name:      "zot under a sub-path",
+			zotPath:   "/zot",
+			userAgent: "docker/27.0.0",
+			method:    http.MethodHead,
+			path:      "/v2/private/app/blobs/sha256:abc",
+			challenge: `Basic realm="zot"`,
+			want:      `Bearer realm="http://localhost:8080/docker-token",service="localhost:8080",scope="repository:private/app:pull"`,
+		},
+		{
+			name:      "passthrough client keeps basic",
+			userAgent: "curl/8.0.0",
+			method:    http.MethodGet,
+			path:      "/v2/private/app/manifests/1.0",
+			challenge: `Basic realm="zot"`,
+			want:      `Basic realm="zot"`,
+		},
+		{
+			name:      "bearer challenge kept",
+			userAgent: "docker/27.0.0",
+			method:    http.MethodGet,
+			path:      "/v2/private/app/manifests/1.0",
+			challenge: `Bearer realm="https://auth.example.com/token"`,
+			want:      `Bearer realm="https://auth.example.com/token"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router, err := server.NewRouter(&config.Config{
+				LogLevel:  config.LogLevelInfo,
+				MyURL:     "http://localhost:8080",
+				ZotURL:    backend.URL + tt.zotPath,
+				Secret:    "supersecret",
+				Anonymous: config.Anonymous{Policy: config.AnonymousPolicyPull},
+			})
+			if err != nil {
+				t.Fatalf("failed to create router: %v", err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			req.Header.Set("Authorization", basicAuth("alice", "wrong"))
+			req.Header.Set("X-Test-Challenge", tt.challenge)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.want {
+				t.Errorf("expected challenge %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// clientMatcher is a compiled config.ClientRule.
+type clientMatcher struct {
+	name      string
+	userAgent *regexp.Regexp
+	header    string
+	networks  []*net.IPNet
+	profile   config.ClientProfile
+}
+
+func compileClientRules(rules []config.ClientRule) ([]clientMatcher, error) {
+	if len(rules) == 0 {
+		rules = config.DefaultClientRules()
+	}
+	matchers := make([]clientMatcher, 0, len(rules))
+	for _, rule := range rules {
+		m := clientMatcher{
+			name:    rule.Name,
+			header:  rule.Header,
+			profile: rule.Profile,
+		}
+		if rule.UserAgent != "" {
+			re, err := regexp.Compile(rule.UserAgent)
+			if err != nil {
+				return nil, fmt.Errorf("client rule %q: %w", rule.Name, err)
+			}
+			m.userAgent = re
+		}
+		networks, err := parseNetworks(rule.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("client rule %q: %w", rule.Name, err)
+		}
+		m.networks = networks
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// matches reports whether the request satisfies every condition of the rule.
+func (m clientMatcher) matches(r *http.Request) bool {
+	if m.userAgent != nil && !m.userAgent.MatchString(r.Header.Get("User-Agent")) {
+		return false
+	}
+	if m.header != "" && r.Header.Get(m.header) == "" {
+		return false
+	}
+	if len(m.networks) > 0 && !containsIP(m.networks, clientIP(r)) {
+		return false
+	}
+	return true
+}
+
+// matchClient returns the first rule matching the request. Requests that
+// match no rule are passed through.
+func matchClient(matchers []clientMatcher, r *http.Request) (string, config.ClientProfile) {
+	for _, m := range matchers {
+		if m.matches(r) {
+			return m.name, m.profile
+		}
+	}
+	return "", config.ClientProfilePassthrough
+}
+
+// clientIP returns the address of the client, as set by realIPMiddleware.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
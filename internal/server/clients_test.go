@@ -0,0 +1,94 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestClientRules_DefaultsUseTokenFlow(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	userAgents := map[string]int{
+		"docker/27.0.0":     http.StatusUnauthorized,
+		"buildkit/v0.15":    http.StatusUnauthorized,
+		"containerd/v1.7.0": http.StatusUnauthorized,
+		"containers/5.30.0 (github.com/containers/image)": http.StatusUnauthorized,
+		"kaniko/v1.23.0": http.StatusUnauthorized,
+		"curl/8.0.0":     http.StatusOK,
+	}
+	for ua, want := range userAgents {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", ua, want, rec.Code)
+		}
+	}
+}
+
+func TestClientRules_Custom(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Clients: []config.ClientRule{
+			{Name: "blocked", Header: "X-Blocked", Profile: config.ClientProfileDeny},
+			{Name: "internal", CIDRs: []string{"10.0.0.0/8"}, Profile: config.ClientProfilePassthrough},
+			{Name: "everyone", UserAgent: ".*", Profile: config.ClientProfileToken},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	req.Header.Set("X-Blocked", "1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for denied client, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("User-Agent", "docker/27.0.0")
+	req.RemoteAddr = "10.1.2.3:1234"
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected passthrough for internal client, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	req.RemoteAddr = "192.168.1.2:1234"
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected token flow for catch-all rule, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+var errNotConvertible = errors.New("manifest cannot be converted to Docker schema2")
+
+// dockerMediaTypes maps the OCI config and layer media types that have a
+// Docker schema2 equivalent.
+var dockerMediaTypes = map[string]string{ //nolint:gochecknoglobals
+	mediaTypeOCIConfig:              mediaTypeDockerConfig,
+	mediaTypeOCILayer:               mediaTypeDockerLayer,
+	mediaTypeOCILayerGzip:           mediaTypeDockerLayerGzip,
+	mediaTypeOCIForeignLayerGzip:    mediaTypeDockerForeignLayerGzip,
+	mediaTypeDockerConfig:           mediaTypeDockerConfig,
+	mediaTypeDockerLayer:            mediaTypeDockerLayer,
+	mediaTypeDockerLayerGzip:        mediaTypeDockerLayerGzip,
+	mediaTypeDockerForeignLayerGzip: mediaTypeDockerForeignLayerGzip,
+}
+
+func newDockerCompat(cfg config.DockerCompat) *manifestRewrites {
+	return newManifestRewrites(time.Duration(cfg.CacheTTL) * time.Second)
+}
+
+// acceptsOCI reports whether the client takes OCI manifests, or anything
+// Zot has.
+func acceptsOCI(r *http.Request) bool {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		for _, accepted := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case mediaTypeOCIManifest, mediaTypeOCIIndex, "*/*", "application/*":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toDockerManifest converts an OCI image manifest.
+func toDockerManifest(manifest ociManifest) (ociManifest, error) {
+	if manifest.Config == nil || manifest.ArtifactType != "" {
+		return ociManifest{}, errNotConvertible
+	}
+	config, err := toDockerDescriptor(*manifest.Config)
+	if err != nil {
+		return ociManifest{}, err
+	}
+	converted := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        &config,
+		Layers:        make([]ociDescriptor, 0, len(manifest.Layers)),
+	}
+	for _, layer := range manifest.Layers {
+		layer, err := toDockerDescriptor(layer)
+		if err != nil {
+			return ociManifest{}, err
+		}
+		converted.Layers = append(converted.Layers, layer)
+	}
+	return converted, nil
+}
+
+func toDockerDescriptor(descriptor ociDescriptor) (ociDescriptor, error) {
+	mediaType, ok := dockerMediaTypes[descriptor.MediaType]
+	if !ok {
+		return ociDescriptor{}, fmt.Errorf("%w: %s", errNotConvertible, descriptor.MediaType)
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: descriptor.Digest, Size: descriptor.Size, URLs: descriptor.URLs}, nil
+}
+
+// convert converts an OCI manifest or index, and the manifests an index
+// lists, and caches the results.
+func (g *gateway) convert(ctx context.Context, header http.Header, repository string, body []byte, mediaType string) (rewrittenManifest, error) {
+	source := digestOf(body)
+	if converted, ok := g.compat.get(repository, source, 0); ok {
+		return converted, nil
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return rewrittenManifest{}, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	var converted ociManifest
+	var err error
+	switch mediaType {
+	case mediaTypeOCIManifest:
+		converted, err = toDockerManifest(manifest)
+	case mediaTypeOCIIndex:
+		converted, err = g.toDockerManifestList(ctx, header, repository, manifest)
+	default:
+		err = fmt.Errorf("%w: %s", errNotConvertible, mediaType)
+	}
+	if err != nil {
+		return rewrittenManifest{}, err
+	}
+
+	encoded, err := json.MarshalIndent(converted, "", "   ")
+	if err != nil {
+		return rewrittenManifest{}, fmt.Errorf("failed to encode converted manifest: %w", err)
+	}
+	result := rewrittenManifest{body: encoded, mediaType: converted.MediaType, digest: digestOf(encoded)}
+	g.compat.set(repository, rewriteSource{digest: source}, result)
+	return result, nil
+}
+
+// toDockerManifestList converts an OCI index. Entries that cannot be
+// converted, like attestations and nested indexes, are left out.
+func (g *gateway) toDockerManifestList(ctx context.Context, header http.Header, repository string, index ociManifest) (ociManifest, error) {
+	converted := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifestList,
+		Manifests:     []ociDescriptor{},
+	}
+	for _, child := range index.Manifests {
+		if child.Platform == nil || child.Platform.OS == "unknown" {
+			continue
+		}
+		descriptor := ociDescriptor{MediaType: child.MediaType, Digest: child.Digest, Size: child.Size, Platform: child.Platform}
+		switch child.MediaType {
+		case mediaTypeDockerManifest:
+		case mediaTypeOCIManifest:
+			body, mediaType, err := g.getManifest(ctx, header, repository, child.Digest)
+			if err != nil {
+				return ociManifest{}, err
+			}
+			result, err := g.convert(ctx, header, repository, body, mediaType)
+			if errors.Is(err, errNotConvertible) {
+				continue
+			}
+			if err != nil {
+				return ociManifest{}, err
+			}
+			descriptor = ociDescriptor{MediaType: result.mediaType, Digest: result.digest, Size: int64(len(result.body)), Platform: child.Platform}
+		default:
+			continue
+		}
+		converted.Manifests = append(converted.Manifests, descriptor)
+	}
+	if len(converted.Manifests) == 0 {
+		return ociManifest{}, fmt.Errorf("%w: no convertible manifests in index", errNotConvertible)
+	}
+	return converted, nil
+}
+
+// dockerCompatMiddleware serves Docker schema2 conversions of OCI manifests
+// to clients that do not accept OCI types. The request still goes through
+// the rest of the gateway, so pull gates apply to the source manifest.
+func dockerCompatMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	rewrite := manifestRewrite{
+		rewrites:   g.compat,
+		accept:     manifestAccept,
+		mediaTypes: []string{mediaTypeOCIManifest, mediaTypeOCIIndex},
+		rewrite: func(r *http.Request, repository string, _ int, body []byte, mediaType string) (rewrittenManifest, bool) {
+			converted, err := g.convert(r.Context(), r.Header, repository, body, mediaType)
+			if err != nil {
+				if !errors.Is(err, errNotConvertible) {
+					slog.Error("Failed to convert manifest to Docker schema2", "repository", repository, "error", err.Error())
+				}
+				return rewrittenManifest{}, false
+			}
+			slog.Debug("Serving manifest converted to Docker schema2", "repository", repository, "digest", converted.digest)
+			return converted, true
+		},
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || !g.cfg.DockerCompat.Enabled || t.Kind != kindManifests || (r.Method != http.MethodGet && r.Method != http.MethodHead) || acceptsOCI(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rewrite.serve(w, r, next, t, 0)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+const dockerOnlyAccept = "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+type compatDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+type compatManifest struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Config        *compatDescriptor  `json:"config"`
+	Layers        []compatDescriptor `json:"layers"`
+	Manifests     []compatDescriptor `json:"manifests"`
+}
+
+func compatTestRouter(t *testing.T, backendURL string, enabled bool) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel:     config.LogLevelInfo,
+		MyURL:        "http://localhost:8080",
+		ZotURL:       backendURL,
+		DockerCompat: config.DockerCompat{Enabled: enabled, CacheTTL: 3600},
+	})
+}
+
+func ociImage(layerMediaType, layer string) string {
+	return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:` + strings.Repeat("c", 64) + `","size":100},` +
+		`"layers":[{"mediaType":"` + layerMediaType + `","digest":"sha256:` + strings.Repeat(layer, 64) + `","size":200}],` +
+		`"annotations":{"org.opencontainers.image.source":"https://example.com"}}`
+}
+
+func decodeConverted(t *testing.T, rec *httptest.ResponseRecorder, wantMediaType string) compatManifest {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != wantMediaType {
+		t.Fatalf("expected Content-Type %s, got %s", wantMediaType, got)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != manifestDigest(rec.Body.String()) {
+		t.Fatalf("expected Docker-Content-Digest to match the body, got %s", got)
+	}
+	var manifest compatManifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("failed to decode converted manifest: %v", err)
+	}
+	if manifest.MediaType != wantMediaType {
+		t.Fatalf("expected mediaType %s, got %s", wantMediaType, manifest.MediaType)
+	}
+	return manifest
+}
+
+func TestDockerCompat_Manifest(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "a")))
+	router := compatTestRouter(t, backend.URL, true)
+
+	rec := serve(router, http.MethodGet, "/v2/app/manifests/1.0", withHeader("Accept", dockerOnlyAccept))
+	manifest := decodeConverted(t, rec, "application/vnd.docker.distribution.manifest.v2+json")
+	if manifest.SchemaVersion != 2 || manifest.Config.MediaType != "application/vnd.docker.container.image.v1+json" || manifest.Config.Digest != "sha256:"+strings.Repeat("c", 64) {
+		t.Errorf("unexpected config %+v", manifest.Config)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != "application/vnd.docker.image.rootfs.diff.tar.gzip" || manifest.Layers[0].Size != 200 {
+		t.Errorf("unexpected layers %+v", manifest.Layers)
+	}
+	if strings.Contains(rec.Body.String(), "annotations") {
+		t.Errorf("expected annotations to be dropped, got %s", rec.Body.String())
+	}
+
+	head := serve(router, http.MethodHead, "/v2/app/manifests/1.0", withHeader("Accept", dockerOnlyAccept))
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Fatalf("expected an empty 200 for HEAD, got %d with %d bytes", head.Code, head.Body.Len())
+	}
+	if head.Header().Get("Docker-Content-Digest") != rec.Header().Get("Docker-Content-Digest") || head.Header().Get("Content-Length") != rec.Header().Get("Content-Length") {
+		t.Errorf("expected HEAD to describe the converted manifest, got %v", head.Header())
+	}
+
+	byDigest := serve(router, http.MethodGet, "/v2/app/manifests/"+rec.Header().Get("Docker-Content-Digest"), withHeader("Accept", dockerOnlyAccept))
+	if byDigest.Code != http.StatusOK || byDigest.Body.String() != rec.Body.String() {
+		t.Errorf("expected the converted digest to be pullable, got %d: %s", byDigest.Code, byDigest.Body.String())
+	}
+}
+
+func TestDockerCompat_Index(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	amd64 := registry.putManifest("app", "", "application/vnd.oci.image.manifest.v1+json", []byte(ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "a")))
+	arm64 := registry.putManifest("app", "", "application/vnd.oci.image.manifest.v1+json", []byte(ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "b")))
+	attestation := registry.putManifest("app", "", "application/vnd.oci.image.manifest.v1+json", []byte(ociImage("application/vnd.in-toto+json", "d")))
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + amd64 + `","size":1,"platform":{"architecture":"amd64","os":"linux"}},` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + arm64 + `","size":1,"platform":{"architecture":"arm64","os":"linux","variant":"v8"}},` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + attestation + `","size":1,"platform":{"architecture":"unknown","os":"unknown"}}]}`
+	registry.putManifest("app", "latest", "application/vnd.oci.image.index.v1+json", []byte(index))
+	router := compatTestRouter(t, backend.URL, true)
+
+	list := decodeConverted(t, serve(router, http.MethodGet, "/v2/app/manifests/latest", withHeader("Accept", dockerOnlyAccept)), "application/vnd.docker.distribution.manifest.list.v2+json")
+	if len(list.Manifests) != 2 {
+		t.Fatalf("expected the attestation to be dropped, got %+v", list.Manifests)
+	}
+	for _, child := range list.Manifests {
+		if child.MediaType != "application/vnd.docker.distribution.manifest.v2+json" || child.Digest == amd64 || child.Digest == arm64 {
+			t.Fatalf("expected converted children, got %+v", child)
+		}
+		rec := serve(router, http.MethodGet, "/v2/app/manifests/"+child.Digest, withHeader("Accept", dockerOnlyAccept))
+		decodeConverted(t, rec, "application/vnd.docker.distribution.manifest.v2+json")
+		if rec.Header().Get("Docker-Content-Digest") != child.Digest || rec.Body.Len() != child.Size {
+			t.Fatalf("expected child %s of %d bytes, got %s of %d bytes", child.Digest, child.Size, rec.Header().Get("Docker-Content-Digest"), rec.Body.Len())
+		}
+	}
+
+	// Converted manifests are cached by source digest, so pulling again does
+	// not fetch the children from Zot.
+	fetched := registry.requested(http.MethodGet, "/v2/app/manifests/sha256:")
+	serve(router, http.MethodGet, "/v2/app/manifests/latest", withHeader("Accept", dockerOnlyAccept))
+	if got := registry.requested(http.MethodGet, "/v2/app/manifests/sha256:"); got != fetched {
+		t.Errorf("expected cached conversions, children were fetched %d more times", got-fetched)
+	}
+}
+
+func TestDockerCompat_Passthrough(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		accept   string
+		manifest string
+		wantCode int
+		wantType string
+	}{
+		{name: "oci client", enabled: true, accept: "application/vnd.oci.image.manifest.v1+json", manifest: ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "a"), wantCode: http.StatusOK, wantType: "application/vnd.oci.image.manifest.v1+json"},
+		{name: "any type", enabled: true, accept: "*/*", manifest: ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "a"), wantCode: http.StatusOK, wantType: "application/vnd.oci.image.manifest.v1+json"},
+		{name: "disabled", enabled: false, accept: dockerOnlyAccept, manifest: ociImage("application/vnd.oci.image.layer.v1.tar+gzip", "a"), wantCode: http.StatusNotFound},
+		{name: "zstd layers", enabled: true, accept: dockerOnlyAccept, manifest: ociImage("application/vnd.oci.image.layer.v1.tar+zstd", "a"), wantCode: http.StatusOK, wantType: "application/vnd.oci.image.manifest.v1+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry, backend := newFakeRegistry(t)
+			registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(tt.manifest))
+			router := compatTestRouter(t, backend.URL, tt.enabled)
+
+			rec := serve(router, http.MethodGet, "/v2/app/manifests/1.0", withHeader("Accept", tt.accept))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantType != "" && (rec.Header().Get("Content-Type") != tt.wantType || rec.Body.String() != tt.manifest) {
+				t.Errorf("expected the original manifest, got %s: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+			}
+		})
+	}
+}
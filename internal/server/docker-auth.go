@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -13,27 +15,43 @@ import (
 	"github.com/USA-RedDragon/zot-docker-proxy/internal/tokenforge"
 )
 
-func dockerAuthMiddleware(cfg *config.Config) func(next http.Handler) http.Handler {
+const tokenAuthenticatorName = "token"
+
+func dockerAuthMiddleware(g *gateway) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ua := r.Header.Get("User-Agent")
-			if strings.HasPrefix(ua, "docker/") {
-				path := r.URL.Path
-				auth := r.Header.Get("Authorization")
-
-				switch {
-				case path == "/docker-token":
-					dockerTokenHandler(cfg, w, r)
-					return
-				case (path == "/v2" || path == "/v2/") && auth == "":
-					dockerPingHandler(cfg, w, r)
-					return
-				case path == "/v2" || strings.HasPrefix(path, "/v2/"):
-					dockerV2Handler(cfg, w, r)
-				}
+			rule, profile := matchClient(g.clients, r)
+			ctx := context.WithValue(r.Context(), ClientProfile_ContextKey, profile)
+			r = r.WithContext(context.WithValue(ctx, ClientRule_ContextKey, rule))
+			// canonicalPathMiddleware has rejected paths Zot could route
+			// differently, so plain comparisons are safe here.
+			path := r.URL.Path
+			isV2 := path == "/v2" || strings.HasPrefix(path, "/v2/")
+
+			if profile == config.ClientProfileDeny {
+				slog.Debug("Denying client", "rule", rule, "user_agent", r.Header.Get("User-Agent"), "remote_addr", r.RemoteAddr)
+				writeRegistryError(w, http.StatusForbidden, errCodeDenied, "client is not allowed", nil)
+				return
+			}
+			if profile != config.ClientProfileToken {
+				next.ServeHTTP(w, g.identify(r, isV2))
+				return
+			}
 
-				next.ServeHTTP(w, r)
+			auth := r.Header.Get("Authorization")
+			switch {
+			case path == "/docker-token":
+				g.dockerTokenHandler(w, r)
+				return
+			case (path == "/v2" || path == "/v2/") && auth == "":
+				g.dockerPingHandler(w, r)
 				return
+			case isV2:
+				var ok bool
+				r, ok = g.dockerV2Handler(w, r)
+				if !ok {
+					return
+				}
 			}
 
 			next.ServeHTTP(w, r)
@@ -41,37 +59,78 @@ func dockerAuthMiddleware(cfg *config.Config) func(next http.Handler) http.Handl
 	}
 }
 
-func dockerTokenHandler(cfg *config.Config, w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	token := ""
-	if auth != "" && strings.HasPrefix(auth, "Basic ") {
-		b64 := strings.TrimSpace(auth[len("Basic "):])
-		if b64 != "" {
-			token = b64
-		}
+// identify attaches the caller's identity to passthrough requests without
+// changing how they are forwarded.
+func (g *gateway) identify(r *http.Request, isV2 bool) *http.Request {
+	if !isV2 {
+		return r
+	}
+	identity, err := g.auth.authenticate(r)
+	if err != nil {
+		return r
 	}
-	if len(token) == 0 {
-		var err error
-		token, err = tokenforge.MakeToken(cfg.Secret, 1*time.Hour)
+	return withIdentity(r, identity)
+}
+
+func (g *gateway) dockerTokenHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := g.auth.authenticate(r)
+	if err != nil {
+		writeRegistryError(w, http.StatusUnauthorized, errCodeUnauthorized, "authentication failed", nil)
+		return
+	}
+
+	scopes := g.upstreamScopes(r.URL.Query()["scope"])
+	var token string
+	switch {
+	case identity.Passthrough:
+		// Hand the client's own credentials back as the token, so Zot
+		// verifies them on every request.
+		_, token = credentials(r)
+	case identity.Anonymous:
+		if g.cfg.Anonymous.Policy == config.AnonymousPolicyDisabled {
+			slog.Debug("Refusing anonymous token, anonymous access is disabled")
+			writeRegistryError(w, http.StatusUnauthorized, errCodeUnauthorized, "anonymous access is disabled", nil)
+			return
+		}
+		claims := tokenforge.Claims{
+			Subject: anonymousSubject,
+			Access:  g.access.filterGrants(identity, anonymousGrants(g.cfg, scopes)),
+		}
+		slog.Debug("Issuing anonymous token", "access", claims.Access)
+		token, err = tokenforge.MakeTokenWithClaims(g.cfg.Secret, 1*time.Hour, claims)
 		if err != nil {
 			slog.Error("Failed to generate anonymous token", "error", err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeInternalError(w)
+			return
+		}
+	default:
+		claims := tokenforge.Claims{
+			Subject: identity.Name,
+			Groups:  identity.Groups,
+			Access:  g.access.filterGrants(identity, requestedGrants(scopes)),
+		}
+		slog.Debug("Issuing token", "identity", identity.Name, "access", claims.Access)
+		token, err = tokenforge.MakeTokenWithClaims(g.cfg.Secret, 1*time.Hour, claims)
+		if err != nil {
+			slog.Error("Failed to generate token", "error", err.Error())
+			writeInternalError(w)
 			return
 		}
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	tokenBytes, err := json.Marshal(map[string]string{
 		"token": token,
 	})
 	if err != nil {
 		slog.Error("Failed to marshal token response", "error", err.Error())
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	written, err := w.Write(tokenBytes)
 	if err != nil {
 		slog.Error("Failed to write token response", "error", err.Error())
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeInternalError(w)
 		return
 	}
 	if written != len(tokenBytes) {
@@ -79,37 +138,172 @@ func dockerTokenHandler(cfg *config.Config, w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func dockerPingHandler(cfg *config.Config, w http.ResponseWriter, r *http.Request) {
+func (g *gateway) dockerPingHandler(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
-		tokenURL, err := url.JoinPath(cfg.MyURL, "/docker-token")
-		if err != nil {
-			slog.Error("Failed to build token URL", "error", err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		slog.Debug("Docker ping without Authorization, sending 401 with WWW-Authenticate Bearer", "url", r.URL.String(), "token_url", tokenURL)
-		w.Header().Set("WWW-Authenticate", "Bearer realm="+strconv.Quote(tokenURL))
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		slog.Debug("Docker ping without Authorization, sending 401 with WWW-Authenticate Bearer", "url", r.URL.String())
+		g.dockerChallenge(w, "", "")
 		return
 	}
 }
 
-func dockerV2Handler(cfg *config.Config, _ http.ResponseWriter, r *http.Request) {
+// dockerV2Handler authenticates a Docker API request and rewrites its
+// Authorization header before it is proxied. It returns false if it already
+// answered the request.
+func (g *gateway) dockerV2Handler(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	t, hasTarget := parseTarget(r)
+
 	auth := r.Header.Get("Authorization")
 	if strings.HasPrefix(auth, "Bearer ") {
 		tok := strings.TrimSpace(auth[len("Bearer "):])
-		validated, err := tokenforge.VerifyToken(cfg.Secret, tok)
+		claims, err := tokenforge.ParseToken(g.cfg.Secret, tok)
 		if err != nil {
 			// This can happen normally if the token is expired or invalid, or if
 			// docker is actually logged in with a real token.
 			slog.Debug("Failed to verify token", "error", err.Error(), "token", tok)
 		}
-		if validated {
-			slog.Debug("Verified token")
+		if err == nil {
+			identity := identityFromClaims(claims)
+			if hasTarget {
+				var allowed bool
+				if claims == nil {
+					allowed = anonymousTargetAllowed(g.cfg, t)
+				} else {
+					allowed = t.allowedBy(claims)
+				}
+				if !allowed {
+					slog.Info("Authentication decision", "result", "denied", "authenticator", tokenAuthenticatorName, "identity", identity.Name, "scope", t.scopeString(), "method", r.Method, "path", r.URL.Path)
+					g.dockerChallenge(w, t.scopeString(), "insufficient_scope")
+					return r, false
+				}
+			}
+			slog.Info("Authentication decision", "result", "allowed", "authenticator", tokenAuthenticatorName, "identity", identity.Name, "groups", identity.Groups, "method", r.Method, "path", r.URL.Path)
 			r.Header.Del("Authorization")
+			return withIdentity(r, identity), true
 		} else if tok != "" {
 			r.Header.Set("Authorization", "Basic "+tok)
 		}
 	}
+
+	identity, err := g.auth.authenticate(r)
+	if err != nil {
+		scope := ""
+		if hasTarget {
+			scope = t.scopeString()
+		}
+		g.dockerChallenge(w, scope, "")
+		return r, false
+	}
+	if identity.Anonymous && hasTarget && !anonymousTargetAllowed(g.cfg, t) {
+		g.dockerChallenge(w, t.scopeString(), "insufficient_scope")
+		return r, false
+	}
+	if !identity.Anonymous && !identity.Passthrough {
+		// The proxy verified these credentials itself, so Zot sees an
+		// anonymous request.
+		r.Header.Del("Authorization")
+	}
+	return withIdentity(r, identity), true
+}
+
+// clientProfileFromContext returns the profile of the client rule that
+// matched the request.
+func clientProfileFromContext(ctx context.Context) config.ClientProfile {
+	profile, _ := ctx.Value(ClientProfile_ContextKey).(config.ClientProfile)
+	return profile
+}
+
+// clientRuleFromContext returns the name of the client rule that matched
+// the request.
+func clientRuleFromContext(ctx context.Context) string {
+	rule, _ := ctx.Value(ClientRule_ContextKey).(string)
+	return rule
+}
+
+// identityFromClaims rebuilds the identity a token was issued to. Legacy
+// tokens without claims were always anonymous.
+func identityFromClaims(claims *tokenforge.Claims) *Identity {
+	identity := &Identity{Authenticator: tokenAuthenticatorName}
+	if claims == nil || claims.Subject == anonymousSubject || claims.Subject == "" {
+		identity.Name = anonymousSubject
+		identity.Anonymous = true
+		return identity
+	}
+	identity.Name = claims.Subject
+	identity.Groups = claims.Groups
+	return identity
+}
+
+// dockerChallenge answers with a 401 pointing the client at the token
+// endpoint. With a scope, Docker fetches a token for it, and prompts for
+// `docker login` when the token cannot be upgraded.
+func (g *gateway) dockerChallenge(w http.ResponseWriter, scope, errCode string) {
+	challenge, err := g.bearerChallenge(scope, errCode)
+	if err != nil {
+		slog.Error("Failed to build token URL", "error", err.Error())
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	message := "authentication required"
+	if errCode == "insufficient_scope" {
+		message = "requested access to the resource is denied"
+	}
+	var detail any
+	if scope != "" {
+		detail = map[string]string{"scope": scope}
+	}
+	writeRegistryError(w, http.StatusUnauthorized, errCodeUnauthorized, message, detail)
+}
+
+// bearerChallenge builds a WWW-Authenticate value for the token endpoint.
+func (g *gateway) bearerChallenge(scope, errCode string) (string, error) {
+	tokenURL, err := url.JoinPath(g.cfg.MyURL, "/docker-token")
+	if err != nil {
+		return "", fmt.Errorf("failed to build token URL: %w", err)
+	}
+	challenge := "Bearer realm=" + strconv.Quote(tokenURL)
+	if myURL, err := url.Parse(g.cfg.MyURL); err == nil && myURL.Host != "" {
+		challenge += ",service=" + strconv.Quote(myURL.Host)
+	}
+	if scope != "" {
+		challenge += ",scope=" + strconv.Quote(scope)
+	}
+	if errCode != "" {
+		challenge += ",error=" + strconv.Quote(errCode)
+	}
+	return challenge, nil
+}
+
+// translateChallenge replaces the Basic challenge of a 401 from Zot with a
+// Bearer challenge for clients using the token flow. Otherwise Docker asks
+// Zot for credentials directly and never reaches /docker-token.
+func (g *gateway) translateChallenge(resp *http.Response) {
+	if resp.StatusCode != http.StatusUnauthorized || resp.Request == nil {
+		return
+	}
+	if clientProfileFromContext(resp.Request.Context()) != config.ClientProfileToken {
+		return
+	}
+	scheme, _, _ := strings.Cut(strings.TrimSpace(resp.Header.Get("WWW-Authenticate")), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return
+	}
+
+	scope := ""
+	if path, ok := cutPathPrefix(resp.Request.URL.Path, g.upstream.Path); ok {
+		req := resp.Request.Clone(resp.Request.Context())
+		req.URL.Path = path
+		req.URL.RawPath = ""
+		if t, ok := parseTarget(req); ok {
+			scope = t.scopeString()
+		}
+	}
+	challenge, err := g.bearerChallenge(scope, "")
+	if err != nil {
+		slog.Error("Failed to translate upstream challenge", "error", err.Error())
+		return
+	}
+	slog.Debug("Translating upstream Basic challenge", "scope", scope, "path", resp.Request.URL.Path)
+	resp.Header.Set("WWW-Authenticate", challenge)
 }
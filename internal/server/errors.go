@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Error codes from the OCI distribution specification, and the UNKNOWN,
+// UNAVAILABLE, TAG_INVALID, and PAGINATION_NUMBER_INVALID codes of Docker's
+// registry.
+const (
+	errCodeBlobUploadInvalid       = "BLOB_UPLOAD_INVALID"
+	errCodeDenied                  = "DENIED"
+	errCodeDigestInvalid           = "DIGEST_INVALID"
+	errCodeManifestInvalid         = "MANIFEST_INVALID"
+	errCodeManifestUnknown         = "MANIFEST_UNKNOWN"
+	errCodeNameInvalid             = "NAME_INVALID"
+	errCodePaginationNumberInvalid = "PAGINATION_NUMBER_INVALID"
+	errCodeTagInvalid              = "TAG_INVALID"
+	errCodeUnauthorized            = "UNAUTHORIZED"
+	errCodeUnavailable             = "UNAVAILABLE"
+	errCodeUnknown                 = "UNKNOWN"
+	errCodeUnsupported             = "UNSUPPORTED"
+)
+
+// internalErrorBody is sent when an error body cannot be built.
+const internalErrorBody = `{"errors":[{"code":"UNKNOWN","message":"internal server error"}]}`
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+}
+
+type registryErrors struct {
+	Errors []registryError `json:"errors"`
+}
+
+// writeRegistryError answers with an OCI distribution error body.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string, detail any) {
+	body, err := json.Marshal(registryErrors{Errors: []registryError{{Code: code, Message: message, Detail: detail}}})
+	if err != nil {
+		slog.Error("Failed to marshal registry error", "error", err.Error())
+		status, body = http.StatusInternalServerError, []byte(internalErrorBody)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		slog.Error("Failed to write registry error", "error", err.Error())
+	}
+}
+
+// writeInternalError answers with a 500 for failures of the proxy itself.
+// The cause is logged, not sent.
+func writeInternalError(w http.ResponseWriter) {
+	writeRegistryError(w, http.StatusInternalServerError, errCodeUnknown, "internal server error", nil)
+}
+
+// writeUpstreamError answers requests that could not be forwarded to Zot.
+// It is the reverse proxy's error handler.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("Request to Zot timed out", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+		writeRegistryError(w, http.StatusGatewayTimeout, errCodeUnavailable, "request timed out", nil)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// The client went away, so nobody reads the answer.
+		slog.Debug("Request canceled by the client", "method", r.Method, "path", r.URL.Path)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if errors.Is(err, errStorageRedirect) {
+		slog.Error("Failed to fetch blob from storage", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+		writeRegistryError(w, http.StatusBadGateway, errCodeUnavailable, "storage is unreachable", nil)
+		return
+	}
+	slog.Error("Failed to reach Zot", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+	writeRegistryError(w, http.StatusBadGateway, errCodeUnavailable, "registry is unreachable", nil)
+}
+
+// recovererMiddleware answers requests whose handler panicked with a 500,
+// like chi's Recoverer, but with an OCI error body.
+func recovererMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler { //nolint:errorlint
+				// Aborting the response is how handlers hang up on the
+				// client.
+				panic(recovered)
+			}
+			slog.Error("Recovered from panic", "request_id", middleware.GetReqID(r.Context()), "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			if ww.Status() == 0 && r.Header.Get("Connection") != "Upgrade" {
+				writeInternalError(ww)
+			}
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// timeoutMiddleware cancels the request context after timeout, like chi's
+// Timeout, and answers with a 504 OCI error when nothing was sent yet.
+func timeoutMiddleware(timeout time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && ww.Status() == 0 {
+				slog.Error("Request timed out", "request_id", middleware.GetReqID(r.Context()), "method", r.Method, "path", r.URL.Path, "timeout", timeout.String())
+				writeRegistryError(ww, http.StatusGatewayTimeout, errCodeUnavailable, "request timed out", nil)
+			}
+		})
+	}
+}
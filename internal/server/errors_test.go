@@ -0,0 +1,89 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+type errorBody struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func TestProxyErrors(t *testing.T) {
+	t.Parallel()
+
+	// A closed server refuses connections, like a Zot that is down.
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name       string
+		anonymous  config.AnonymousPolicy
+		userAgent  string
+		header     string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "ping", userAgent: "docker/27.0.0", method: http.MethodGet, path: "/v2/", wantStatus: http.StatusUnauthorized, wantCode: "UNAUTHORIZED"},
+		{name: "anonymous token while disabled", anonymous: config.AnonymousPolicyDisabled, userAgent: "docker/27.0.0", method: http.MethodGet, path: "/docker-token?scope=repository:app:pull", wantStatus: http.StatusUnauthorized, wantCode: "UNAUTHORIZED"},
+		{name: "challenge", anonymous: config.AnonymousPolicyDisabled, userAgent: "docker/27.0.0", method: http.MethodGet, path: "/v2/app/manifests/1.0", wantStatus: http.StatusUnauthorized, wantCode: "UNAUTHORIZED"},
+		{name: "denied client", userAgent: "curl/8.0.0", header: "X-Blocked", method: http.MethodGet, path: "/v2/app/manifests/1.0", wantStatus: http.StatusForbidden, wantCode: "DENIED"},
+		{name: "zot unreachable", userAgent: "curl/8.0.0", method: http.MethodGet, path: "/v2/app/manifests/1.0", wantStatus: http.StatusBadGateway, wantCode: "UNAVAILABLE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			anonymous := tt.anonymous
+			if anonymous == "" {
+				anonymous = config.AnonymousPolicyPull
+			}
+			router, err := server.NewRouter(&config.Config{
+				LogLevel:  config.LogLevelInfo,
+				MyURL:     "http://localhost:8080",
+				ZotURL:    unreachable.URL,
+				Secret:    "supersecret",
+				Anonymous: config.Anonymous{Policy: anonymous},
+				Clients: []config.ClientRule{
+					{Name: "blocked", Header: "X-Blocked", Profile: config.ClientProfileDeny},
+					{Name: "docker", UserAgent: `^docker/`, Profile: config.ClientProfileToken},
+				},
+			})
+			if err != nil {
+				t.Fatalf("failed to create router: %v", err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			if tt.header != "" {
+				req.Header.Set(tt.header, "true")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("expected a JSON error, got Content-Type %s", got)
+			}
+			var body errorBody
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode error body %q: %v", rec.Body.String(), err)
+			}
+			if len(body.Errors) != 1 || body.Errors[0].Code != tt.wantCode || body.Errors[0].Message == "" {
+				t.Errorf("expected one %s error with a message, got %+v", tt.wantCode, body.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+// requestOption adjusts a request built by serve.
+type requestOption func(*http.Request)
+
+// withHeader sets a request header. An empty value leaves it unset.
+func withHeader(key, value string) requestOption {
+	return func(req *http.Request) {
+		if value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+}
+
+// withBody sends a request body.
+func withBody(body string) requestOption {
+	return func(req *http.Request) {
+		req.Body = io.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+}
+
+// withManifest sends an OCI image manifest as the request body.
+func withManifest(manifest string) requestOption {
+	return func(req *http.Request) {
+		withBody(manifest)(req)
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	}
+}
+
+// asAdmin authenticates with the admin token the test routers configure.
+func asAdmin() requestOption {
+	return withHeader("Authorization", "Bearer admin-secret")
+}
+
+// serve sends a request to the router as curl would, with the options
+// applied, and records the response.
+func serve(router http.Handler, method, path string, options ...requestOption) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	for _, option := range options {
+		option(req)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// newTestRouter creates a router for the config or fails the test.
+func newTestRouter(t *testing.T, cfg *config.Config) http.Handler {
+	t.Helper()
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	return router
+}
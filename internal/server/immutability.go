@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+// immutableRule returns the rule making the tag write-once for the
+// identity, if any.
+func immutableRule(rules []config.ImmutableTagRule, identity *Identity, repository, tag string) (config.ImmutableTagRule, bool) {
+	for _, rule := range rules {
+		if !glob.MatchAny(rule.Repositories, repository) || !glob.MatchAny(rule.Tags, tag) {
+			continue
+		}
+		if identity != nil && !identity.Anonymous && slices.Contains(rule.ExemptIdentities, identity.Name) {
+			continue
+		}
+		return rule, true
+	}
+	return config.ImmutableTagRule{}, false
+}
+
+// immutableTagsMiddleware rejects manifest pushes that would move an
+// immutable tag to a different digest.
+func immutableTagsMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.cfg.ImmutableTags) == 0 || r.Method != http.MethodPut || t.Kind != kindManifests || isDigest(t.Reference) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity := IdentityFromContext(r.Context())
+			if _, ok := immutableRule(g.cfg.ImmutableTags, g.trustedIdentity(identity), t.Repository, t.Reference); !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			manifest, err := readManifest(r)
+			if err != nil {
+				writeManifestReadError(w, err)
+				return
+			}
+
+			current, exists, err := g.manifestDigest(r, t.Repository, t.Reference)
+			if err != nil {
+				slog.Error("Failed to look up tag for immutability check", "repository", t.Repository, "tag", t.Reference, "error", err.Error())
+				writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not look up the current digest of the tag", nil)
+				return
+			}
+
+			pushed := digestOf(manifest)
+			if exists && current != pushed {
+				slog.Info("Rejected overwrite of immutable tag", "identity", identityName(identity), "repository", t.Repository, "tag", t.Reference, "current", current, "pushed", pushed)
+				writeRegistryError(w, http.StatusForbidden, errCodeDenied, "tag "+t.Reference+" is immutable", map[string]string{
+					"repository": t.Repository,
+					"tag":        t.Reference,
+					"digest":     current,
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
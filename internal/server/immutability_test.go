@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+const existingManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+
+func manifestDigest(manifest string) string {
+	sum := sha256.Sum256([]byte(manifest))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// createManifestBackend serves existingManifest for tag v1.0.0 and records
+// the digests of the manifest pushes that reach it.
+func createManifestBackend(pushed *sync.Map) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/team/app/manifests/v1.0.0":
+			w.Header().Set("Docker-Content-Digest", manifestDigest(existingManifest))
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			pushed.Store(manifestDigest(string(body)), true)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+}
+
+func TestImmutableTags(t *testing.T) {
+	t.Parallel()
+
+	var pushed sync.Map
+	backend := createManifestBackend(&pushed)
+	t.Cleanup(backend.Close)
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorHtpasswd, HtpasswdFile: writeHtpasswd(t, "release-admin", "hunter2")},
+				{Type: config.AuthenticatorBasic},
+				{Type: config.AuthenticatorAnonymous},
+			},
+		},
+		ImmutableTags: []config.ImmutableTagRule{
+			{Repositories: []string{"team/**"}, Tags: []string{"v*"}, ExemptIdentities: []string{"release-admin", "ci-bot"}},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		manifest string
+		auth     string
+		wantCode int
+	}{
+		{name: "overwrite with a different digest", path: "/v2/team/app/manifests/v1.0.0", manifest: `{"schemaVersion":2,"annotations":{"overwrite":"true"}}`, wantCode: http.StatusForbidden},
+		{name: "push of the same digest", path: "/v2/team/app/manifests/v1.0.0", manifest: existingManifest, wantCode: http.StatusCreated},
+		{name: "new tag", path: "/v2/team/app/manifests/v2.0.0", manifest: `{"schemaVersion":2}`, wantCode: http.StatusCreated},
+		{name: "mutable tag", path: "/v2/team/app/manifests/latest", manifest: `{"schemaVersion":2}`, wantCode: http.StatusCreated},
+		{name: "other repository", path: "/v2/other/app/manifests/v1.0.0", manifest: `{"schemaVersion":2}`, wantCode: http.StatusCreated},
+		{name: "exempt identity", path: "/v2/team/app/manifests/v1.0.0", manifest: `{"schemaVersion":2}`, auth: basicAuth("release-admin", "hunter2"), wantCode: http.StatusCreated},
+		// Only Zot would check ci-bot's password, so the proxy cannot rely
+		// on the name.
+		{name: "unverified exempt identity", path: "/v2/team/app/manifests/v1.0.0", manifest: `{"schemaVersion":2,"annotations":{"spoofed":"true"}}`, auth: basicAuth("ci-bot", "guess"), wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.manifest))
+			req.Header.Set("User-Agent", "curl/8.0.0")
+			req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusForbidden {
+				if !strings.Contains(rec.Body.String(), `"DENIED"`) {
+					t.Errorf("expected DENIED error, got %s", rec.Body.String())
+				}
+				if _, ok := pushed.Load(manifestDigest(tt.manifest)); ok {
+					t.Error("expected the push not to reach the backend")
+				}
+			}
+		})
+	}
+}
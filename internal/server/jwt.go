@@ -0,0 +1,284 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+var (
+	errJWTMalformed        = errors.New("malformed jwt")
+	errJWTUnsupportedAlg   = errors.New("unsupported jwt algorithm")
+	errJWTBadSignature     = errors.New("bad jwt signature")
+	errJWTExpired          = errors.New("jwt expired")
+	errJWTMissingExpiry    = errors.New("jwt has no exp claim")
+	errJWTNotYetValid      = errors.New("jwt not yet valid")
+	errJWTInvalidIssuer    = errors.New("jwt issuer mismatch")
+	errJWTInvalidAudience  = errors.New("jwt audience mismatch")
+	errJWTMissingUsername  = errors.New("jwt has no username claim")
+	errJWTUnsupportedKey   = errors.New("unsupported jwt public key")
+	errJWTPublicKeyInvalid = errors.New("jwt public key file contains no PEM block")
+)
+
+// ecdsaCurves are the curves of the ES algorithms.
+var ecdsaCurves = map[string]elliptic.Curve{ //nolint:gochecknoglobals
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// jwtVerifier checks compact JWS tokens signed with a configured key.
+type jwtVerifier struct {
+	hmacKey       []byte
+	publicKey     crypto.PublicKey
+	issuer        string
+	audience      string
+	usernameClaim string
+	groupsClaim   string
+}
+
+func newJWTVerifier(entry config.AuthenticatorConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		issuer:        entry.JWTIssuer,
+		audience:      entry.JWTAudience,
+		usernameClaim: entry.JWTUsernameClaim,
+		groupsClaim:   entry.JWTGroupsClaim,
+	}
+	if v.usernameClaim == "" {
+		v.usernameClaim = "sub"
+	}
+	if v.groupsClaim == "" {
+		v.groupsClaim = "groups"
+	}
+	if entry.JWTSecret != "" {
+		v.hmacKey = []byte(entry.JWTSecret)
+	}
+	if entry.JWTPublicKeyFile != "" {
+		key, err := loadPublicKey(entry.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+	}
+	return v, nil
+}
+
+// loadPublicKey reads a PEM encoded public key or certificate.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errJWTPublicKeyInvalid
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return key, nil
+}
+
+// verify checks the token and returns its username and groups.
+func (v *jwtVerifier) verify(token string) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errJWTMalformed
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, errJWTMalformed
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, errJWTMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", nil, errJWTMalformed
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return "", nil, errJWTMalformed
+	}
+
+	if err := v.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return "", nil, err
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return "", nil, err
+	}
+
+	username, _ := claims[v.usernameClaim].(string)
+	if username == "" {
+		return "", nil, errJWTMissingUsername
+	}
+	return username, stringsClaim(claims[v.groupsClaim]), nil
+}
+
+func (v *jwtVerifier) verifySignature(alg string, signed, signature []byte) error {
+	var (
+		hashFunc crypto.Hash
+		newHash  func() hash.Hash
+	)
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case "384":
+		hashFunc, newHash = crypto.SHA384, sha512.New384
+	case "512":
+		hashFunc, newHash = crypto.SHA512, sha512.New
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && newHash != nil:
+		if v.hmacKey == nil {
+			return errJWTUnsupportedAlg
+		}
+		mac := hmac.New(newHash, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errJWTBadSignature
+		}
+		return nil
+	case alg == "EdDSA":
+		key, ok := v.publicKey.(ed25519.PublicKey)
+		if !ok {
+			return errJWTUnsupportedKey
+		}
+		if !ed25519.Verify(key, signed, signature) {
+			return errJWTBadSignature
+		}
+		return nil
+	case newHash == nil:
+		return errJWTUnsupportedAlg
+	}
+
+	h := newHash()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		key, ok := v.publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errJWTUnsupportedKey
+		}
+		var err error
+		if strings.HasPrefix(alg, "RS") {
+			err = rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(key, hashFunc, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return errJWTBadSignature
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES"):
+		key, ok := v.publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errJWTUnsupportedKey
+		}
+		// The curve has to be the one the algorithm names, and the
+		// signature is r and s, each padded to the curve's byte size.
+		if key.Curve != ecdsaCurves[alg] {
+			return errJWTUnsupportedKey
+		}
+		half := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*half {
+			return errJWTBadSignature
+		}
+		r := new(big.Int).SetBytes(signature[:half])
+		s := new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errJWTBadSignature
+		}
+		return nil
+	default:
+		return errJWTUnsupportedAlg
+	}
+}
+
+func (v *jwtVerifier) verifyClaims(claims map[string]any) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errJWTMissingExpiry
+	}
+	if now.After(time.Unix(int64(exp), 0)) {
+		return errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return errJWTNotYetValid
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return errJWTInvalidIssuer
+		}
+	}
+	if v.audience != "" {
+		found := false
+		for _, aud := range stringsClaim(claims["aud"]) {
+			if aud == v.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errJWTInvalidAudience
+		}
+	}
+	return nil
+}
+
+// stringsClaim reads a claim that is either a list of strings or a
+// space-separated string.
+func stringsClaim(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// catalogListing and tagsListing are the catalog and tags list answers the
+// proxy builds.
+type catalogListing struct {
+	Repositories []string `json:"repositories"`
+}
+
+type tagsListing struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// enforcesPolicies reports whether policy denials are enforced rather than
+// only logged.
+func (g *gateway) enforcesPolicies() bool {
+	return !g.policies.Empty() && !g.cfg.Policies.DryRun
+}
+
+// answersListing reports whether the proxy builds the answer to a catalog
+// or tags list request itself, because its rules can hide entries from the
+// caller or Zot's names differ from the client's. Repository rules only
+// hide catalog entries, since a tags list request is checked against them
+// as a whole.
+func (g *gateway) answersListing(t target) bool {
+	if g.renamesRepositories() || g.enforcesPolicies() {
+		return true
+	}
+	return t.Action == actionCatalog && (len(g.access) > 0 || len(g.networks) > 0)
+}
+
+// readable reports whether the caller may pull from the repository, by the
+// access rules, network rules, and policies. The repository is checked like
+// a tags list request for it.
+func (g *gateway) readable(r *http.Request, repository string) bool {
+	if !g.access.allowed(g.trustedIdentity(IdentityFromContext(r.Context())), repository, actionPull) {
+		return false
+	}
+	if _, denied := deniedBy(g.networks, clientIP(r), repository, actionPull); denied {
+		return false
+	}
+	return g.policyAllows(r, target{Repository: repository, Kind: kindTags, Action: actionPull})
+}
+
+// policyAllows reports whether the enforced policies let the caller access
+// the target.
+func (g *gateway) policyAllows(r *http.Request, t target) bool {
+	if !g.enforcesPolicies() {
+		return true
+	}
+	denied, _ := g.policies.Evaluate(g.policyInput(r, t))
+	return denied == nil
+}
+
+// fetchListing reads every page of a catalog or tags list from Zot with
+// the caller's credentials. When Zot refuses the request, its response is
+// returned for the caller instead.
+func (g *gateway) fetchListing(r *http.Request, field string) ([]string, *http.Response, error) {
+	var all []string
+	next := r.URL.Path + "?n=" + strconv.Itoa(listPageSize)
+	for next != "" {
+		resp, err := g.upstreamRequest(r.Context(), http.MethodGet, next, r.Header, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp, nil
+		}
+		var page map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		link := resp.Header.Get("Link")
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode %s: %w", r.URL.Path, err)
+		}
+		var values []string
+		if raw, ok := page[field]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode %s: %w", r.URL.Path, err)
+			}
+		}
+		all = append(all, values...)
+		next = g.nextLink(link)
+	}
+	return all, nil, nil
+}
+
+// relayUpstream answers with a response from Zot, mapped like proxied
+// responses.
+func (g *gateway) relayUpstream(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	if err := g.modifyResponse(resp); err != nil {
+		slog.Error("Failed to map upstream response", "error", err.Error())
+	}
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Error("Failed to relay upstream response", "error", err.Error())
+	}
+}
+
+// paginate applies the n and last parameters to sorted entries, and
+// returns the page and whether entries follow it. It returns false for an
+// invalid n.
+func paginate(entries []string, query url.Values) ([]string, bool, bool) {
+	if last := query.Get("last"); last != "" {
+		i, found := slices.BinarySearch(entries, last)
+		if found {
+			i++
+		}
+		entries = entries[i:]
+	}
+	if !query.Has("n") {
+		return entries, false, true
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil || n < 0 {
+		return nil, false, false
+	}
+	if len(entries) > n {
+		return entries[:n], n > 0, true
+	}
+	return entries, false, true
+}
+
+// serveListing answers a catalog or tags list request with the entries the
+// caller may read, in lexical order and paginated by the proxy. Zot's pages
+// are merged first, so hidden entries never leave a page short.
+func (g *gateway) serveListing(w http.ResponseWriter, r *http.Request, t target) {
+	field := "tags"
+	if t.Action == actionCatalog {
+		field = "repositories"
+	}
+	values, refused, err := g.fetchListing(r, field)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	if refused != nil {
+		g.relayUpstream(w, refused)
+		return
+	}
+
+	mapping := repositoryMappingFromContext(r.Context())
+	entries := make([]string, 0, len(values))
+	for _, value := range values {
+		if t.Action == actionCatalog {
+			if g.readable(r, value) {
+				entries = append(entries, g.clientName(value))
+			}
+			continue
+		}
+		if g.policyAllows(r, target{Repository: t.Repository, Kind: kindManifests, Reference: value, Action: actionPull}) {
+			entries = append(entries, value)
+		}
+	}
+	slices.Sort(entries)
+	if hidden := len(values) - len(entries); hidden > 0 {
+		slog.Debug("Hid unreadable listing entries", "identity", identityName(IdentityFromContext(r.Context())), "repository", t.Repository, "hidden", hidden)
+	}
+
+	query := r.URL.Query()
+	page, more, ok := paginate(entries, query)
+	if !ok {
+		writeRegistryError(w, http.StatusBadRequest, errCodePaginationNumberInvalid, "invalid number of results requested", map[string]string{"n": query.Get("n")})
+		return
+	}
+
+	var body any = catalogListing{Repositories: page}
+	path := "/v2/_catalog"
+	if t.Action != actionCatalog {
+		name := t.Repository
+		if mapping != nil {
+			name = mapping.target.Repository
+		}
+		body = tagsListing{Name: name, Tags: page}
+		path = "/v2/" + name + "/tags/list"
+	}
+	if more {
+		next := url.Values{"n": {query.Get("n")}, "last": {page[len(page)-1]}}
+		link := path + "?" + next.Encode()
+		if mapping != nil {
+			link = mapping.withNamespace(link)
+		}
+		w.Header().Set("Link", "<"+link+`>; rel="next"`)
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		slog.Error("Failed to encode listing", "error", err.Error())
+		writeInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(encoded); err != nil {
+		slog.Error("Failed to write listing", "error", err.Error())
+	}
+}
+
+// listingMiddleware answers catalog and tags list requests itself when the
+// proxy's rules can hide entries, so callers only see the repositories and
+// tags they may read, and pagination stays correct around hidden entries.
+func listingMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || r.Method != http.MethodGet || (t.Action != actionCatalog && t.Kind != kindTags) || !g.answersListing(t) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			g.serveListing(w, r, t)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestListing_CatalogFilteredByAccess(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	// Zot's pages of two start with a hidden repository, so every page
+	// the proxy sends merges several of them.
+	registry.pageSize = 2
+	for _, repository := range []string{"app", "secret/a", "secret/b", "tools", "zeta"} {
+		registry.putManifest(repository, "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	}
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorHtpasswd, HtpasswdFile: writeHtpasswd(t, "alice", "hunter2"), Groups: []string{"developers"}},
+				{Type: config.AuthenticatorAnonymous},
+			},
+		},
+		AccessRules: []config.AccessRule{
+			{Repositories: []string{"secret/**"}, Actions: []config.Action{config.ActionPull}, Groups: []string{"developers"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		auth     string
+		path     string
+		want     []string
+		wantLink string
+	}{
+		{name: "anonymous", path: "/v2/_catalog", want: []string{"app", "tools", "zeta"}},
+		{name: "group member", auth: basicAuth("alice", "hunter2"), path: "/v2/_catalog", want: []string{"app", "secret/a", "secret/b", "tools", "zeta"}},
+		{name: "first page", path: "/v2/_catalog?n=2", want: []string{"app", "tools"}, wantLink: `</v2/_catalog?last=tools&n=2>; rel="next"`},
+		{name: "last page", path: "/v2/_catalog?last=tools&n=2", want: []string{"zeta"}},
+		{name: "after a hidden repository", path: "/v2/_catalog?last=secret/a&n=1", want: []string{"tools"}, wantLink: `</v2/_catalog?last=tools&n=1>; rel="next"`},
+		{name: "group member page", auth: basicAuth("alice", "hunter2"), path: "/v2/_catalog?last=app&n=2", want: []string{"secret/a", "secret/b"}, wantLink: `</v2/_catalog?last=secret%2Fb&n=2>; rel="next"`},
+		{name: "empty page", path: "/v2/_catalog?n=0", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := serve(router, http.MethodGet, tt.path, withHeader("Authorization", tt.auth))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var catalog struct {
+				Repositories []string `json:"repositories"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+				t.Fatalf("failed to decode catalog: %v", err)
+			}
+			if !slices.Equal(catalog.Repositories, tt.want) || catalog.Repositories == nil {
+				t.Errorf("expected %v, got %v", tt.want, catalog.Repositories)
+			}
+			if got := rec.Header().Get("Link"); got != tt.wantLink {
+				t.Errorf("expected Link %q, got %q", tt.wantLink, got)
+			}
+		})
+	}
+}
+
+func TestListing_TagsFilteredByPolicy(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.pageSize = 2
+	for _, tag := range []string{"1.0", "2.0", "internal-1", "internal-2", "3.0"} {
+		registry.putManifest("app", tag, "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers(tag)))
+	}
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Policies: config.Policies{
+			Rules: []config.PolicyRule{
+				{Name: "hide-internal", Expression: `!(action == "pull" && reference.startsWith("internal-"))`},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	var seen []string
+	path := "/v2/app/tags/list?n=2"
+	for path != "" {
+		rec := serve(router, http.MethodGet, path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		var list tagList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GET %s: failed to decode tag list: %v", path, err)
+		}
+		if list.Name != "app" || len(list.Tags) == 0 {
+			t.Fatalf("GET %s: expected a page of app's tags, got %+v", path, list)
+		}
+		seen = append(seen, list.Tags...)
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			path = link[1 : len(link)-len(`>; rel="next"`)]
+		}
+	}
+	if !slices.Equal(seen, []string{"1.0", "2.0", "3.0"}) {
+		t.Errorf("expected the readable tags in lexical order, got %v", seen)
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/app/tags/list?n=-1")
+	var body errorBody
+	if rec.Code != http.StatusBadRequest || json.Unmarshal(rec.Body.Bytes(), &body) != nil || len(body.Errors) != 1 || body.Errors[0].Code != "PAGINATION_NUMBER_INVALID" {
+		t.Errorf("expected a PAGINATION_NUMBER_INVALID error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListing_UnfilteredIsProxied(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/_catalog?n=1")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected Zot's own answer, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
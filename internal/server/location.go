@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// linkTargetRegexp matches the target URLs of a Link header.
+var linkTargetRegexp = regexp.MustCompile(`<([^>]*)>`)
+
+// locationRewriter maps URLs that point at Zot to the proxy's public URL.
+type locationRewriter struct {
+	upstream *url.URL
+	public   *url.URL
+}
+
+// newLocationRewriter returns nil when there is no public URL to rewrite to.
+func newLocationRewriter(upstream *url.URL, myURL string) *locationRewriter {
+	public, err := url.Parse(myURL)
+	if err != nil || public.Host == "" {
+		return nil
+	}
+	return &locationRewriter{upstream: upstream, public: public}
+}
+
+// rewrite maps a URL under Zot's URL to the same path under the public URL.
+// Root-relative URLs are mapped between the path prefixes, and anything
+// else is left alone.
+func (l *locationRewriter) rewrite(raw string) string {
+	target, err := url.Parse(raw)
+	if err != nil || target.Opaque != "" {
+		return raw
+	}
+	if target.IsAbs() && !sameOrigin(target, l.upstream) {
+		return raw
+	}
+	if !target.IsAbs() && (target.Host != "" || !strings.HasPrefix(target.Path, "/")) {
+		return raw
+	}
+	rest, ok := cutPathPrefix(target.Path, l.upstream.Path)
+	if !ok {
+		return raw
+	}
+
+	rewritten := *target
+	rewritten.Path = strings.TrimSuffix(l.public.Path, "/") + rest
+	rewritten.RawPath = ""
+	if target.IsAbs() {
+		rewritten.Scheme = l.public.Scheme
+		rewritten.Host = l.public.Host
+		rewritten.User = nil
+	}
+	return rewritten.String()
+}
+
+// rewriteResponse rewrites the Location and Link headers of a response.
+func (l *locationRewriter) rewriteResponse(resp *http.Response) {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", l.rewrite(location))
+	}
+	if links := resp.Header.Values("Link"); len(links) > 0 {
+		rewritten := make([]string, 0, len(links))
+		for _, link := range links {
+			rewritten = append(rewritten, linkTargetRegexp.ReplaceAllStringFunc(link, func(match string) string {
+				return "<" + l.rewrite(match[1:len(match)-1]) + ">"
+			}))
+		}
+		resp.Header["Link"] = rewritten
+	}
+}
+
+// sameOrigin compares the scheme, host, and effective port of two URLs.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(a.Hostname(), b.Hostname()) &&
+		effectivePort(a) == effectivePort(b)
+}
+
+func effectivePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// cutPathPrefix removes a path prefix on a segment boundary.
+func cutPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path, true
+	}
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return rest, true
+}
@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestLocationRewrite(t *testing.T) {
+	t.Parallel()
+
+	var zotURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location := r.Header.Get("X-Test-Location"); location != "" {
+			w.Header().Set("Location", strings.ReplaceAll(location, "{zot}", zotURL))
+		}
+		for _, link := range r.Header.Values("X-Test-Link") {
+			w.Header().Add("Link", strings.ReplaceAll(link, "{zot}", zotURL))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(backend.Close)
+	zotURL = backend.URL
+
+	tests := []struct {
+		name         string
+		zotPath      string
+		myURL        string
+		location     string
+		links        []string
+		wantLocation string
+		wantLinks    []string
+	}{
+		{
+			name:         "upload location",
+			myURL:        "https://registry.example.com",
+			location:     "{zot}/v2/app/blobs/uploads/1234?state=abc",
+			wantLocation: "https://registry.example.com/v2/app/blobs/uploads/1234?state=abc",
+		},
+		{
+			name:         "proxy under a sub-path",
+			myURL:        "https://example.com/registry/",
+			location:     "{zot}/v2/app/blobs/uploads/1234",
+			wantLocation: "https://example.com/registry/v2/app/blobs/uploads/1234",
+		},
+		{
+			name:         "zot under a sub-path",
+			zotPath:      "/zot",
+			myURL:        "https://registry.example.com/registry",
+			location:     "{zot}/zot/v2/app/blobs/uploads/1234",
+			wantLocation: "https://registry.example.com/registry/v2/app/blobs/uploads/1234",
+		},
+		{
+			name:         "root-relative location under a sub-path",
+			myURL:        "https://example.com/registry",
+			location:     "/v2/app/blobs/uploads/1234",
+			wantLocation: "/registry/v2/app/blobs/uploads/1234",
+		},
+		{
+			name:         "foreign redirect left alone",
+			myURL:        "https://registry.example.com",
+			location:     "https://bucket.s3.amazonaws.com/blob?X-Amz-Signature=abc",
+			wantLocation: "https://bucket.s3.amazonaws.com/blob?X-Amz-Signature=abc",
+		},
+		{
+			name:         "location outside the zot sub-path left alone",
+			zotPath:      "/zot",
+			myURL:        "https://registry.example.com",
+			location:     "{zot}/other/v2/",
+			wantLocation: "{zot}/other/v2/",
+		},
+		{
+			name:      "pagination links",
+			myURL:     "https://registry.example.com",
+			links:     []string{`<{zot}/v2/_catalog?last=b&n=2>; rel="next"`, `</v2/_catalog?last=d&n=2>; rel="next", <{zot}/v2/_catalog>; rel="first"`},
+			wantLinks: []string{`<https://registry.example.com/v2/_catalog?last=b&n=2>; rel="next"`, `</v2/_catalog?last=d&n=2>; rel="next", <https://registry.example.com/v2/_catalog>; rel="first"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			router, err := server.NewRouter(&config.Config{
+				LogLevel: config.LogLevelInfo,
+				MyURL:    tt.myURL,
+				ZotURL:   backend.URL + tt.zotPath,
+			})
+			if err != nil {
+				t.Fatalf("failed to create router: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v2/app/blobs/uploads/", nil)
+			req.Header.Set("User-Agent", "curl/8.0.0")
+			if tt.location != "" {
+				req.Header.Set("X-Test-Location", tt.location)
+			}
+			for _, link := range tt.links {
+				req.Header.Add("X-Test-Link", link)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+			}
+			wantLocation := strings.ReplaceAll(tt.wantLocation, "{zot}", backend.URL)
+			if got := rec.Header().Get("Location"); got != wantLocation {
+				t.Errorf("expected Location %q, got %q", wantLocation, got)
+			}
+			if got := rec.Header().Values("Link"); strings.Join(got, "\n") != strings.Join(tt.wantLinks, "\n") {
+				t.Errorf("expected Link %q, got %q", tt.wantLinks, got)
+			}
+		})
+	}
+}
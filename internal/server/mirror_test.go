@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func mirrorTestRouter(t *testing.T, backendURL string, mirror config.Mirror) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel:  config.LogLevelInfo,
+		MyURL:     "http://localhost:8080",
+		ZotURL:    backendURL,
+		Secret:    "test-secret",
+		Anonymous: config.Anonymous{Policy: config.AnonymousPolicyPullRepositories, Repositories: []string{"docker.io/**"}},
+		Mirror:    mirror,
+	})
+}
+
+func TestMirror_Names(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("docker.io/library/alpine", "latest", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	registry.putManifest("docker.io/bitnami/redis", "7", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("20")))
+	router := mirrorTestRouter(t, backend.URL, config.Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true})
+
+	for _, path := range []string{
+		"/v2/alpine/manifests/latest",
+		"/v2/library/alpine/manifests/latest",
+		"/v2/docker.io/library/alpine/manifests/latest",
+		"/v2/bitnami/redis/manifests/7",
+	} {
+		if rec := serve(router, http.MethodGet, path); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, rec.Code)
+		}
+	}
+	if got := registry.requested(http.MethodGet, "/v2/docker.io/library/alpine/manifests/latest"); got != 3 {
+		t.Errorf("expected three pulls of the mirrored alpine, got %d", got)
+	}
+
+	for path, wantName := range map[string]string{
+		"/v2/alpine/tags/list":         "alpine",
+		"/v2/library/alpine/tags/list": "library/alpine",
+	} {
+		rec := serve(router, http.MethodGet, path)
+		var list tagList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GET %s: failed to decode tag list: %v", path, err)
+		}
+		if list.Name != wantName || !slices.Equal(list.Tags, []string{"latest"}) {
+			t.Errorf("GET %s: expected %s with the latest tag, got %+v", path, wantName, list)
+		}
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/_catalog")
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("failed to decode catalog: %v", err)
+	}
+	if !slices.Equal(catalog.Repositories, []string{"bitnami/redis", "library/alpine"}) {
+		t.Errorf("expected catalog names without the prefix, got %v", catalog.Repositories)
+	}
+}
+
+func TestMirror_WithoutImplicitLibrary(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	router := mirrorTestRouter(t, backend.URL, config.Mirror{Enabled: true, Prefix: "hub"})
+
+	serve(router, http.MethodGet, "/v2/alpine/manifests/latest")
+	if registry.requested(http.MethodGet, "/v2/hub/alpine/manifests/latest") != 1 {
+		t.Error("expected alpine to map to hub/alpine")
+	}
+}
+
+func TestMirror_ResponseHeaders(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Path+"uuid-1234?state=abc")
+		w.Header().Set("Link", `<`+r.URL.Path+`?n=1&last=a>; rel="next"`)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(backend.Close)
+	router := mirrorTestRouter(t, backend.URL, config.Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true})
+
+	rec := serve(router, http.MethodPost, "/v2/alpine/blobs/uploads/")
+	if got := rec.Header().Get("Location"); got != "/v2/alpine/blobs/uploads/uuid-1234?state=abc" {
+		t.Errorf("expected the location to use the client's name, got %s", got)
+	}
+	if got := rec.Header().Get("Link"); got != `</v2/alpine/blobs/uploads/?n=1&last=a>; rel="next"` {
+		t.Errorf("expected the link to use the client's name, got %s", got)
+	}
+}
+
+func TestMirror_TokenScopes(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("docker.io/library/alpine", "latest", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router := mirrorTestRouter(t, backend.URL, config.Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true})
+
+	token := fetchAnonymousToken(t, router, "repository:library/alpine:pull")
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.Header.Set("User-Agent", "docker/27.0.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the token for library/alpine to pull the mirror, got %d: %s", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
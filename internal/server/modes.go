@@ -0,0 +1,139 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+const (
+	defaultRetryAfter         = 300
+	defaultReadOnlyMessage    = "the registry is read-only, try again later"
+	defaultMaintenanceMessage = "the registry is down for maintenance, try again later"
+)
+
+// modes holds the read-only and maintenance modes, which can change at
+// runtime through the admin API or a config reload.
+type modes struct {
+	mu          sync.RWMutex
+	readOnly    config.Mode
+	maintenance config.Mode
+}
+
+func newModes(cfg *config.Config) *modes {
+	m := &modes{}
+	m.set(cfg.ReadOnly, cfg.Maintenance)
+	return m
+}
+
+func (m *modes) set(readOnly, maintenance config.Mode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readOnly = readOnly
+	m.maintenance = maintenance
+}
+
+func (m *modes) get() (config.Mode, config.Mode) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readOnly, m.maintenance
+}
+
+func (m *modes) setReadOnly(mode config.Mode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readOnly = mode
+}
+
+func (m *modes) setMaintenance(mode config.Mode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maintenance = mode
+}
+
+// modeAppliesTo reports whether an enabled mode covers the request. Requests
+// that do not name a repository are only covered by global modes.
+func modeAppliesTo(mode config.Mode, r *http.Request) bool {
+	if !mode.Enabled {
+		return false
+	}
+	if len(mode.Repositories) == 0 {
+		return true
+	}
+	t, ok := parseTarget(r)
+	return ok && t.Repository != "" && glob.MatchAny(mode.Repositories, t.Repository)
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// modesMiddleware answers distribution API requests that the read-only or
+// maintenance modes block.
+func modesMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			if path != "/v2" && !strings.HasPrefix(path, "/v2/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			readOnly, maintenance := g.modes.get()
+			switch {
+			case modeAppliesTo(maintenance, r) && !isWriteMethod(r.Method) && maintenance.StatusBody != "":
+				slog.Debug("Serving status page, maintenance mode", "method", r.Method, "path", path)
+				writeStatusBody(w, r, maintenance)
+			case modeAppliesTo(maintenance, r):
+				slog.Debug("Blocking request, maintenance mode", "method", r.Method, "path", path)
+				writeModeError(w, maintenance, defaultMaintenanceMessage, "maintenance")
+			case isWriteMethod(r.Method) && modeAppliesTo(readOnly, r):
+				slog.Debug("Blocking write, read-only mode", "method", r.Method, "path", path)
+				writeModeError(w, readOnly, defaultReadOnlyMessage, "read-only")
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func writeModeError(w http.ResponseWriter, mode config.Mode, defaultMessage, status string) {
+	message := mode.Message
+	if message == "" {
+		message = defaultMessage
+	}
+	if mode.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfter))
+	}
+	writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, message, map[string]string{
+		"status": status,
+	})
+}
+
+// writeStatusBody answers a read during maintenance with the configured
+// status page. It is still a 503, so clients retry instead of caching it.
+func writeStatusBody(w http.ResponseWriter, r *http.Request, mode config.Mode) {
+	if mode.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(mode.RetryAfter))
+	}
+	w.Header().Set("Content-Type", http.DetectContentType([]byte(mode.StatusBody)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(mode.StatusBody)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write([]byte(mode.StatusBody)); err != nil {
+		slog.Error("Failed to write maintenance status page", "error", err.Error())
+	}
+}
@@ -0,0 +1,242 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestReadOnly_BlocksWrites(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		ReadOnly: config.Mode{Enabled: true, Message: "migrating storage", RetryAfter: 120},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodPut, "/v2/team/app/manifests/latest")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "120" {
+		t.Errorf("expected Retry-After 120, got %q", rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), `"UNAVAILABLE"`) || !strings.Contains(rec.Body.String(), "migrating storage") {
+		t.Errorf("expected UNAVAILABLE error with message, got %s", rec.Body.String())
+	}
+	if rec.Header().Get("X-Backend-Called") == "true" {
+		t.Error("expected backend not to be called")
+	}
+
+	rec = serve(router, http.MethodGet, "/v2/team/app/manifests/latest")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected reads to be proxied, got %d", rec.Code)
+	}
+}
+
+func TestReadOnly_Repositories(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		ReadOnly: config.Mode{Enabled: true, Repositories: []string{"archive/**"}},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodDelete, "/v2/archive/old/manifests/sha256:abc")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for archived repository, got %d", rec.Code)
+	}
+
+	rec = serve(router, http.MethodPost, "/v2/team/app/blobs/uploads/")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected writes to other repositories to be proxied, got %d", rec.Code)
+	}
+}
+
+func TestMaintenance_BlocksEverything(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel:    config.LogLevelInfo,
+		MyURL:       "http://localhost:8080",
+		ZotURL:      backend.URL,
+		Maintenance: config.Mode{Enabled: true, RetryAfter: 60},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		rec := serve(router, method, "/v2/team/app/manifests/latest")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", method, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `"status":"maintenance"`) {
+			t.Errorf("%s: expected maintenance status, got %s", method, rec.Body.String())
+		}
+	}
+
+	rec := serve(router, http.MethodGet, "/healthz")
+	if rec.Header().Get("X-Backend-Called") != "true" {
+		t.Error("expected non-registry paths to be proxied")
+	}
+}
+
+func TestMaintenance_StatusBody(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	const statusPage = "<html><body>Upgrading storage, back at 14:00 UTC.</body></html>"
+	router, err := server.NewRouter(&config.Config{
+		LogLevel:    config.LogLevelInfo,
+		MyURL:       "http://localhost:8080",
+		ZotURL:      backend.URL,
+		Maintenance: config.Mode{Enabled: true, RetryAfter: 60, StatusBody: statusPage},
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/team/app/manifests/latest")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != statusPage {
+		t.Errorf("expected the status page with a 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected an HTML page with Retry-After, got %v", rec.Header())
+	}
+
+	head := serve(router, http.MethodHead, "/v2/team/app/manifests/latest")
+	if head.Code != http.StatusServiceUnavailable || head.Body.Len() != 0 {
+		t.Errorf("expected HEAD to get the status without a body, got %d: %s", head.Code, head.Body.String())
+	}
+
+	push := serve(router, http.MethodPut, "/v2/team/app/manifests/latest")
+	if push.Code != http.StatusServiceUnavailable || !strings.Contains(push.Body.String(), `"status":"maintenance"`) {
+		t.Errorf("expected writes to get the OCI error, got %d: %s", push.Code, push.Body.String())
+	}
+}
+
+func TestRouter_Reload(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	reloaded := *cfg
+	reloaded.ReadOnly = config.Mode{Enabled: true}
+	router.Reload(&reloaded)
+
+	rec := serve(router, http.MethodPut, "/v2/team/app/manifests/latest")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after reload, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_ToggleReadOnly(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Admin:    config.Admin{Token: "admin-secret"},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/_proxy/admin/read-only", strings.NewReader(`{"enabled":true,"message":"frozen"}`))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/_proxy/admin/read-only", strings.NewReader(`{"enabled":true,"message":"frozen"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var mode config.Mode
+	if err := json.Unmarshal(rec.Body.Bytes(), &mode); err != nil {
+		t.Fatalf("failed to decode mode: %v", err)
+	}
+	if !mode.Enabled || mode.RetryAfter != 300 {
+		t.Errorf("expected enabled mode with default Retry-After, got %+v", mode)
+	}
+
+	rec = serve(router, http.MethodPut, "/v2/team/app/manifests/latest")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "frozen") {
+		t.Errorf("expected 503 with message, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdmin_DisabledWithoutToken(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	rec := serve(router, http.MethodGet, "/_proxy/admin/maintenance")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Backend-Called") == "true" {
+		t.Error("expected admin paths not to be proxied")
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// repositoryMapping records how the proxy renamed the repository of a
+// request, so responses can be mapped back.
+type repositoryMapping struct {
+	// target is the request as the client sent it.
+	target target
+	// upstream is the repository name in Zot.
+	upstream string
+	// namespace is the registry named by the ns parameter.
+	namespace string
+}
+
+func repositoryMappingFromContext(ctx context.Context) *repositoryMapping {
+	mapping, _ := ctx.Value(RepositoryMapping_ContextKey).(*repositoryMapping)
+	return mapping
+}
+
+// renamesRepositories reports whether any repository name mapping is
+// configured.
+func (g *gateway) renamesRepositories() bool {
+	return g.cfg.Mirror.Enabled || len(g.cfg.NS.Registries) > 0 || g.cfg.NS.Unknown == config.UnknownNamespaceDeny || len(g.aliases) > 0
+}
+
+// upstreamName maps a repository name as clients know it to its name in
+// Zot. Aliases come first, and name Zot's repository outright. Names under
+// the prefix of a registry mirrored with the ns parameter are already Zot's
+// names, like the ones in challenges for those requests.
+func (g *gateway) upstreamName(name string) string {
+	if _, upstream, ok := g.matchAlias(name); ok {
+		return upstream
+	}
+	if g.cfg.Mirror.Enabled && !g.underNamespace(name) {
+		name = mirrorName(g.cfg.Mirror.Prefix, g.cfg.Mirror.ImplicitLibrary, name)
+	}
+	return name
+}
+
+// namespacePrefix returns the prefix Zot stores the registry named by a
+// containerd ns parameter under.
+func (g *gateway) namespacePrefix(registry string) (string, bool) {
+	for _, namespace := range g.cfg.NS.Registries {
+		if strings.EqualFold(namespace.Registry, registry) {
+			return namespace.Prefix, true
+		}
+	}
+	return "", false
+}
+
+func (g *gateway) underNamespace(name string) bool {
+	for _, namespace := range g.cfg.NS.Registries {
+		if strings.HasPrefix(name, namespace.Prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// clientName maps a repository name in Zot back to the name clients know
+// it by, for listings.
+func (g *gateway) clientName(name string) string {
+	for _, alias := range g.aliases {
+		if client, ok := alias.reverse(name); ok {
+			return client
+		}
+	}
+	if g.cfg.Mirror.Enabled {
+		if rest, ok := strings.CutPrefix(name, g.cfg.Mirror.Prefix+"/"); ok {
+			name = rest
+		}
+	}
+	return name
+}
+
+// mirrorName maps a Docker Hub repository name under the prefix Zot's sync
+// extension stores Docker Hub under. Official images live in library/, so
+// alpine is library/alpine. Names already under the prefix are kept.
+func mirrorName(prefix string, implicitLibrary bool, name string) string {
+	if strings.HasPrefix(name, prefix+"/") {
+		return name
+	}
+	if implicitLibrary && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return prefix + "/" + name
+}
+
+// upstreamScopes maps the repository names of token request scopes, so
+// tokens are issued for the repositories requests are checked against.
+func (g *gateway) upstreamScopes(scopes []string) []string {
+	if !g.renamesRepositories() {
+		return scopes
+	}
+	mapped := make([]string, 0, len(scopes))
+	for _, raw := range scopes {
+		fields := strings.Fields(raw)
+		for i, scope := range fields {
+			access, ok := parseScope(scope)
+			if !ok || access.Type != scopeTypeRepository {
+				continue
+			}
+			fields[i] = access.Type + ":" + g.upstreamName(access.Name) + ":" + strings.Join(access.Actions, ",")
+		}
+		mapped = append(mapped, strings.Join(fields, " "))
+	}
+	return mapped
+}
+
+// repositoryNamesMiddleware renames the repository of distribution API
+// requests to its name in Zot. Everything after it, and Zot, only sees
+// Zot's names.
+func repositoryNamesMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || !g.renamesRepositories() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mapping := &repositoryMapping{target: t}
+			r = r.Clone(context.WithValue(r.Context(), RepositoryMapping_ContextKey, mapping))
+			query := r.URL.Query()
+			// containerd names the registry it mirrors in the ns
+			// parameter, which Zot does not know about.
+			namespace := query.Get("ns")
+			if namespace != "" {
+				query.Del("ns")
+				r.URL.RawQuery = query.Encode()
+			}
+			if t.Action == actionCatalog {
+				// Catalog listings are mapped by listingMiddleware.
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			upstreamName := g.upstreamName
+			namespaced := false
+			if namespace != "" {
+				if prefix, ok := g.namespacePrefix(namespace); ok {
+					namespaced = true
+					upstreamName = func(name string) string {
+						return prefix + "/" + name
+					}
+				} else if g.cfg.NS.Unknown == config.UnknownNamespaceDeny {
+					slog.Info("Access denied to unmirrored registry", "client_ip", r.RemoteAddr, "registry", namespace, "repository", t.Repository, "method", r.Method, "path", r.URL.Path)
+					writeRegistryError(w, http.StatusForbidden, errCodeDenied, "requested registry is not mirrored", map[string]string{
+						"registry":   namespace,
+						"repository": t.Repository,
+					})
+					return
+				}
+			}
+
+			if alias, upstream, ok := g.matchAlias(t.Repository); ok && alias.deprecated && !namespaced {
+				slog.Warn("Deprecated repository alias used", "alias", alias.name, "repository", t.Repository, "upstream", upstream, "client_ip", r.RemoteAddr, "user_agent", r.UserAgent(), "method", r.Method, "path", r.URL.Path)
+			}
+			mapping.upstream = upstreamName(t.Repository)
+			mapping.namespace = namespace
+			r.URL.Path = "/v2/" + mapping.upstream + strings.TrimPrefix(r.URL.Path, "/v2/"+t.Repository)
+			r.URL.RawPath = ""
+			if t.MountFrom != "" {
+				query.Set("from", upstreamName(t.MountFrom))
+				r.URL.RawQuery = query.Encode()
+			}
+			if mapping.upstream != t.Repository {
+				slog.Debug("Mapped repository name", "repository", t.Repository, "registry", namespace, "upstream", mapping.upstream)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// mapNamesBack rewrites Zot's repository names in the Location and Link
+// headers of a response to the names the client used. Listings are built
+// with the client's names by listingMiddleware.
+func (g *gateway) mapNamesBack(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	mapping := repositoryMappingFromContext(resp.Request.Context())
+	if mapping == nil || mapping.upstream == "" || mapping.upstream == mapping.target.Repository {
+		return
+	}
+
+	from, to := "/v2/"+mapping.upstream+"/", "/v2/"+mapping.target.Repository+"/"
+	if location := resp.Header.Get("Location"); strings.Contains(location, from) {
+		resp.Header.Set("Location", mapping.withNamespace(strings.Replace(location, from, to, 1)))
+	}
+	if links := resp.Header.Values("Link"); len(links) > 0 {
+		mapped := make([]string, 0, len(links))
+		for _, link := range links {
+			mapped = append(mapped, linkTargetRegexp.ReplaceAllStringFunc(link, func(match string) string {
+				if !strings.Contains(match, from) {
+					return match
+				}
+				return "<" + mapping.withNamespace(strings.Replace(match[1:len(match)-1], from, to, 1)) + ">"
+			}))
+		}
+		resp.Header["Link"] = mapped
+	}
+}
+
+// withNamespace adds the ns parameter of the request to a URL pointing back
+// at the repository, so following it reaches the same registry's content.
+func (m *repositoryMapping) withNamespace(raw string) string {
+	if m.namespace == "" {
+		return raw
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	query := target.Query()
+	query.Set("ns", m.namespace)
+	target.RawQuery = query.Encode()
+	return target.String()
+}
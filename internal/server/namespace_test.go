@@ -0,0 +1,159 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// recordingBackend answers every request, hands out upload locations, and
+// records the URLs Zot would have seen.
+type recordingBackend struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func newRecordingBackend(t *testing.T) (*recordingBackend, *httptest.Server) {
+	t.Helper()
+	recorder := &recordingBackend{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.mu.Lock()
+		recorder.urls = append(recorder.urls, r.URL.String())
+		recorder.mu.Unlock()
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", r.URL.Path+"uuid-1234")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+	return recorder, backend
+}
+
+func (b *recordingBackend) last() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.urls) == 0 {
+		return ""
+	}
+	return b.urls[len(b.urls)-1]
+}
+
+func namespaceTestRouter(t *testing.T, backendURL string, ns config.NamespaceMirror, mirror config.Mirror) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel:  config.LogLevelInfo,
+		MyURL:     "http://localhost:8080",
+		ZotURL:    backendURL,
+		Secret:    "test-secret",
+		Anonymous: config.Anonymous{Policy: config.AnonymousPolicyPull},
+		Mirror:    mirror,
+		NS:        ns,
+	})
+}
+
+func TestNamespaceMirror_Paths(t *testing.T) {
+	t.Parallel()
+
+	registries := []config.NamespaceRegistry{{Registry: "ghcr.io", Prefix: "ghcr"}, {Registry: "quay.io", Prefix: "mirrors/quay"}}
+	tests := []struct {
+		name     string
+		unknown  config.UnknownNamespace
+		mirror   config.Mirror
+		path     string
+		wantCode int
+		wantURL  string
+	}{
+		{name: "listed registry", path: "/v2/org/app/manifests/1.0?ns=ghcr.io", wantCode: http.StatusOK, wantURL: "/v2/ghcr/org/app/manifests/1.0"},
+		{name: "registry case", path: "/v2/org/app/manifests/1.0?ns=GHCR.io", wantCode: http.StatusOK, wantURL: "/v2/ghcr/org/app/manifests/1.0"},
+		{name: "nested prefix", path: "/v2/org/app/blobs/sha256:abc?ns=quay.io", wantCode: http.StatusOK, wantURL: "/v2/mirrors/quay/org/app/blobs/sha256:abc"},
+		{name: "unknown registry passed through", unknown: config.UnknownNamespacePassthrough, path: "/v2/org/app/manifests/1.0?ns=registry.k8s.io", wantCode: http.StatusOK, wantURL: "/v2/org/app/manifests/1.0"},
+		{name: "unknown registry denied", unknown: config.UnknownNamespaceDeny, path: "/v2/org/app/manifests/1.0?ns=registry.k8s.io", wantCode: http.StatusForbidden},
+		{name: "no ns", unknown: config.UnknownNamespaceDeny, path: "/v2/org/app/manifests/1.0", wantCode: http.StatusOK, wantURL: "/v2/org/app/manifests/1.0"},
+		{name: "unlisted docker hub falls back to mirror", unknown: config.UnknownNamespacePassthrough, mirror: config.Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true}, path: "/v2/library/alpine/manifests/latest?ns=docker.io", wantCode: http.StatusOK, wantURL: "/v2/docker.io/library/alpine/manifests/latest"},
+		{name: "other parameters kept", path: "/v2/org/app/referrers/sha256:abc?artifactType=sbom&ns=ghcr.io", wantCode: http.StatusOK, wantURL: "/v2/ghcr/org/app/referrers/sha256:abc?artifactType=sbom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			recorder, backend := newRecordingBackend(t)
+			router := namespaceTestRouter(t, backend.URL, config.NamespaceMirror{Registries: registries, Unknown: tt.unknown}, tt.mirror)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("User-Agent", "curl/8.0.0")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusForbidden {
+				if !strings.Contains(rec.Body.String(), "DENIED") || recorder.last() != "" {
+					t.Errorf("expected a DENIED error without reaching Zot, got %s", rec.Body.String())
+				}
+				return
+			}
+			if got := recorder.last(); got != tt.wantURL {
+				t.Errorf("expected Zot to see %s, got %s", tt.wantURL, got)
+			}
+		})
+	}
+}
+
+func TestNamespaceMirror_Location(t *testing.T) {
+	t.Parallel()
+
+	recorder, backend := newRecordingBackend(t)
+	router := namespaceTestRouter(t, backend.URL, config.NamespaceMirror{Registries: []config.NamespaceRegistry{{Registry: "ghcr.io", Prefix: "ghcr"}}}, config.Mirror{})
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/org/app/blobs/uploads/?ns=ghcr.io", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	location := rec.Header().Get("Location")
+	if location != "/v2/org/app/blobs/uploads/uuid-1234?ns=ghcr.io" {
+		t.Fatalf("expected the location to keep the client's name and registry, got %s", location)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, location, nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if got := recorder.last(); got != "/v2/ghcr/org/app/blobs/uploads/uuid-1234" {
+		t.Errorf("expected following the location to reach the same upload, got %s", got)
+	}
+}
+
+func TestNamespaceMirror_TokenScopes(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("ghcr/org/app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router := namespaceTestRouter(t, backend.URL, config.NamespaceMirror{Registries: []config.NamespaceRegistry{{Registry: "ghcr.io", Prefix: "ghcr"}}}, config.Mirror{Enabled: true, Prefix: "docker.io", ImplicitLibrary: true})
+
+	req := httptest.NewRequest(http.MethodPut, "/v2/org/app/manifests/1.0?ns=ghcr.io", nil)
+	req.Header.Set("User-Agent", "containerd/v1.7.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), `scope="repository:ghcr/org/app:push"`) {
+		t.Fatalf("expected a challenge for Zot's name, got %d: %s", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	// The Docker Hub mapping leaves names under a registry prefix alone, so
+	// the token covers the repository the challenge named.
+	token := fetchAnonymousToken(t, router, "repository:ghcr/org/app:pull")
+	req = httptest.NewRequest(http.MethodGet, "/v2/org/app/manifests/1.0?ns=ghcr.io", nil)
+	req.Header.Set("User-Agent", "containerd/v1.7.0")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the token to pull the mirrored image, got %d: %s", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+// parseNetworks parses a list of CIDRs.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether any of the networks contains the address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIPMiddleware replaces the remote address with the client address from
+// X-Forwarded-For or X-Real-IP, but only when the request comes from a
+// trusted proxy. X-Forwarded-For is read from the right, skipping trusted
+// proxies, so clients cannot choose their address by sending the header
+// themselves.
+func realIPMiddleware(trusted []*net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if containsIP(trusted, clientIP(r)) {
+				if ip := forwardedIP(r, trusted); ip != nil {
+					r.RemoteAddr = ip.String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedIP returns the client address a trusted proxy forwarded.
+func forwardedIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	var hops []net.IP
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			ip := net.ParseIP(strings.TrimSpace(hop))
+			if ip == nil {
+				// A malformed hop means nothing before it can be trusted.
+				hops = nil
+				continue
+			}
+			hops = append(hops, ip)
+		}
+	}
+	for i, ip := range slices.Backward(hops) {
+		if !containsIP(trusted, ip) || i == 0 {
+			return ip
+		}
+	}
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+// networkRule is a compiled config.NetworkRule.
+type networkRule struct {
+	name         string
+	repositories []string
+	actions      []config.Action
+	allow        []*net.IPNet
+	deny         []*net.IPNet
+}
+
+func compileNetworkRules(rules []config.NetworkRule) ([]networkRule, error) {
+	compiled := make([]networkRule, 0, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("network-rules[%d]", i)
+		}
+		allow, err := parseNetworks(rule.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("network rule %q: %w", name, err)
+		}
+		deny, err := parseNetworks(rule.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("network rule %q: %w", name, err)
+		}
+		compiled = append(compiled, networkRule{
+			name:         name,
+			repositories: rule.Repositories,
+			actions:      rule.Actions,
+			allow:        allow,
+			deny:         deny,
+		})
+	}
+	return compiled, nil
+}
+
+// applies reports whether the rule covers the action on the repository.
+// Catalog rules cover the whole registry.
+func (n networkRule) applies(repository, action string) bool {
+	if !slices.Contains(n.actions, config.Action(action)) {
+		return false
+	}
+	return action == actionCatalog || glob.MatchAny(n.repositories, repository)
+}
+
+// admits reports whether the rule lets the address through.
+func (n networkRule) admits(ip net.IP) bool {
+	if containsIP(n.deny, ip) {
+		return false
+	}
+	return len(n.allow) == 0 || containsIP(n.allow, ip)
+}
+
+// deniedBy returns the first rule covering the action on the repository
+// that refuses the address.
+func deniedBy(rules []networkRule, ip net.IP, repository, action string) (networkRule, bool) {
+	for _, rule := range rules {
+		if rule.applies(repository, action) && !rule.admits(ip) {
+			return rule, true
+		}
+	}
+	return networkRule{}, false
+}
+
+// networkMiddleware enforces the source network rules on every distribution
+// API request, including pull access to the source of a blob mount.
+func networkMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.networks) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip := clientIP(r)
+			rule, denied := deniedBy(g.networks, ip, t.Repository, t.Action)
+			repository, action := t.Repository, t.Action
+			if !denied && t.MountFrom != "" {
+				rule, denied = deniedBy(g.networks, ip, t.MountFrom, actionPull)
+				repository, action = t.MountFrom, actionPull
+			}
+			if !denied {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			slog.Info("Access denied by network rule", "rule", rule.name, "client_ip", r.RemoteAddr, "identity", identityName(IdentityFromContext(r.Context())), "repository", repository, "action", action, "method", r.Method, "path", r.URL.Path)
+			writeRegistryError(w, http.StatusForbidden, errCodeDenied, "requested access to the resource is denied from this network", map[string]string{
+				"repository": repository,
+				"action":     action,
+				"rule":       rule.name,
+			})
+		})
+	}
+}
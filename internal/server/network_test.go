@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+func networkTestRouter(t *testing.T, backendURL string) http.Handler {
+	t.Helper()
+	cfg := &config.Config{
+		LogLevel:       config.LogLevelInfo,
+		MyURL:          "http://localhost:8080",
+		ZotURL:         backendURL,
+		TrustedProxies: []string{"10.0.0.0/24"},
+		NetworkRules: []config.NetworkRule{
+			{Name: "cluster-only", Repositories: []string{"internal/**"}, Actions: []config.Action{config.ActionPull, config.ActionPush}, Allow: []string{"10.96.0.0/12"}},
+			{Name: "ci-pushes", Repositories: []string{"**"}, Actions: []config.Action{config.ActionPush}, Allow: []string{"10.96.0.0/12", "172.16.5.0/24"}},
+			{Repositories: []string{"**"}, Actions: []config.Action{config.ActionPull}, Deny: []string{"198.51.100.0/24"}},
+		},
+	}
+	return newTestRouter(t, cfg)
+}
+
+func TestNetworkRules(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Backend-Called", "true")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+	router := networkTestRouter(t, backend.URL)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		remoteAddr   string
+		forwardedFor string
+		wantCode     int
+		wantRule     string
+	}{
+		{name: "cluster pulls internal", method: http.MethodGet, path: "/v2/internal/app/manifests/1.0", remoteAddr: "10.100.0.5:1234", wantCode: http.StatusOK},
+		{name: "outside pulls internal", method: http.MethodGet, path: "/v2/internal/app/manifests/1.0", remoteAddr: "192.0.2.10:1234", wantCode: http.StatusForbidden, wantRule: "cluster-only"},
+		{name: "outside pulls public", method: http.MethodGet, path: "/v2/public/app/manifests/1.0", remoteAddr: "192.0.2.10:1234", wantCode: http.StatusOK},
+		{name: "ci pushes public", method: http.MethodPut, path: "/v2/public/app/manifests/1.0", remoteAddr: "172.16.5.20:1234", wantCode: http.StatusOK},
+		{name: "ci pushes internal", method: http.MethodPut, path: "/v2/internal/app/manifests/1.0", remoteAddr: "172.16.5.20:1234", wantCode: http.StatusForbidden, wantRule: "cluster-only"},
+		{name: "outside pushes public", method: http.MethodPut, path: "/v2/public/app/manifests/1.0", remoteAddr: "192.0.2.10:1234", wantCode: http.StatusForbidden, wantRule: "ci-pushes"},
+		{name: "denied network pulls", method: http.MethodGet, path: "/v2/public/app/manifests/1.0", remoteAddr: "198.51.100.7:1234", wantCode: http.StatusForbidden, wantRule: "network-rules[2]"},
+		{name: "mount from internal", method: http.MethodPost, path: "/v2/public/app/blobs/uploads/?mount=sha256:abc&from=internal/app", remoteAddr: "172.16.5.20:1234", wantCode: http.StatusForbidden, wantRule: "cluster-only"},
+		{name: "trusted proxy forwards cluster client", method: http.MethodGet, path: "/v2/internal/app/manifests/1.0", remoteAddr: "10.0.0.2:1234", forwardedFor: "10.100.0.5", wantCode: http.StatusOK},
+		{name: "trusted proxy forwards outside client", method: http.MethodGet, path: "/v2/internal/app/manifests/1.0", remoteAddr: "10.0.0.2:1234", forwardedFor: "10.100.0.5, 192.0.2.10, 10.0.0.3", wantCode: http.StatusForbidden, wantRule: "cluster-only"},
+		{name: "untrusted forwarded header ignored", method: http.MethodGet, path: "/v2/internal/app/manifests/1.0", remoteAddr: "192.0.2.10:1234", forwardedFor: "10.100.0.5", wantCode: http.StatusForbidden, wantRule: "cluster-only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+			req.Header.Set("User-Agent", "curl/8.0.0")
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantRule == "" {
+				return
+			}
+			if !strings.Contains(rec.Body.String(), `"DENIED"`) || !strings.Contains(rec.Body.String(), `"rule":"`+tt.wantRule+`"`) {
+				t.Fatalf("expected DENIED by %s, got %s", tt.wantRule, rec.Body.String())
+			}
+			if rec.Header().Get("X-Backend-Called") != "" {
+				t.Fatal("expected the request not to reach the backend")
+			}
+		})
+	}
+}
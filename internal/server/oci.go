@@ -0,0 +1,50 @@
+package server
+
+// Media types the proxy looks inside of.
+const (
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	mediaTypeOCIConfig              = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer               = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip           = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCIForeignLayerGzip    = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	mediaTypeDockerConfig           = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer            = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// ociDescriptor is a content descriptor from the OCI image spec.
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	URLs         []string          `json:"urls,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// ociManifest holds the fields of image manifests and indexes the proxy
+// uses. Docker schema2 manifests and manifest lists decode into it too.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *ociDescriptor    `json:"config,omitempty"`
+	Layers        []ociDescriptor   `json:"layers,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests,omitempty"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// Reference grammars of the distribution specification.
+var (
+	tagRegexp      = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestRegexp   = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+	uploadIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._~=-]*$`)
+)
+
+// routedPrefixes are the first path segments the proxy makes decisions on.
+var routedPrefixes = []string{"v2", "docker-token"} //nolint:gochecknoglobals
+
+// ambiguousPath reports why a request path could be routed differently by
+// the proxy and Zot, or "" when it cannot.
+func ambiguousPath(r *http.Request) string {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		return "path is not absolute"
+	}
+	if strings.ContainsAny(p, `\%`) || strings.ContainsFunc(p, func(c rune) bool { return c < 0x20 || c == 0x7f }) {
+		return "path has escaped or control characters"
+	}
+	raw := strings.ToLower(r.URL.RawPath)
+	if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") {
+		return "path has encoded separators"
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean != p {
+		return "path is not canonical"
+	}
+	first, _, _ := strings.Cut(p[1:], "/")
+	for _, prefix := range routedPrefixes {
+		if first != prefix && strings.EqualFold(first, prefix) {
+			return "path prefix must be lowercase"
+		}
+	}
+	return ""
+}
+
+// invalidTarget checks the names and references of a distribution API
+// request against the grammar of the distribution specification. It returns
+// the error code and message for the first one that does not match.
+func invalidTarget(r *http.Request, t target) (string, string, map[string]string) {
+	if t.Action == actionCatalog {
+		return "", "", nil
+	}
+	if !config.ValidRepositoryName(t.Repository) {
+		return errCodeNameInvalid, "invalid repository name", map[string]string{"name": t.Repository}
+	}
+	if t.MountFrom != "" && !config.ValidRepositoryName(t.MountFrom) {
+		return errCodeNameInvalid, "invalid repository name", map[string]string{"name": t.MountFrom}
+	}
+
+	switch t.Kind {
+	case kindManifests:
+		if isDigest(t.Reference) {
+			if !digestRegexp.MatchString(t.Reference) {
+				return errCodeDigestInvalid, "invalid digest", map[string]string{"digest": t.Reference}
+			}
+		} else if !tagRegexp.MatchString(t.Reference) {
+			return errCodeTagInvalid, "invalid tag", map[string]string{"tag": t.Reference}
+		}
+	case kindBlobs, kindReferrers:
+		if !digestRegexp.MatchString(t.Reference) {
+			return errCodeDigestInvalid, "invalid digest", map[string]string{"digest": t.Reference}
+		}
+	case kindUploads:
+		if t.Reference != "" && !uploadIDRegexp.MatchString(t.Reference) {
+			return errCodeBlobUploadInvalid, "invalid upload ID", map[string]string{"upload": t.Reference}
+		}
+		query := r.URL.Query()
+		for _, key := range []string{"digest", "mount"} {
+			if value := query.Get(key); value != "" && !digestRegexp.MatchString(value) {
+				return errCodeDigestInvalid, "invalid digest", map[string]string{"digest": value}
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// canonicalPathMiddleware runs before any routing or auth decision. It
+// rejects paths the proxy and Zot could read differently, like ones with
+// dot segments, duplicate or encoded slashes, or case variants of the
+// routed prefixes, and requests whose names or references break the
+// distribution grammar. Accepted paths are forwarded in their canonical
+// encoding, so Zot routes the path the proxy checked.
+func canonicalPathMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := ambiguousPath(r); reason != "" {
+			slog.Debug("Rejecting ambiguous request path", "reason", reason, "path", r.URL.EscapedPath(), "remote_addr", r.RemoteAddr)
+			writeRegistryError(w, http.StatusBadRequest, errCodeUnsupported, "ambiguous request path: "+reason, nil)
+			return
+		}
+		if t, ok := parseTarget(r); ok {
+			if code, message, detail := invalidTarget(r, t); code != "" {
+				writeRegistryError(w, http.StatusBadRequest, code, message, detail)
+				return
+			}
+		}
+
+		if r.URL.RawPath != "" {
+			r = r.Clone(r.Context())
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
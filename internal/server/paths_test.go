@@ -0,0 +1,180 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestCanonicalPaths(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	digest := registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "canonical", path: "/v2/app/manifests/1.0", wantCode: http.StatusOK},
+		{name: "encoded digest separator", path: "/v2/app/manifests/" + strings.Replace(digest, ":", "%3A", 1), wantCode: http.StatusOK},
+		{name: "dot dot segment", path: "/v2/secret/../app/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "dot segment", path: "/v2/./app/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "duplicate slash", path: "/v2//app/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "encoded slash", path: "/v2/team%2Fapp/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "double encoding", path: "/v2/app/manifests/%252e%252e", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "prefix case", path: "/V2/app/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "token endpoint case", path: "/Docker-Token?scope=repository:app:pull", wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "uppercase name", path: "/v2/App/manifests/1.0", wantCode: http.StatusBadRequest, wantErr: "NAME_INVALID"},
+		{name: "invalid tag", path: "/v2/app/manifests/-bad", wantCode: http.StatusBadRequest, wantErr: "TAG_INVALID"},
+		{name: "long tag", path: "/v2/app/manifests/" + strings.Repeat("a", 129), wantCode: http.StatusBadRequest, wantErr: "TAG_INVALID"},
+		{name: "blob by tag", path: "/v2/app/blobs/latest", wantCode: http.StatusBadRequest, wantErr: "DIGEST_INVALID"},
+		{name: "invalid digest", path: "/v2/app/manifests/SHA256:abc", wantCode: http.StatusBadRequest, wantErr: "DIGEST_INVALID"},
+		{name: "invalid mount source", method: http.MethodPost, path: "/v2/app/blobs/uploads/?mount=sha256:abc&from=Team/App", wantCode: http.StatusBadRequest, wantErr: "NAME_INVALID"},
+		{name: "invalid mount digest", method: http.MethodPost, path: "/v2/app/blobs/uploads/?mount=abc&from=team/app", wantCode: http.StatusBadRequest, wantErr: "DIGEST_INVALID"},
+		{name: "invalid upload ID", method: http.MethodPatch, path: "/v2/app/blobs/uploads/.upload", wantCode: http.StatusBadRequest, wantErr: "BLOB_UPLOAD_INVALID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := serve(router, method, tt.path, withHeader("Accept", "application/vnd.oci.image.manifest.v1+json"))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantErr == "" {
+				return
+			}
+			var body errorBody
+			if json.Unmarshal(rec.Body.Bytes(), &body) != nil || len(body.Errors) != 1 || body.Errors[0].Code != tt.wantErr {
+				t.Errorf("expected a %s error, got %s", tt.wantErr, rec.Body.String())
+			}
+		})
+	}
+}
+
+// zotRoutes are the distribution routes Zot serves, with the repository name
+// as the first group.
+var zotRoutes = []*regexp.Regexp{ //nolint:gochecknoglobals
+	regexp.MustCompile(`^/v2/(.+)/(?:manifests|blobs|referrers)/[^/]+$`),
+	regexp.MustCompile(`^/v2/(.+)/tags/list$`),
+	regexp.MustCompile(`^/v2/(.+)/blobs/uploads/[^/]*$`),
+}
+
+// FuzzCanonicalPaths checks that whatever request path a client sends, Zot
+// only sees the canonical path the proxy made its decisions on, and never
+// routes an anonymous request to a protected repository.
+func FuzzCanonicalPaths(f *testing.F) {
+	for _, seed := range []string{
+		"/v2/secret/app/manifests/1.0",
+		"/v2/public/app/manifests/1.0",
+		"/v2/public/../secret/app/manifests/1.0",
+		"/v2//secret/app/manifests/1.0",
+		"/v2/public%2F..%2Fsecret/app/manifests/1.0",
+		"/v2/public/%2e%2e/secret/app/manifests/1.0",
+		"/V2/secret/app/manifests/1.0",
+		"/v2/secret/app/manifests/%2e%2e",
+		"/v2/./secret/app/tags/list",
+		"/v2/secret/app/blobs/uploads/?mount=sha256:abc&from=public/app",
+		"/v2/_catalog",
+		"/v2/",
+		"/docker-token?scope=repository:secret/app:pull",
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+
+	var (
+		mu   sync.Mutex
+		seen []*url.URL
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	f.Cleanup(backend.Close)
+
+	router, err := server.NewRouter(&config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Secret:   "test-secret",
+		Auth: config.Auth{
+			Chain: []config.AuthenticatorConfig{
+				{Type: config.AuthenticatorAnonymous},
+			},
+		},
+		AccessRules: []config.AccessRule{
+			{Repositories: []string{"secret/**"}, Actions: []config.Action{config.ActionPull, config.ActionPush, config.ActionDelete}, Groups: []string{"developers"}},
+		},
+	})
+	if err != nil {
+		f.Fatalf("failed to create router: %v", err)
+	}
+
+	f.Fuzz(func(t *testing.T, target string, docker bool) {
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			t.Skip()
+		}
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL = u
+		req.RequestURI = target
+		req.Header.Set("User-Agent", "curl/8.0.0")
+		if docker {
+			req.Header.Set("User-Agent", "docker/27.0.0")
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, forwarded := range seen {
+			clean := path.Clean(forwarded.Path)
+			if strings.HasSuffix(forwarded.Path, "/") && clean != "/" {
+				clean += "/"
+			}
+			if forwarded.Path != clean || forwarded.Path != u.Path {
+				t.Errorf("Zot saw %q for %q, which the proxy checked as %q", forwarded.Path, target, u.Path)
+			}
+			if strings.Contains(strings.ToLower(forwarded.EscapedPath()), "%2f") {
+				t.Errorf("Zot saw an encoded slash in %q for %q", forwarded.EscapedPath(), target)
+			}
+			for _, route := range zotRoutes {
+				if match := route.FindStringSubmatch(forwarded.Path); match != nil && strings.HasPrefix(match[1], "secret/") {
+					t.Errorf("Zot routed %q for %q to the protected repository %s", forwarded.Path, target, match[1])
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+// platformFilter trims indexes and manifest lists for matching requests,
+// and remembers the results so filtered digests can be pulled.
+type platformFilter struct {
+	rules []config.PlatformFilterRule
+	// filtered remembers filtered indexes and the indexes they were made
+	// from.
+	filtered *manifestRewrites
+}
+
+func newPlatformFilter(cfg config.PlatformFilters) *platformFilter {
+	return &platformFilter{
+		rules:    cfg.Rules,
+		filtered: newManifestRewrites(time.Duration(cfg.CacheTTL) * time.Second),
+	}
+}
+
+// rule returns the index of the first rule covering the repository and the
+// client of the request, or -1.
+func (p *platformFilter) rule(r *http.Request, repository string) int {
+	client := clientRuleFromContext(r.Context())
+	for i, rule := range p.rules {
+		if len(rule.Repositories) > 0 && !glob.MatchAny(rule.Repositories, repository) {
+			continue
+		}
+		if len(rule.Clients) > 0 && !slices.Contains(rule.Clients, client) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// keepsEntry reports whether the rule keeps an index entry for the
+// platform. A platform without a variant keeps every variant.
+func keepsEntry(rule config.PlatformFilterRule, platform *ociPlatform) bool {
+	if platform == nil {
+		return len(rule.Platforms) == 0
+	}
+	if rule.DropAttestations && platform.OS == "unknown" && platform.Architecture == "unknown" {
+		return false
+	}
+	if len(rule.Platforms) == 0 {
+		return true
+	}
+	return slices.Contains(rule.Platforms, platformString(platform)) || slices.Contains(rule.Platforms, platform.OS+"/"+platform.Architecture)
+}
+
+// filterEntries drops the entries of an index the rule does not keep. Only
+// the manifests list changes, so the same index and rule always give the
+// same document and digest. It returns false when the index is left as is,
+// including when no entry would be left.
+func filterEntries(rule config.PlatformFilterRule, body []byte) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false, fmt.Errorf("failed to decode index: %w", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(fields["manifests"], &entries); err != nil {
+		return nil, false, fmt.Errorf("failed to decode index manifests: %w", err)
+	}
+	kept := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		var descriptor ociDescriptor
+		if err := json.Unmarshal(entry, &descriptor); err != nil {
+			return nil, false, fmt.Errorf("failed to decode index manifest: %w", err)
+		}
+		if keepsEntry(rule, descriptor.Platform) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) || len(kept) == 0 {
+		return body, false, nil
+	}
+
+	encoded, err := json.Marshal(kept)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode index manifests: %w", err)
+	}
+	fields["manifests"] = encoded
+	filtered, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode index: %w", err)
+	}
+	return filtered, true, nil
+}
+
+// filterIndex filters an index with a rule, and caches the result.
+func (p *platformFilter) filterIndex(repository string, rule int, body []byte, mediaType string) (rewrittenManifest, bool, error) {
+	source := digestOf(body)
+	if filtered, ok := p.filtered.get(repository, source, rule); ok {
+		return filtered, true, nil
+	}
+	encoded, changed, err := filterEntries(p.rules[rule], body)
+	if err != nil || !changed {
+		return rewrittenManifest{}, false, err
+	}
+	result := rewrittenManifest{body: encoded, mediaType: mediaType, digest: digestOf(encoded)}
+	p.filtered.set(repository, rewriteSource{digest: source, rule: rule}, result)
+	return result, true, nil
+}
+
+// platformFilterMiddleware serves image indexes and manifest lists trimmed
+// to the platforms of the first matching platform filter rule. Filtered
+// digests are pulled through their source index, so the rest of the
+// gateway checks the index Zot has.
+func platformFilterMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	rewrite := manifestRewrite{
+		rewrites:   g.platforms.filtered,
+		mediaTypes: []string{mediaTypeOCIIndex, mediaTypeDockerManifestList},
+		rewrite: func(_ *http.Request, repository string, rule int, body []byte, mediaType string) (rewrittenManifest, bool) {
+			filtered, changed, err := g.platforms.filterIndex(repository, rule, body, mediaType)
+			if err != nil {
+				slog.Error("Failed to filter index platforms", "repository", repository, "error", err.Error())
+			}
+			if changed {
+				slog.Debug("Serving platform-filtered index", "rule", g.platforms.rules[rule].Name, "repository", repository, "digest", filtered.digest)
+			}
+			return filtered, changed
+		},
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.platforms.rules) == 0 || t.Kind != kindManifests || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rule := -1
+			if !isDigest(t.Reference) {
+				rule = g.platforms.rule(r, t.Repository)
+			}
+			rewrite.serve(w, r, next, t, rule)
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+// indexAccept is the Accept header of clients that take image indexes.
+const indexAccept = "application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json"
+
+const multiPlatformIndex = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+	`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","size":100,"platform":{"architecture":"amd64","os":"linux"}},` +
+	`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb","size":100,"platform":{"architecture":"arm64","os":"linux","variant":"v8"}},` +
+	`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc","size":100,"platform":{"architecture":"unknown","os":"unknown"},"annotations":{"vnd.docker.reference.type":"attestation-manifest"}}` +
+	`],"annotations":{"org.opencontainers.image.source":"https://example.com/app"}}`
+
+func platformTestRouter(t *testing.T, backendURL string) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backendURL,
+		Clients: []config.ClientRule{
+			{Name: "edge", UserAgent: `^edge-agent/`, Profile: config.ClientProfilePassthrough},
+			{Name: "curl", UserAgent: `^curl/`, Profile: config.ClientProfilePassthrough},
+		},
+		PlatformFilters: config.PlatformFilters{
+			CacheTTL: 60,
+			Rules: []config.PlatformFilterRule{
+				{Name: "edge", Clients: []string{"edge"}, Platforms: []string{"linux/arm64"}},
+				{Name: "attestations", Repositories: []string{"tools/**"}, DropAttestations: true},
+			},
+		},
+	})
+}
+
+func indexPlatforms(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var index struct {
+		Manifests []struct {
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+			} `json:"platform"`
+		} `json:"manifests"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatalf("failed to decode index: %v", err)
+	}
+	if index.Annotations["org.opencontainers.image.source"] == "" {
+		t.Errorf("expected the index annotations to be kept, got %s", rec.Body.String())
+	}
+	platforms := make([]string, 0, len(index.Manifests))
+	for _, manifest := range index.Manifests {
+		platforms = append(platforms, manifest.Platform.OS+"/"+manifest.Platform.Architecture)
+	}
+	return platforms
+}
+
+func TestPlatformFilter_Client(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	source := registry.putManifest("app", "1.0", "application/vnd.oci.image.index.v1+json", []byte(multiPlatformIndex))
+	router := platformTestRouter(t, backend.URL)
+
+	rec := serve(router, http.MethodGet, "/v2/app/manifests/1.0", withHeader("User-Agent", "edge-agent/1.2"), withHeader("Accept", indexAccept))
+	if platforms := indexPlatforms(t, rec); len(platforms) != 1 || platforms[0] != "linux/arm64" {
+		t.Fatalf("expected only linux/arm64, got %v", platforms)
+	}
+	digest := rec.Header().Get("Docker-Content-Digest")
+	if digest != manifestDigest(rec.Body.String()) || digest == source {
+		t.Fatalf("expected the digest of the filtered index, got %s", digest)
+	}
+
+	head := serve(router, http.MethodHead, "/v2/app/manifests/1.0", withHeader("User-Agent", "edge-agent/1.2"), withHeader("Accept", indexAccept))
+	if head.Header().Get("Docker-Content-Digest") != digest || head.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) || head.Body.Len() != 0 {
+		t.Errorf("expected HEAD to describe the filtered index, got %v", head.Header())
+	}
+
+	// Repeated pulls, and pulls of the filtered digest, get the same
+	// document.
+	again := serve(router, http.MethodGet, "/v2/app/manifests/1.0", withHeader("User-Agent", "edge-agent/1.2"), withHeader("Accept", indexAccept))
+	byDigest := serve(router, http.MethodGet, "/v2/app/manifests/"+digest, withHeader("User-Agent", "edge-agent/1.2"), withHeader("Accept", indexAccept))
+	for _, other := range []*httptest.ResponseRecorder{again, byDigest} {
+		if other.Code != http.StatusOK || other.Body.String() != rec.Body.String() || other.Header().Get("Docker-Content-Digest") != digest {
+			t.Errorf("expected the same filtered index, got %d: %s", other.Code, other.Body.String())
+		}
+	}
+	if got := registry.requested(http.MethodGet, "/v2/app/manifests/"+digest); got != 0 {
+		t.Errorf("expected the filtered digest to be pulled through its source, Zot saw it %d times", got)
+	}
+
+	if platforms := indexPlatforms(t, serve(router, http.MethodGet, "/v2/app/manifests/"+source, withHeader("User-Agent", "edge-agent/1.2"), withHeader("Accept", indexAccept))); len(platforms) != 3 {
+		t.Errorf("expected pulls of the source digest to be left alone, got %v", platforms)
+	}
+	if platforms := indexPlatforms(t, serve(router, http.MethodGet, "/v2/app/manifests/1.0", withHeader("Accept", indexAccept))); len(platforms) != 3 {
+		t.Errorf("expected other clients to get the whole index, got %v", platforms)
+	}
+}
+
+func TestPlatformFilter_DropAttestations(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.putManifest("tools/app", "1.0", "application/vnd.oci.image.index.v1+json", []byte(multiPlatformIndex))
+	registry.putManifest("tools/app", "image", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router := platformTestRouter(t, backend.URL)
+
+	platforms := indexPlatforms(t, serve(router, http.MethodGet, "/v2/tools/app/manifests/1.0", withHeader("Accept", indexAccept)))
+	if len(platforms) != 2 || platforms[0] != "linux/amd64" || platforms[1] != "linux/arm64" {
+		t.Errorf("expected the attestation entry to be dropped, got %v", platforms)
+	}
+
+	image := serve(router, http.MethodGet, "/v2/tools/app/manifests/image", withHeader("Accept", indexAccept))
+	if image.Code != http.StatusOK || image.Body.String() != imageWithLayers("10") {
+		t.Errorf("expected image manifests to be passed through, got %d: %s", image.Code, image.Body.String())
+	}
+}
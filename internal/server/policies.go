@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/policy"
+)
+
+func compilePolicies(cfg config.Policies) (*policy.Engine, error) {
+	policies := make([]*policy.Policy, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		p, err := policy.Compile(rule.Name, rule.Expression, rule.Message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile policy: %w", err)
+		}
+		policies = append(policies, p)
+	}
+	return policy.NewEngine(policies...), nil
+}
+
+// policyInput collects the attributes of a request that policies see.
+func (g *gateway) policyInput(r *http.Request, t target) policy.Input {
+	input := policy.Input{
+		Identity:   anonymousSubject,
+		Anonymous:  true,
+		Repository: t.Repository,
+		Reference:  t.Reference,
+		Kind:       t.Kind,
+		Action:     t.Action,
+		UserAgent:  r.Header.Get("User-Agent"),
+		Time:       time.Now(),
+	}
+	if ip := clientIP(r); ip != nil {
+		input.ClientIP = ip.String()
+	}
+	if identity := g.trustedIdentity(IdentityFromContext(r.Context())); identity != nil {
+		input.Identity = identity.Name
+		input.Groups = identity.Groups
+		input.Anonymous = identity.Anonymous
+	}
+	return input
+}
+
+// policyMiddleware evaluates the CEL policies for every distribution API
+// request. In dry-run mode, denials are only logged.
+func policyMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || g.policies.Empty() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			input := g.policyInput(r, t)
+			denied, err := g.policies.Evaluate(input)
+			if denied == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			attrs := []any{"policy", denied.Name, "identity", input.Identity, "repository", input.Repository, "reference", input.Reference, "action", input.Action, "client_ip", input.ClientIP}
+			if err != nil {
+				attrs = append(attrs, "error", err.Error())
+			}
+			if g.cfg.Policies.DryRun {
+				slog.Warn("Policy would deny request (dry run)", attrs...)
+				next.ServeHTTP(w, r)
+				return
+			}
+			slog.Info("Policy denied request", attrs...)
+
+			message := denied.Message
+			if message == "" {
+				message = fmt.Sprintf("denied by policy %s", denied.Name)
+			}
+			g.denyAccess(w, r, t, message)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/server"
+)
+
+func TestPolicies_Enforced(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Policies: config.Policies{
+			Rules: []config.PolicyRule{
+				{Name: "no-latest-push", Expression: `!(action == "push" && kind == "manifests" && reference == "latest")`, Message: "pushing latest is not allowed"},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/v2/team/app/manifests/latest", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "pushing latest is not allowed") {
+		t.Errorf("expected policy message in body, got %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/v2/team/app/manifests/1.0.0", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestPolicies_DryRun(t *testing.T) {
+	t.Parallel()
+
+	backend := createTestBackend()
+	defer backend.Close()
+
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backend.URL,
+		Policies: config.Policies{
+			DryRun: true,
+			Rules: []config.PolicyRule{
+				{Name: "deny-all", Expression: "false"},
+			},
+		},
+	}
+	router, err := server.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/team/app/manifests/latest", nil)
+	req.Header.Set("User-Agent", "curl/8.0.0")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected dry run to forward the request, got %d", rec.Code)
+	}
+}
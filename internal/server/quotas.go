@@ -0,0 +1,470 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// listPageSize is the page size the proxy asks for when it lists the
+// catalog or tags of Zot.
+const listPageSize = 1000
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type namespaceUsage struct {
+	blobs        map[string]int64
+	bytes        int64
+	repositories map[string]struct{}
+}
+
+func newNamespaceUsage() *namespaceUsage {
+	return &namespaceUsage{blobs: make(map[string]int64), repositories: make(map[string]struct{})}
+}
+
+func (u *namespaceUsage) add(repository string, blobs map[string]int64) {
+	u.repositories[repository] = struct{}{}
+	for digest, size := range blobs {
+		if _, ok := u.blobs[digest]; !ok {
+			u.blobs[digest] = size
+			u.bytes += size
+		}
+	}
+}
+
+// quotaRecord is a push counted while a reconcile is running.
+type quotaRecord struct {
+	namespace  int
+	repository string
+	blobs      map[string]int64
+}
+
+// quotaTracker keeps the storage and repository usage of the namespaces
+// with quotas.
+type quotaTracker struct {
+	mu         sync.Mutex
+	namespaces []config.QuotaNamespace
+	usage      []*namespaceUsage
+	// reconciling serializes reconciles. While one runs, pending holds
+	// the pushes it may have missed.
+	reconciling sync.Mutex
+	pending     []quotaRecord
+}
+
+// quotaReport is the usage of a namespace, as reported by the admin API.
+type quotaReport struct {
+	Prefix          string `json:"prefix"`
+	Bytes           int64  `json:"bytes"`
+	MaxBytes        int64  `json:"max-bytes"`
+	Repositories    int    `json:"repositories"`
+	MaxRepositories int    `json:"max-repositories"`
+}
+
+func newQuotaTracker(cfg config.Quotas) *quotaTracker {
+	q := &quotaTracker{}
+	for _, namespace := range cfg.Namespaces {
+		namespace.Prefix = strings.Trim(namespace.Prefix, "/")
+		q.namespaces = append(q.namespaces, namespace)
+		q.usage = append(q.usage, newNamespaceUsage())
+	}
+	return q
+}
+
+// namespace returns the index of the namespace with the longest prefix
+// containing the repository, or -1.
+func (q *quotaTracker) namespace(repository string) int {
+	best := -1
+	for i, namespace := range q.namespaces {
+		if repository != namespace.Prefix && !strings.HasPrefix(repository, namespace.Prefix+"/") {
+			continue
+		}
+		if best < 0 || len(namespace.Prefix) > len(q.namespaces[best].Prefix) {
+			best = i
+		}
+	}
+	return best
+}
+
+// check reports whether storing the blobs in the repository would exceed
+// the namespace's quota. With no blobs, it checks whether the namespace
+// has room left at all.
+func (q *quotaTracker) check(i int, repository string, blobs map[string]int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	namespace, usage := q.namespaces[i], q.usage[i]
+
+	if _, ok := usage.repositories[repository]; !ok && namespace.MaxRepositories > 0 && len(usage.repositories) >= namespace.MaxRepositories {
+		return fmt.Errorf("%w: namespace %s already has %d of %d repositories", errQuotaExceeded, namespace.Prefix, len(usage.repositories), namespace.MaxRepositories)
+	}
+	if namespace.MaxBytes <= 0 {
+		return nil
+	}
+	if blobs == nil {
+		if usage.bytes >= namespace.MaxBytes {
+			return fmt.Errorf("%w: namespace %s uses %d of %d bytes", errQuotaExceeded, namespace.Prefix, usage.bytes, namespace.MaxBytes)
+		}
+		return nil
+	}
+	var added int64
+	for digest, size := range blobs {
+		if _, ok := usage.blobs[digest]; !ok {
+			added += size
+		}
+	}
+	if usage.bytes+added > namespace.MaxBytes {
+		return fmt.Errorf("%w: namespace %s uses %d of %d bytes and the push adds %d", errQuotaExceeded, namespace.Prefix, usage.bytes, namespace.MaxBytes, added)
+	}
+	return nil
+}
+
+func (q *quotaTracker) record(i int, repository string, blobs map[string]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage[i].add(repository, blobs)
+	if q.pending != nil {
+		q.pending = append(q.pending, quotaRecord{namespace: i, repository: repository, blobs: blobs})
+	}
+}
+
+// beginReconcile waits for other reconciles and starts keeping the pushes
+// recorded from now on.
+func (q *quotaTracker) beginReconcile() {
+	q.reconciling.Lock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = []quotaRecord{}
+}
+
+// endReconcile replaces the usage with the recounted usage, adding the
+// pushes recorded since the reconcile began. With nil usage, the current
+// usage is kept.
+func (q *quotaTracker) endReconcile(usage []*namespaceUsage) {
+	defer q.reconciling.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if usage != nil {
+		for _, record := range q.pending {
+			usage[record.namespace].add(record.repository, record.blobs)
+		}
+		q.usage = usage
+	}
+	q.pending = nil
+}
+
+func (q *quotaTracker) report() []quotaReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reports := make([]quotaReport, 0, len(q.namespaces))
+	for i, namespace := range q.namespaces {
+		reports = append(reports, quotaReport{
+			Prefix:          namespace.Prefix,
+			Bytes:           q.usage[i].bytes,
+			MaxBytes:        namespace.MaxBytes,
+			Repositories:    len(q.usage[i].repositories),
+			MaxRepositories: namespace.MaxRepositories,
+		})
+	}
+	return reports
+}
+
+// manifestBlobs lists the content a manifest stores: the manifest itself,
+// and the config and layers of an image, with the sizes the manifest
+// declares. The manifests of an index are counted when they are pushed.
+func manifestBlobs(raw []byte) map[string]int64 {
+	blobs := map[string]int64{digestOf(raw): int64(len(raw))}
+	var manifest ociManifest
+	if json.Unmarshal(raw, &manifest) != nil {
+		return blobs
+	}
+	if manifest.Config != nil && manifest.Config.Digest != "" {
+		blobs[manifest.Config.Digest] = manifest.Config.Size
+	}
+	for _, layer := range manifest.Layers {
+		blobs[layer.Digest] = layer.Size
+	}
+	return blobs
+}
+
+// negativeBlob returns a blob the manifest declares a negative size for, or
+// "".
+func negativeBlob(blobs map[string]int64) string {
+	for digest, size := range blobs {
+		if size < 0 {
+			return digest
+		}
+	}
+	return ""
+}
+
+// unknownBlobs lists the blobs of a push the namespace has not counted yet,
+// other than the manifest itself.
+func (q *quotaTracker) unknownBlobs(i int, manifestDigest string, blobs map[string]int64) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[i].unknownBlobs(manifestDigest, blobs)
+}
+
+func (u *namespaceUsage) unknownBlobs(manifestDigest string, blobs map[string]int64) []string {
+	var unknown []string
+	for digest := range blobs {
+		if _, ok := u.blobs[digest]; !ok && digest != manifestDigest {
+			unknown = append(unknown, digest)
+		}
+	}
+	return unknown
+}
+
+// blobSizes replaces the declared sizes of the digests with their sizes in
+// Zot, so clients cannot shrink their usage by declaring small sizes. Blobs
+// Zot does not have keep their declared size, as Zot refuses manifests that
+// refer to them, but never less than zero.
+func (g *gateway) blobSizes(ctx context.Context, header http.Header, repository string, blobs map[string]int64, digests []string) error {
+	for _, digest := range digests {
+		size, exists, err := g.headBlob(ctx, header, repository, digest)
+		if err != nil {
+			return fmt.Errorf("failed to look up blob %s in %s: %w", digest, repository, err)
+		}
+		if exists {
+			blobs[digest] = size
+		}
+		blobs[digest] = max(blobs[digest], 0)
+	}
+	return nil
+}
+
+// quotaMiddleware rejects new upload sessions and manifest pushes that
+// would exceed a namespace quota, and counts the pushes that succeed.
+func quotaMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || len(g.quotas.namespaces) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			newUpload := r.Method == http.MethodPost && t.Kind == kindUploads && t.Reference == ""
+			manifestPush := r.Method == http.MethodPut && t.Kind == kindManifests
+			i := g.quotas.namespace(t.Repository)
+			if i < 0 || (!newUpload && !manifestPush) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var blobs map[string]int64
+			if manifestPush {
+				manifest, err := readManifest(r)
+				if err != nil {
+					writeManifestReadError(w, err)
+					return
+				}
+				blobs = manifestBlobs(manifest)
+				if digest := negativeBlob(blobs); digest != "" {
+					writeRegistryError(w, http.StatusBadRequest, errCodeManifestInvalid, "manifest declares a negative blob size", map[string]string{"digest": digest})
+					return
+				}
+				if err := g.blobSizes(r.Context(), r.Header, t.Repository, blobs, g.quotas.unknownBlobs(i, digestOf(manifest), blobs)); err != nil {
+					slog.Error("Failed to look up blob sizes for quota", "repository", t.Repository, "error", err.Error())
+					writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not check the namespace quota", nil)
+					return
+				}
+			}
+
+			if err := g.quotas.check(i, t.Repository, blobs); err != nil {
+				slog.Info("Push rejected by quota", "identity", identityName(IdentityFromContext(r.Context())), "repository", t.Repository, "error", err.Error())
+				writeRegistryError(w, http.StatusForbidden, errCodeDenied, err.Error(), map[string]string{
+					"repository": t.Repository,
+					"namespace":  g.quotas.namespaces[i].Prefix,
+				})
+				return
+			}
+
+			if !manifestPush {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			if ww.Status() == http.StatusCreated {
+				g.quotas.record(i, t.Repository, blobs)
+			}
+		})
+	}
+}
+
+// serviceHeader carries the credentials the proxy uses for its own
+// background requests to Zot.
+func (g *gateway) serviceHeader() http.Header {
+	header := http.Header{}
+	if g.cfg.ZotUsername != "" || g.cfg.ZotPassword != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(g.cfg.ZotUsername+":"+g.cfg.ZotPassword)))
+	}
+	return header
+}
+
+// listAll follows the pagination of a catalog or tags list and returns the
+// values of the named field.
+func (g *gateway) listAll(ctx context.Context, header http.Header, path, field string) ([]string, error) {
+	var all []string
+	next := path + "?n=" + strconv.Itoa(listPageSize)
+	for next != "" {
+		resp, err := g.upstreamRequest(ctx, http.MethodGet, next, header, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		status, link := resp.StatusCode, resp.Header.Get("Link")
+		resp.Body.Close()
+		if status == http.StatusNotFound {
+			return all, nil
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("%w: %d", errUnexpectedUpstreamStatus, status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		var values []string
+		if raw, ok := page[field]; ok {
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+			}
+		}
+		all = append(all, values...)
+		next = g.nextLink(link)
+	}
+	return all, nil
+}
+
+// nextLink extracts the path of a `rel="next"` Link header.
+func (g *gateway) nextLink(link string) string {
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	u, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimPrefix(u.Path, strings.TrimSuffix(g.upstream.Path, "/"))
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// reconcileQuotas recounts the usage of every namespace from the
+// repositories and tags in Zot.
+func (g *gateway) reconcileQuotas(ctx context.Context) error {
+	g.quotas.beginReconcile()
+	var usage []*namespaceUsage
+	defer func() { g.quotas.endReconcile(usage) }()
+
+	header := g.serviceHeader()
+	repositories, err := g.listAll(ctx, header, "/v2/_catalog", "repositories")
+	if err != nil {
+		return fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	counted := make([]*namespaceUsage, len(g.quotas.namespaces))
+	for i := range counted {
+		counted[i] = newNamespaceUsage()
+	}
+	manifestHeader := header.Clone()
+	manifestHeader.Set("Accept", manifestAccept)
+
+	for _, repository := range repositories {
+		i := g.quotas.namespace(repository)
+		if i < 0 {
+			continue
+		}
+		counted[i].repositories[repository] = struct{}{}
+		tags, err := g.listAll(ctx, header, "/v2/"+repository+"/tags/list", "tags")
+		if err != nil {
+			return fmt.Errorf("failed to list tags of %s: %w", repository, err)
+		}
+		seen := make(map[string]bool)
+		for _, tag := range tags {
+			if err := g.countManifest(ctx, manifestHeader, repository, tag, counted[i], seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	usage = counted
+	slog.Debug("Reconciled quota usage", "repositories", len(repositories))
+	return nil
+}
+
+func (g *gateway) countManifest(ctx context.Context, header http.Header, repository, reference string, usage *namespaceUsage, seen map[string]bool) error {
+	body, err := g.fetchContent(ctx, "/v2/"+repository+"/manifests/"+reference, header, maxManifestSize)
+	if errors.Is(err, errUpstreamNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest %s:%s: %w", repository, reference, err)
+	}
+	digest := digestOf(body)
+	if seen[digest] {
+		return nil
+	}
+	seen[digest] = true
+	blobs := manifestBlobs(body)
+	if err := g.blobSizes(ctx, header, repository, blobs, usage.unknownBlobs(digest, blobs)); err != nil {
+		return err
+	}
+	usage.add(repository, blobs)
+
+	var manifest ociManifest
+	if json.Unmarshal(body, &manifest) != nil {
+		return nil
+	}
+	for _, child := range manifest.Manifests {
+		if err := g.countManifest(ctx, header, repository, child.Digest, usage, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runQuotaReconciler reconciles quota usage at startup and then
+// periodically until the context ends.
+func (g *gateway) runQuotaReconciler(ctx context.Context) {
+	if len(g.quotas.namespaces) == 0 {
+		return
+	}
+	reconcile := func() {
+		if err := g.reconcileQuotas(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Failed to reconcile quota usage", "error", err.Error())
+		}
+	}
+	reconcile()
+	if g.cfg.Quotas.ReconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(g.cfg.Quotas.ReconcileInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconcile()
+		}
+	}
+}
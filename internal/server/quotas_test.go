@@ -0,0 +1,192 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+type quotaReport struct {
+	Prefix       string `json:"prefix"`
+	Bytes        int64  `json:"bytes"`
+	Repositories int    `json:"repositories"`
+}
+
+func quotaTestRouter(t *testing.T, backendURL string) http.Handler {
+	t.Helper()
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backendURL,
+		Admin:    config.Admin{Token: "admin-secret"},
+		Quotas: config.Quotas{
+			Namespaces: []config.QuotaNamespace{{Prefix: "team-a", MaxBytes: 3000, MaxRepositories: 2}},
+		},
+	}
+	return newTestRouter(t, cfg)
+}
+
+func imageWithLayers(sizes ...string) string {
+	layers := []string{}
+	for i, size := range sizes {
+		layers = append(layers, `{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:`+strings.Repeat(string(rune('a'+i)), 64)+`","size":`+size+`}`)
+	}
+	return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[` + strings.Join(layers, ",") + `]}`
+}
+
+func quotaReports(t *testing.T, rec *httptest.ResponseRecorder) []quotaReport {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from admin API, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var reports []quotaReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("failed to decode quota report: %v", err)
+	}
+	return reports
+}
+
+func TestQuotas_Enforced(t *testing.T) {
+	t.Parallel()
+
+	_, backend := newFakeRegistry(t)
+	router := quotaTestRouter(t, backend.URL)
+
+	steps := []struct {
+		method, path, body string
+		wantCode           int
+	}{
+		{http.MethodPut, "/v2/team-a/one/manifests/1.0", imageWithLayers("1000"), http.StatusCreated},
+		// The first layer is shared, so only the second counts.
+		{http.MethodPut, "/v2/team-a/two/manifests/1.0", imageWithLayers("1000", "500"), http.StatusCreated},
+		{http.MethodPost, "/v2/team-a/three/blobs/uploads/", "", http.StatusForbidden},
+		{http.MethodPut, "/v2/team-a/one/manifests/2.0", imageWithLayers("1000", "500", "2000"), http.StatusForbidden},
+		{http.MethodPost, "/v2/team-a/one/blobs/uploads/", "", http.StatusOK},
+		{http.MethodPost, "/v2/team-b/app/blobs/uploads/", "", http.StatusOK},
+	}
+	for _, step := range steps {
+		rec := serve(router, step.method, step.path, withManifest(step.body))
+		if rec.Code != step.wantCode {
+			t.Fatalf("%s %s: expected %d, got %d: %s", step.method, step.path, step.wantCode, rec.Code, rec.Body.String())
+		}
+		if rec.Code == http.StatusForbidden && !strings.Contains(rec.Body.String(), "quota exceeded") {
+			t.Errorf("%s %s: expected quota error, got %s", step.method, step.path, rec.Body.String())
+		}
+	}
+
+	reports := quotaReports(t, serve(router, http.MethodGet, "/_proxy/admin/quotas", asAdmin()))
+	if len(reports) != 1 || reports[0].Repositories != 2 || reports[0].Bytes < 1500 || reports[0].Bytes > 3000 {
+		t.Errorf("unexpected usage: %+v", reports)
+	}
+}
+
+func TestQuotas_Reconcile(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	first := imageWithLayers("1000")
+	second := imageWithLayers("1000", "500")
+	registry.putManifest("team-a/one", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(first))
+	registry.putManifest("team-a/two", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(second))
+	registry.putManifest("team-b/app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("9999")))
+
+	router := quotaTestRouter(t, backend.URL)
+	reports := quotaReports(t, serve(router, http.MethodPost, "/_proxy/admin/quotas/reconcile", asAdmin()))
+
+	wantBytes := int64(1000 + 500 + len(first) + len(second))
+	if len(reports) != 1 || reports[0].Repositories != 2 || reports[0].Bytes != wantBytes {
+		t.Errorf("expected 2 repositories and %d bytes, got %+v", wantBytes, reports)
+	}
+
+	if rec := serve(router, http.MethodPost, "/v2/team-a/three/blobs/uploads/"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected reconciled repository count to be enforced, got %d", rec.Code)
+	}
+}
+
+func TestQuotas_PushDuringReconcile(t *testing.T) {
+	t.Parallel()
+
+	registry, _ := newFakeRegistry(t)
+	var (
+		router     http.Handler
+		pushes     sync.WaitGroup
+		catalogued sync.Once
+	)
+	pushed := []string{imageWithLayers("100"), imageWithLayers("100", "200"), imageWithLayers("100", "200", "300")}
+	// Zot lists the catalog before the pushes land, so only the proxy's
+	// own records can account for them.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			registry.serveHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		registry.serveHTTP(rec, r)
+		catalogued.Do(func() {
+			for i, body := range pushed {
+				pushes.Add(1)
+				go func() {
+					defer pushes.Done()
+					serve(router, http.MethodPut, "/v2/team-a/new/manifests/"+strconv.Itoa(i), withManifest(body))
+				}()
+			}
+			pushes.Wait()
+		})
+		for key, values := range rec.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(backend.Close)
+
+	existing := imageWithLayers("1000")
+	registry.putManifest("team-a/one", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(existing))
+	router = quotaTestRouter(t, backend.URL)
+
+	reports := quotaReports(t, serve(router, http.MethodPost, "/_proxy/admin/quotas/reconcile", asAdmin()))
+	// The first layer of every image is the existing image's layer.
+	wantBytes := int64(1000 + 200 + 300 + len(existing))
+	for _, body := range pushed {
+		wantBytes += int64(len(body))
+	}
+	if len(reports) != 1 || reports[0].Repositories != 2 || reports[0].Bytes != wantBytes {
+		t.Errorf("expected 2 repositories and %d bytes, got %+v", wantBytes, reports)
+	}
+}
+
+func TestQuotas_DeclaredSizes(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	router := quotaTestRouter(t, backend.URL)
+	layer := func(digest, size string) string {
+		return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[` +
+			`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"` + digest + `","size":` + size + `}]}`
+	}
+
+	rec := serve(router, http.MethodPut, "/v2/team-a/app/manifests/negative", withManifest(layer("sha256:"+strings.Repeat("a", 64), "-4000")))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"MANIFEST_INVALID"`) {
+		t.Fatalf("expected a negative layer size to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	large := registry.putBlob([]byte(strings.Repeat("x", 2500)))
+	if rec := serve(router, http.MethodPut, "/v2/team-a/app/manifests/1.0", withManifest(layer(large, "1"))); rec.Code != http.StatusCreated {
+		t.Fatalf("expected push to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	reports := quotaReports(t, serve(router, http.MethodGet, "/_proxy/admin/quotas", asAdmin()))
+	if len(reports) != 1 || reports[0].Bytes < 2500 {
+		t.Fatalf("expected the blob's real size to be charged, got %+v", reports)
+	}
+
+	other := registry.putBlob([]byte(strings.Repeat("y", 1000)))
+	if rec := serve(router, http.MethodPut, "/v2/team-a/app/manifests/2.0", withManifest(layer(other, "1"))); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the real size to exceed the quota, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// referrersIndex is the image index the referrers API answers with, and
+// the referrers tag schema stores. Unlike ociManifest, it always lists its
+// manifests, even when there are none.
+type referrersIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func emptyReferrersIndex() referrersIndex {
+	return referrersIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{}}
+}
+
+// referrersTag is the tag the referrers tag schema keeps the referrers of a
+// digest under, like sha256-<hex>.
+func referrersTag(digest string) string {
+	tag := strings.Replace(digest, ":", "-", 1)
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return tag
+}
+
+// referrerDescriptor describes a pushed manifest as an entry of its
+// subject's referrers. Manifests without an artifact type are listed under
+// their config's media type.
+func referrerDescriptor(manifest ociManifest, mediaType string, body []byte) ociDescriptor {
+	artifactType := manifest.ArtifactType
+	if artifactType == "" && manifest.Config != nil {
+		artifactType = manifest.Config.MediaType
+	}
+	return ociDescriptor{
+		MediaType:    mediaType,
+		Digest:       digestOf(body),
+		Size:         int64(len(body)),
+		ArtifactType: artifactType,
+		Annotations:  manifest.Annotations,
+	}
+}
+
+// fallbackReferrers reads the referrers of a digest from the tag schema.
+// A missing tag means there are no referrers.
+func (g *gateway) fallbackReferrers(ctx context.Context, header http.Header, repository, digest string) (referrersIndex, bool, error) {
+	index := emptyReferrersIndex()
+	body, _, err := g.getManifest(ctx, header, repository, referrersTag(digest))
+	if errors.Is(err, errUpstreamNotFound) {
+		return index, false, nil
+	}
+	if err != nil {
+		return index, false, err
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return index, false, fmt.Errorf("failed to decode referrers index %s:%s: %w", repository, referrersTag(digest), err)
+	}
+	if index.Manifests == nil {
+		index.Manifests = []ociDescriptor{}
+	}
+	return index, true, nil
+}
+
+// updateReferrers edits the referrers tag of a digest with the proxy's own
+// credentials. The tag is removed when no referrers are left.
+func (g *gateway) updateReferrers(ctx context.Context, repository, subject string, edit func([]ociDescriptor) ([]ociDescriptor, bool)) error {
+	g.referrersLock.Lock()
+	defer g.referrersLock.Unlock()
+
+	header := g.serviceHeader()
+	index, exists, err := g.fallbackReferrers(ctx, header, repository, subject)
+	if err != nil {
+		return err
+	}
+	manifests, changed := edit(index.Manifests)
+	switch {
+	case !changed:
+		return nil
+	case len(manifests) == 0 && exists:
+		return g.deleteManifest(ctx, header, repository, referrersTag(subject))
+	case len(manifests) == 0:
+		return nil
+	}
+	index.Manifests = manifests
+	body, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode referrers index: %w", err)
+	}
+	return g.putManifest(ctx, header, repository, referrersTag(subject), mediaTypeOCIIndex, body)
+}
+
+func withoutDigest(manifests []ociDescriptor, digest string) ([]ociDescriptor, bool) {
+	kept := make([]ociDescriptor, 0, len(manifests))
+	for _, descriptor := range manifests {
+		if descriptor.Digest != digest {
+			kept = append(kept, descriptor)
+		}
+	}
+	return kept, len(kept) != len(manifests)
+}
+
+// serveReferrers answers the referrers API from the tag schema when Zot
+// does not know the endpoint.
+func (g *gateway) serveReferrers(w http.ResponseWriter, r *http.Request, t target, next http.Handler) {
+	buffered := newBufferedResponse()
+	next.ServeHTTP(buffered, r)
+	if buffered.status != http.StatusNotFound {
+		buffered.replay(w, r.Method)
+		return
+	}
+
+	index, _, err := g.fallbackReferrers(r.Context(), r.Header, t.Repository, t.Reference)
+	if err != nil {
+		slog.Error("Failed to read referrers from the tag schema", "repository", t.Repository, "digest", t.Reference, "error", err.Error())
+		buffered.replay(w, r.Method)
+		return
+	}
+	if artifactType := r.URL.Query().Get("artifactType"); artifactType != "" {
+		filtered := make([]ociDescriptor, 0, len(index.Manifests))
+		for _, descriptor := range index.Manifests {
+			if descriptor.ArtifactType == artifactType {
+				filtered = append(filtered, descriptor)
+			}
+		}
+		index.Manifests = filtered
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	body, err := json.Marshal(index)
+	if err != nil {
+		slog.Error("Failed to encode referrers index", "error", err.Error())
+		writeInternalError(w)
+		return
+	}
+
+	slog.Debug("Serving referrers from the tag schema", "repository", t.Repository, "digest", t.Reference, "referrers", len(index.Manifests))
+	w.Header().Set("Content-Type", mediaTypeOCIIndex)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		slog.Error("Failed to write referrers index", "error", err.Error())
+	}
+}
+
+// pushReferrer adds a pushed manifest with a subject to its subject's
+// referrers tag once Zot stored it.
+func (g *gateway) pushReferrer(w http.ResponseWriter, r *http.Request, t target, next http.Handler) {
+	body, err := readManifest(r)
+	if err != nil {
+		writeManifestReadError(w, err)
+		return
+	}
+	var manifest ociManifest
+	if json.Unmarshal(body, &manifest) != nil || manifest.Subject == nil || manifest.Subject.Digest == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+	if ww.Status() != http.StatusCreated {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = manifest.MediaType
+	}
+	descriptor := referrerDescriptor(manifest, mediaType, body)
+	err = g.updateReferrers(r.Context(), t.Repository, manifest.Subject.Digest, func(manifests []ociDescriptor) ([]ociDescriptor, bool) {
+		manifests, _ = withoutDigest(manifests, descriptor.Digest)
+		return append(manifests, descriptor), true
+	})
+	if err != nil {
+		slog.Error("Failed to add referrer to the tag schema", "repository", t.Repository, "subject", manifest.Subject.Digest, "digest", descriptor.Digest, "error", err.Error())
+		return
+	}
+	slog.Debug("Added referrer to the tag schema", "repository", t.Repository, "subject", manifest.Subject.Digest, "digest", descriptor.Digest)
+}
+
+// deleteReferrer removes a deleted manifest from its subject's referrers
+// tag once Zot deleted it.
+func (g *gateway) deleteReferrer(w http.ResponseWriter, r *http.Request, t target, next http.Handler) {
+	body, _, err := g.getManifest(r.Context(), g.serviceHeader(), t.Repository, t.Reference)
+	var manifest ociManifest
+	if err != nil || json.Unmarshal(body, &manifest) != nil || manifest.Subject == nil || manifest.Subject.Digest == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+	if ww.Status() < http.StatusOK || ww.Status() >= http.StatusMultipleChoices {
+		return
+	}
+
+	err = g.updateReferrers(r.Context(), t.Repository, manifest.Subject.Digest, func(manifests []ociDescriptor) ([]ociDescriptor, bool) {
+		return withoutDigest(manifests, t.Reference)
+	})
+	if err != nil {
+		slog.Error("Failed to remove referrer from the tag schema", "repository", t.Repository, "subject", manifest.Subject.Digest, "digest", t.Reference, "error", err.Error())
+	}
+}
+
+// referrersMiddleware serves the referrers API from the referrers tag
+// schema when Zot answers 404, and keeps the schema's tags in sync with
+// pushes and deletes of manifests with a subject, so clients of either
+// kind see the same artifacts.
+func referrersMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || !g.cfg.ReferrersFallback.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch {
+			case t.Kind == kindReferrers && r.Method == http.MethodGet && isDigest(t.Reference):
+				g.serveReferrers(w, r, t, next)
+			case t.Kind == kindManifests && r.Method == http.MethodPut:
+				g.pushReferrer(w, r, t, next)
+			case t.Kind == kindManifests && r.Method == http.MethodDelete && isDigest(t.Reference):
+				g.deleteReferrer(w, r, t, next)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
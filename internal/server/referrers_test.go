@@ -0,0 +1,198 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+type referrersList struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		MediaType    string            `json:"mediaType"`
+		Digest       string            `json:"digest"`
+		Size         int               `json:"size"`
+		ArtifactType string            `json:"artifactType"`
+		Annotations  map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+func referrersTestRouter(t *testing.T, backendURL string, enabled bool) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel:          config.LogLevelInfo,
+		MyURL:             "http://localhost:8080",
+		ZotURL:            backendURL,
+		ReferrersFallback: config.ReferrersFallback{Enabled: enabled},
+	})
+}
+
+func artifactFor(subject string, size int, artifactType, note string) string {
+	return `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"` + artifactType + `",` +
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},` +
+		`"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + subject + `","size":` + strconv.Itoa(size) + `},` +
+		`"annotations":{"note":"` + note + `"}}`
+}
+
+func decodeReferrers(t *testing.T, rec *httptest.ResponseRecorder) referrersList {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/vnd.oci.image.index.v1+json" {
+		t.Fatalf("expected an image index, got %s", got)
+	}
+	var list referrersList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode referrers: %v", err)
+	}
+	if list.Manifests == nil {
+		t.Fatalf("expected a manifests list, got %s", rec.Body.String())
+	}
+	return list
+}
+
+func TestReferrersFallback(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.referrersAPI = false
+	image := imageWithLayers("10")
+	subject := registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(image))
+	router := referrersTestRouter(t, backend.URL, true)
+
+	if list := decodeReferrers(t, serve(router, http.MethodGet, "/v2/app/referrers/"+subject)); len(list.Manifests) != 0 {
+		t.Fatalf("expected no referrers yet, got %+v", list.Manifests)
+	}
+
+	sbom := artifactFor(subject, len(image), "application/vnd.example.sbom", "sbom")
+	signature := artifactFor(subject, len(image), "application/vnd.example.signature", "signature")
+	for _, artifact := range []string{sbom, signature, sbom} {
+		if rec := serve(router, http.MethodPut, "/v2/app/manifests/"+manifestDigest(artifact), withManifest(artifact)); rec.Code != http.StatusCreated {
+			t.Fatalf("expected the artifact push to succeed, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// Clients of the tag schema see the artifacts under sha256-<hex>.
+	tag := serve(router, http.MethodGet, "/v2/app/manifests/"+strings.Replace(subject, ":", "-", 1))
+	if tag.Code != http.StatusOK || !strings.Contains(tag.Body.String(), manifestDigest(sbom)) || !strings.Contains(tag.Body.String(), manifestDigest(signature)) {
+		t.Fatalf("expected the referrers tag to list both artifacts, got %d: %s", tag.Code, tag.Body.String())
+	}
+
+	list := decodeReferrers(t, serve(router, http.MethodGet, "/v2/app/referrers/"+subject))
+	if len(list.Manifests) != 2 {
+		t.Fatalf("expected two referrers, got %+v", list.Manifests)
+	}
+	for _, descriptor := range list.Manifests {
+		if descriptor.MediaType != "application/vnd.oci.image.manifest.v1+json" || descriptor.ArtifactType == "" || descriptor.Annotations["note"] == "" || descriptor.Size == 0 {
+			t.Errorf("expected a complete descriptor, got %+v", descriptor)
+		}
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/app/referrers/"+subject+"?artifactType=application/vnd.example.sbom")
+	filtered := decodeReferrers(t, rec)
+	if len(filtered.Manifests) != 1 || filtered.Manifests[0].Digest != manifestDigest(sbom) || rec.Header().Get("OCI-Filters-Applied") != "artifactType" {
+		t.Errorf("expected only the SBOM with the filter header, got %+v", filtered.Manifests)
+	}
+
+	for _, artifact := range []string{sbom, signature} {
+		if rec := serve(router, http.MethodDelete, "/v2/app/manifests/"+manifestDigest(artifact)); rec.Code != http.StatusAccepted {
+			t.Fatalf("expected the artifact delete to succeed, got %d", rec.Code)
+		}
+	}
+	if list := decodeReferrers(t, serve(router, http.MethodGet, "/v2/app/referrers/"+subject)); len(list.Manifests) != 0 {
+		t.Errorf("expected deleted artifacts to be gone, got %+v", list.Manifests)
+	}
+	if rec := serve(router, http.MethodGet, "/v2/app/manifests/"+strings.Replace(subject, ":", "-", 1)); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the empty referrers tag to be removed, got %d", rec.Code)
+	}
+}
+
+func TestReferrersFallback_NativeAPI(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	image := imageWithLayers("10")
+	subject := registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(image))
+	artifact := artifactFor(subject, len(image), "application/vnd.example.sbom", "sbom")
+	registry.putManifest("app", "", "application/vnd.oci.image.manifest.v1+json", []byte(artifact))
+	router := referrersTestRouter(t, backend.URL, true)
+
+	list := decodeReferrers(t, serve(router, http.MethodGet, "/v2/app/referrers/"+subject))
+	if len(list.Manifests) != 1 || list.Manifests[0].Digest != manifestDigest(artifact) {
+		t.Errorf("expected Zot's own answer, got %+v", list.Manifests)
+	}
+	if registry.requested(http.MethodGet, "/v2/app/manifests/sha256-") != 0 {
+		t.Error("expected the tag schema not to be read when Zot answers")
+	}
+}
+
+func TestReferrersFallback_Disabled(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.referrersAPI = false
+	image := imageWithLayers("10")
+	subject := registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(image))
+	router := referrersTestRouter(t, backend.URL, false)
+
+	artifact := artifactFor(subject, len(image), "application/vnd.example.sbom", "sbom")
+	serve(router, http.MethodPut, "/v2/app/manifests/"+manifestDigest(artifact), withManifest(artifact))
+	if rec := serve(router, http.MethodGet, "/v2/app/referrers/"+subject); rec.Code != http.StatusNotFound {
+		t.Errorf("expected Zot's 404, got %d", rec.Code)
+	}
+	if registry.requested(http.MethodPut, "/v2/app/manifests/sha256-") != 0 {
+		t.Error("expected no referrers tag to be pushed")
+	}
+}
+
+func TestReferrersFallback_Signatures(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.referrersAPI = false
+	key := generateSigningKey(t)
+	signed := testImage(registry, "prod/app", "1.0")
+	cosignSign(t, registry, key, "prod/app", signed)
+	unsigned := registry.putManifest("prod/app", "2.0", ociManifestType,
+		[]byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+`","config":`+imageConfig+`,"layers":[`+imageLayer+`],"annotations":{"version":"2.0"}}`))
+
+	router := newTestRouter(t, &config.Config{
+		LogLevel:          config.LogLevelInfo,
+		MyURL:             "http://localhost:8080",
+		ZotURL:            backend.URL,
+		ReferrersFallback: config.ReferrersFallback{Enabled: true},
+		Signatures: config.Signatures{
+			CacheTTL: 300,
+			Rules:    []config.SignatureRule{{Repositories: []string{"prod/**"}, Keys: []string{writePublicKey(t, key)}}},
+		},
+	})
+
+	for _, subject := range []string{signed, unsigned} {
+		artifact := artifactFor(subject, 2, "application/vnd.example.sbom", "sbom")
+		if rec := serve(router, http.MethodPut, "/v2/prod/app/manifests/"+manifestDigest(artifact), withManifest(artifact)); rec.Code != http.StatusCreated {
+			t.Fatalf("expected the artifact push to succeed, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	sbom := manifestDigest(artifactFor(signed, 2, "application/vnd.example.sbom", "sbom"))
+	tag := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+strings.Replace(signed, ":", "-", 1))
+	if tag.Code != http.StatusOK || !strings.Contains(tag.Body.String(), sbom) {
+		t.Fatalf("expected the referrers tag of a signed image to be served, got %d: %s", tag.Code, tag.Body.String())
+	}
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+sbom); rec.Code != http.StatusOK {
+		t.Errorf("expected the artifact of a signed image to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if list := decodeReferrers(t, serve(router, http.MethodGet, "/v2/prod/app/referrers/"+signed)); len(list.Manifests) != 1 || list.Manifests[0].Digest != sbom {
+		t.Errorf("expected the referrers API to list the same artifact, got %+v", list.Manifests)
+	}
+
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+strings.Replace(unsigned, ":", "-", 1)); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the referrers tag of an unsigned image to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,254 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is a minimal in-memory distribution API for tests that need
+// the proxy to look at manifests, blobs, and referrers.
+type fakeRegistry struct {
+	mu           sync.Mutex
+	manifests    map[string][]byte
+	mediaTypes   map[string]string
+	blobs        map[string][]byte
+	referrersAPI bool
+	// pageSize caps the pages of catalog and tags lists, when set.
+	pageSize int
+	requests []string
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *httptest.Server) {
+	t.Helper()
+	f := &fakeRegistry{
+		manifests:    make(map[string][]byte),
+		mediaTypes:   make(map[string]string),
+		blobs:        make(map[string][]byte),
+		referrersAPI: true,
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// putManifest stores a manifest under its digest and, if set, a tag.
+func (f *fakeRegistry) putManifest(repository, tag, mediaType string, body []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	digest := manifestDigest(string(body))
+	for _, ref := range []string{digest, tag} {
+		if ref == "" {
+			continue
+		}
+		f.manifests[repository+"@"+ref] = body
+		f.mediaTypes[repository+"@"+ref] = mediaType
+	}
+	return digest
+}
+
+func (f *fakeRegistry) putBlob(content []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	digest := manifestDigest(string(content))
+	f.blobs[digest] = content
+	return digest
+}
+
+// requested returns how many requests matched the method and path prefix.
+func (f *fakeRegistry) requested(method, pathPrefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, method+" "+pathPrefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeRegistry) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("X-Backend-Called", "true")
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if strings.HasSuffix(rest, "/blobs/uploads/") && r.Method == http.MethodPost && r.URL.Query().Has("mount") {
+		// Blobs are shared by every repository, so a mount only needs the
+		// blob to exist.
+		if _, ok := f.blobs[r.URL.Query().Get("mount")]; !ok {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if rest == "_catalog" {
+		_ = json.NewEncoder(w).Encode(map[string]any{"repositories": f.page(w, r, f.list(""))})
+		return
+	}
+	segs := strings.Split(rest, "/")
+	if len(segs) < 3 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	repository := strings.Join(segs[:len(segs)-2], "/")
+	kind, ref := segs[len(segs)-2], segs[len(segs)-1]
+
+	switch {
+	case kind == "manifests" && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		digest := manifestDigest(string(body))
+		for _, key := range []string{repository + "@" + digest, repository + "@" + ref} {
+			f.manifests[key] = body
+			f.mediaTypes[key] = r.Header.Get("Content-Type")
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests" && r.Method == http.MethodDelete:
+		if !f.deleteManifest(repository, ref) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "manifests":
+		body, ok := f.manifests[repository+"@"+ref]
+		if accept := r.Header.Get("Accept"); ok && accept != "" && accept != "*/*" && !strings.Contains(accept, f.mediaTypes[repository+"@"+ref]) {
+			// Like Zot, only serve manifests in a media type the client
+			// accepts.
+			ok = false
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.mediaTypes[repository+"@"+ref])
+		w.Header().Set("Docker-Content-Digest", manifestDigest(string(body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	case kind == "blobs":
+		body, ok := f.blobs[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	case kind == "tags" && ref == "list":
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": repository, "tags": f.page(w, r, f.list(repository))})
+	case kind == "referrers":
+		if !f.referrersAPI {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		_ = json.NewEncoder(w).Encode(f.referrers(repository, ref))
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// deleteManifest removes a tag, or a digest and every tag pointing to it.
+func (f *fakeRegistry) deleteManifest(repository, ref string) bool {
+	body, ok := f.manifests[repository+"@"+ref]
+	if !ok {
+		return false
+	}
+	if !strings.HasPrefix(ref, "sha256:") {
+		delete(f.manifests, repository+"@"+ref)
+		return true
+	}
+	for key, other := range f.manifests {
+		if repo, _, _ := strings.Cut(key, "@"); repo == repository && string(other) == string(body) {
+			delete(f.manifests, key)
+		}
+	}
+	return true
+}
+
+// list returns the repositories, or the tags of a repository, in order.
+func (f *fakeRegistry) list(repository string) []string {
+	seen := map[string]bool{}
+	values := []string{}
+	for key := range f.manifests {
+		repo, ref, _ := strings.Cut(key, "@")
+		value := repo
+		if repository != "" {
+			if repo != repository || strings.HasPrefix(ref, "sha256:") {
+				continue
+			}
+			value = ref
+		}
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	slices.Sort(values)
+	return values
+}
+
+// page applies the n and last parameters of a listing, and links the next
+// page like Zot does.
+func (f *fakeRegistry) page(w http.ResponseWriter, r *http.Request, values []string) []string {
+	query := r.URL.Query()
+	if last := query.Get("last"); last != "" {
+		i, found := slices.BinarySearch(values, last)
+		if found {
+			i++
+		}
+		values = values[i:]
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if f.pageSize > 0 && (err != nil || n > f.pageSize) {
+		n, err = f.pageSize, nil
+	}
+	if err != nil || n <= 0 || n >= len(values) {
+		return values
+	}
+	values = values[:n]
+	w.Header().Set("Link", "<"+r.URL.Path+"?n="+strconv.Itoa(n)+"&last="+url.QueryEscape(values[n-1])+`>; rel="next"`)
+	return values
+}
+
+func (f *fakeRegistry) referrers(repository, digest string) map[string]any {
+	descriptors := []map[string]any{}
+	seen := map[string]bool{}
+	for key, body := range f.manifests {
+		repo, ref, _ := strings.Cut(key, "@")
+		if repo != repository || !strings.HasPrefix(ref, "sha256:") || seen[ref] {
+			continue
+		}
+		var manifest struct {
+			ArtifactType string `json:"artifactType"`
+			Subject      *struct {
+				Digest string `json:"digest"`
+			} `json:"subject"`
+		}
+		if json.Unmarshal(body, &manifest) != nil || manifest.Subject == nil || manifest.Subject.Digest != digest {
+			continue
+		}
+		seen[ref] = true
+		descriptors = append(descriptors, map[string]any{
+			"mediaType":    f.mediaTypes[key],
+			"digest":       ref,
+			"size":         len(body),
+			"artifactType": manifest.ArtifactType,
+		})
+	}
+	return map[string]any{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": descriptors}
+}
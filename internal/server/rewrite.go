@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rewrittenManifest is a manifest the proxy made from one Zot has, like a
+// Docker schema2 conversion or a platform-filtered index.
+type rewrittenManifest struct {
+	body      []byte
+	mediaType string
+	digest    string
+}
+
+// rewriteSource is the manifest a rewritten digest was made from, and the
+// rule that made it.
+type rewriteSource struct {
+	digest string
+	rule   int
+}
+
+// manifestRewrites remembers rewritten manifests so their digests can be
+// pulled through the source manifest.
+type manifestRewrites struct {
+	// rewritten holds rewritten manifests by repository, source digest, and
+	// rule.
+	rewritten *ttlCache[rewrittenManifest]
+	// sources maps repository and rewritten digest to the source. It is not
+	// bounded like the other caches, so a digest handed to a client stays
+	// pullable for the whole TTL. It only grows with the manifests in Zot.
+	sources *ttlCache[rewriteSource]
+}
+
+func newManifestRewrites(ttl time.Duration) *manifestRewrites {
+	return &manifestRewrites{
+		rewritten: newTTLCache[rewrittenManifest](ttl),
+		sources:   newUnboundedTTLCache[rewriteSource](ttl),
+	}
+}
+
+func rewriteKey(repository, source string, rule int) string {
+	return repository + "@" + source + "#" + strconv.Itoa(rule)
+}
+
+// get returns the manifest rewritten from the source with the rule.
+func (m *manifestRewrites) get(repository, source string, rule int) (rewrittenManifest, bool) {
+	return m.rewritten.get(rewriteKey(repository, source, rule))
+}
+
+// set remembers a rewritten manifest and the source it was made from.
+func (m *manifestRewrites) set(repository string, source rewriteSource, result rewrittenManifest) {
+	m.rewritten.set(rewriteKey(repository, source.digest, source.rule), result)
+	m.sources.set(repository+"@"+result.digest, source)
+}
+
+// manifestRewrite describes how a middleware rewrites the manifests it
+// serves.
+type manifestRewrite struct {
+	rewrites *manifestRewrites
+	// accept replaces the Accept header of the request to Zot when set.
+	accept string
+	// mediaTypes are the manifest types that are rewritten.
+	mediaTypes []string
+	// rewrite rewrites a manifest with a rule, and returns false to serve it
+	// as is.
+	rewrite func(r *http.Request, repository string, rule int, body []byte, mediaType string) (rewrittenManifest, bool)
+}
+
+// serve serves a GET or HEAD of a manifest rewritten with the rule. Digests
+// are only rewritten when they name a rewritten manifest, which is pulled
+// through its source manifest with the rule that made it, so the rest of
+// the gateway checks the manifest Zot has. Tags are rewritten with the rule,
+// unless it is negative.
+func (m manifestRewrite) serve(w http.ResponseWriter, r *http.Request, next http.Handler, t target, rule int) {
+	method := r.Method
+	r = r.Clone(r.Context())
+	if isDigest(t.Reference) {
+		source, ok := m.rewrites.sources.get(t.Repository + "@" + t.Reference)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule = source.rule
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, t.Reference) + source.digest
+		r.URL.RawPath = ""
+	} else if rule < 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	r.Method = http.MethodGet
+	if m.accept != "" {
+		r.Header.Set("Accept", m.accept)
+	}
+
+	buffered := newBufferedResponse()
+	next.ServeHTTP(buffered, r)
+	mediaType, _, _ := mime.ParseMediaType(buffered.header.Get("Content-Type"))
+	if buffered.status != http.StatusOK || !slices.Contains(m.mediaTypes, mediaType) {
+		buffered.replay(w, method)
+		return
+	}
+
+	result, ok := m.rewrite(r, t.Repository, rule, buffered.body.Bytes(), mediaType)
+	if !ok {
+		buffered.replay(w, method)
+		return
+	}
+
+	w.Header().Set("Content-Type", result.mediaType)
+	w.Header().Set("Docker-Content-Digest", result.digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(result.body)))
+	w.WriteHeader(http.StatusOK)
+	if method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(result.body); err != nil {
+		slog.Error("Failed to write rewritten manifest", "error", err.Error())
+	}
+}
+
+// bufferedResponse holds a response so it can be inspected before it is
+// sent.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	n, err := b.body.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("failed to buffer response: %w", err)
+	}
+	return n, nil
+}
+
+// replay sends the buffered response, without the body for HEAD requests.
+func (b *bufferedResponse) replay(w http.ResponseWriter, method string) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	if method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(b.body.Bytes()); err != nil {
+		slog.Error("Failed to write response", "error", err.Error())
+	}
+}
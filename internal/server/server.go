@@ -1,14 +1,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/policy"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -18,15 +21,72 @@ type contextKey uint8
 
 const (
 	Config_ContextKey contextKey = iota
+	Identity_ContextKey
+	ClientProfile_ContextKey
+	RepositoryMapping_ContextKey
+	ClientRule_ContextKey
 )
 
-func NewRouter(cfg *config.Config) (*chi.Mux, error) {
+// gateway holds the compiled configuration shared by the proxy middleware.
+type gateway struct {
+	cfg      *config.Config
+	clients  []clientMatcher
+	auth     *authChain
+	access   accessRules
+	policies *policy.Engine
+	modes    *modes
+	upstream *url.URL
+	client   *http.Client
+
+	vulnerabilities *vulnerabilityGate
+	signatures      *signatureVerifier
+	quotas          *quotaTracker
+	networks        []networkRule
+	locations       *locationRewriter
+	compat          *manifestRewrites
+	platforms       *platformFilter
+	aliases         []repositoryAlias
+	// referrersLock serializes updates of referrers tags.
+	referrersLock sync.Mutex
+}
+
+// Router is the proxy's HTTP handler. The embedded mux holds the proxied
+// routes, behind the gateway middleware.
+type Router struct {
+	*chi.Mux
+	root http.Handler
+	g    *gateway
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.root.ServeHTTP(w, r)
+}
+
+// Reload applies the parts of a new config that can change without a
+// restart. Currently that is the read-only and maintenance modes.
+func (rt *Router) Reload(cfg *config.Config) {
+	rt.g.modes.set(cfg.ReadOnly, cfg.Maintenance)
+	slog.Info("Reloaded config", "read-only", cfg.ReadOnly.Enabled, "maintenance", cfg.Maintenance.Enabled)
+}
+
+// Start runs the router's background tasks until the context ends.
+func (rt *Router) Start(ctx context.Context) {
+	go rt.g.runQuotaReconciler(ctx)
+	go rt.g.runTrashPurger(ctx)
+}
+
+func NewRouter(cfg *config.Config) (*Router, error) {
+	trustedProxies, err := parseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIPMiddleware(trustedProxies))
 	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(1 * time.Hour))
+	r.Use(recovererMiddleware)
+	r.Use(timeoutMiddleware(1 * time.Hour))
 	if len(cfg.CORSAllowedOrigins) > 0 {
 		r.Use(cors.Handler(cors.Options{
 			AllowedOrigins: cfg.CORSAllowedOrigins,
@@ -35,23 +95,110 @@ func NewRouter(cfg *config.Config) (*chi.Mux, error) {
 		}))
 	}
 
-	r.Use(dockerAuthMiddleware(cfg))
+	clients, err := compileClientRules(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile client rules: %w", err)
+	}
+
+	auth, err := newAuthChain(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authenticator chain: %w", err)
+	}
+
+	policies, err := compilePolicies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures, err := newSignatureVerifier(cfg.Signatures)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signature keys: %w", err)
+	}
+
+	networks, err := compileNetworkRules(cfg.NetworkRules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile network rules: %w", err)
+	}
+
+	aliases, err := compileAliases(cfg.Aliases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile repository aliases: %w", err)
+	}
 
 	url, err := url.Parse(cfg.ZotURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse zot URL: %w", err)
 	}
 
-	handler := newReverseProxy(url)
+	g := &gateway{
+		cfg:      cfg,
+		clients:  clients,
+		auth:     auth,
+		access:   accessRules(cfg.AccessRules),
+		policies: policies,
+		modes:    newModes(cfg),
+		upstream: url,
+		client:   &http.Client{},
+
+		vulnerabilities: newVulnerabilityGate(cfg.VulnerabilityGate),
+		signatures:      signatures,
+		quotas:          newQuotaTracker(cfg.Quotas),
+		networks:        networks,
+		locations:       newLocationRewriter(url, cfg.MyURL),
+		compat:          newDockerCompat(cfg.DockerCompat),
+		platforms:       newPlatformFilter(cfg.PlatformFilters),
+		aliases:         aliases,
+	}
+
+	handler := newReverseProxy(url, g.modifyResponse)
+
+	// The admin API sits outside the client authentication flow and has its
+	// own token.
+	r.Mount("/_proxy/admin", adminRouter(g))
+
+	proxy := chi.NewRouter()
+	proxy.Use(canonicalPathMiddleware)
+	proxy.Use(repositoryNamesMiddleware(g))
+	proxy.Use(modesMiddleware(g))
+	proxy.Use(dockerAuthMiddleware(g))
+	proxy.Use(networkMiddleware(g))
+	proxy.Use(accessMiddleware(g))
+	proxy.Use(policyMiddleware(g))
+	proxy.Use(listingMiddleware(g))
+	proxy.Use(immutableTagsMiddleware(g))
+	proxy.Use(admissionMiddleware(g))
+	proxy.Use(quotaMiddleware(g))
+	proxy.Use(softDeleteMiddleware(g))
+	proxy.Use(dockerCompatMiddleware(g))
+	proxy.Use(platformFilterMiddleware(g))
+	proxy.Use(vulnerabilityMiddleware(g))
+	proxy.Use(signatureMiddleware(g))
+	proxy.Use(referrersMiddleware(g))
 
 	// Catch-all: proxy everything
-	r.Handle("/*", handler)
+	proxy.Handle("/*", handler)
+	r.Mount("/", proxy)
+
+	return &Router{Mux: proxy, root: r, g: g}, nil
+}
 
-	return r, nil
+// modifyResponse rewrites Zot's responses for the proxy's clients.
+func (g *gateway) modifyResponse(resp *http.Response) error {
+	if err := g.handleStorageRedirect(resp); err != nil {
+		return err
+	}
+	if g.locations != nil {
+		g.locations.rewriteResponse(resp)
+	}
+	g.mapNamesBack(resp)
+	g.translateChallenge(resp)
+	return nil
 }
 
-func newReverseProxy(upstream *url.URL) http.Handler {
+func newReverseProxy(upstream *url.URL, modifyResponse func(*http.Response) error) http.Handler {
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.ModifyResponse = modifyResponse
+	proxy.ErrorHandler = writeUpstreamError
 
 	origDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
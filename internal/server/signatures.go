@@ -0,0 +1,550 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+const (
+	artifactTypeCosignSignature   = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	artifactTypeNotationSignature = "application/vnd.cncf.notary.signature"
+	mediaTypeCosignSimpleSigning  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	mediaTypeJWS                  = "application/jose+json"
+	mediaTypeNotationPayload      = "application/vnd.cncf.notary.payload.v1+json"
+
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	notationSigningTime       = "io.cncf.notary.signingTime"
+
+	// maxSignatureSize bounds the signature payloads and envelopes the
+	// proxy downloads.
+	maxSignatureSize = 1 << 20
+	// maxSubjectDepth bounds the chain of artifact subjects followed to
+	// find a signed image, such as a signature of an attestation.
+	maxSubjectDepth = 4
+)
+
+// subjectTagRegexp matches the tags cosign stores signatures, attestations,
+// and SBOMs under, and the tags of the referrers tag schema, capturing the
+// hex of the digest they are for.
+var subjectTagRegexp = regexp.MustCompile(`^sha256-([a-f0-9]{64})(?:\.(?:sig|att|sbom))?$`)
+
+var (
+	errNoSignatures             = errors.New("no signatures found")
+	errSignatureKeyInvalid      = errors.New("signature key file contains no PEM public key or certificate")
+	errSignatureUnsupportedKey  = errors.New("unsupported signature key type")
+	errSignatureBad             = errors.New("signature does not verify with a trusted key")
+	errSignatureDigestMismatch  = errors.New("signature is for a different digest")
+	errSignatureMalformed       = errors.New("malformed signature")
+	errSignatureUntrustedSigner = errors.New("signing certificate is not trusted")
+)
+
+type signatureRule struct {
+	repositories []string
+	keys         []crypto.PublicKey
+	roots        *x509.CertPool
+}
+
+// signatureResult is the cached outcome of verifying a digest. Unsigned
+// artifacts are recorded as such with their subject, never as verified.
+type signatureResult struct {
+	verified bool
+	reason   string
+	artifact bool
+	subject  string
+}
+
+// signatureVerifier requires images in protected repositories to carry a
+// cosign or Notation signature from a trusted key.
+type signatureVerifier struct {
+	rules []signatureRule
+	cache *ttlCache[signatureResult]
+}
+
+func newSignatureVerifier(cfg config.Signatures) (*signatureVerifier, error) {
+	v := &signatureVerifier{cache: newTTLCache[signatureResult](time.Duration(cfg.CacheTTL) * time.Second)}
+	for _, rule := range cfg.Rules {
+		compiled := signatureRule{repositories: rule.Repositories, roots: x509.NewCertPool()}
+		for _, path := range rule.Keys {
+			if err := compiled.loadKeys(path); err != nil {
+				return nil, err
+			}
+		}
+		v.rules = append(v.rules, compiled)
+	}
+	return v, nil
+}
+
+// loadKeys reads every public key and certificate in a PEM file.
+// Certificates are trusted as keys and as roots for Notation chains.
+func (s *signatureRule) loadKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read signature key: %w", err)
+	}
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("failed to parse certificate in %s: %w", path, err)
+			}
+			s.keys = append(s.keys, cert.PublicKey)
+			s.roots.AddCert(cert)
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("failed to parse public key in %s: %w", path, err)
+			}
+			s.keys = append(s.keys, key)
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", errSignatureKeyInvalid, path)
+	}
+	return nil
+}
+
+func (s *signatureRule) trusts(key crypto.PublicKey) bool {
+	for _, trusted := range s.keys {
+		if k, ok := trusted.(interface{ Equal(x crypto.PublicKey) bool }); ok && k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the first rule covering the repository.
+func (v *signatureVerifier) rule(repository string) (int, *signatureRule) {
+	for i := range v.rules {
+		if glob.MatchAny(v.rules[i].repositories, repository) {
+			return i, &v.rules[i]
+		}
+	}
+	return -1, nil
+}
+
+// tagSubject returns the digest named by one of cosign's tags or a
+// referrers tag, or "" for other references.
+func tagSubject(reference string) string {
+	match := subjectTagRegexp.FindStringSubmatch(reference)
+	if match == nil {
+		return ""
+	}
+	return "sha256:" + match[1]
+}
+
+// cosignTag is the tag cosign stores the signatures of a digest under.
+func cosignTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// signatureResult verifies the signatures of a digest, using the cache.
+func (g *gateway) signatureResult(r *http.Request, index int, rule *signatureRule, repository, digest string) (signatureResult, error) {
+	key := fmt.Sprintf("%d/%s@%s", index, repository, digest)
+	if result, ok := g.signatures.cache.get(key); ok {
+		return result, nil
+	}
+
+	result := signatureResult{verified: true}
+	err := g.verifySignatures(r, rule, repository, digest)
+	if err != nil {
+		if !errors.Is(err, errNoSignatures) && !errors.Is(err, errSignatureBad) {
+			return signatureResult{}, err
+		}
+		result = signatureResult{reason: err.Error()}
+		body, err := g.fetchManifest(r, repository, digest)
+		if err != nil {
+			return signatureResult{}, err
+		}
+		var manifest ociManifest
+		if json.Unmarshal(body, &manifest) == nil && (isArtifactManifest(manifest) || isReferrersIndex(manifest)) {
+			result.artifact = true
+			if manifest.Subject != nil {
+				result.subject = manifest.Subject.Digest
+			}
+		}
+	}
+	g.signatures.cache.set(key, result)
+	return result, nil
+}
+
+// trustedDigest reports whether a digest may be served from a protected
+// repository. Unsigned artifacts are trusted through their subject, which
+// must be signed. An artifact without a subject, pulled by one of cosign's
+// tags or a referrers tag, has the digest the tag names as its subject.
+func (g *gateway) trustedDigest(r *http.Request, index int, rule *signatureRule, repository, digest, tagSubject string) (bool, string, error) {
+	for range maxSubjectDepth {
+		result, err := g.signatureResult(r, index, rule, repository, digest)
+		if err != nil {
+			return false, "", err
+		}
+		subject := result.subject
+		if subject == "" {
+			subject = tagSubject
+		}
+		switch {
+		case result.verified:
+			return true, "", nil
+		case !result.artifact:
+			return false, result.reason, nil
+		case subject == "":
+			return false, "artifact has no subject", nil
+		case !isDigest(subject):
+			return false, "artifact has a malformed subject", nil
+		}
+		digest, tagSubject = subject, ""
+	}
+	return false, "artifact subjects are nested too deeply", nil
+}
+
+// isArtifactManifest reports whether a manifest is an artifact rather than
+// a runnable image: it has no filesystem layers, and either declares an
+// artifact type, has a config that is not an image config, or carries
+// other content.
+func isArtifactManifest(manifest ociManifest) bool {
+	if manifest.SchemaVersion != 2 || manifest.Config == nil || len(manifest.Manifests) > 0 {
+		return false
+	}
+	for _, layer := range manifest.Layers {
+		if strings.HasPrefix(layer.MediaType, "application/vnd.oci.image.layer.") ||
+			strings.HasPrefix(layer.MediaType, "application/vnd.docker.image.rootfs.") {
+			return false
+		}
+	}
+	if manifest.ArtifactType != "" || len(manifest.Layers) > 0 {
+		return true
+	}
+	return manifest.Config.MediaType != mediaTypeOCIConfig && manifest.Config.MediaType != mediaTypeDockerConfig
+}
+
+// isReferrersIndex reports whether a manifest is an index of referrers, like
+// the ones the referrers tag schema stores, rather than a multi-platform
+// image. Its entries are checked when they are pulled.
+func isReferrersIndex(manifest ociManifest) bool {
+	if manifest.SchemaVersion != 2 || manifest.MediaType != mediaTypeOCIIndex || manifest.Config != nil || len(manifest.Layers) > 0 {
+		return false
+	}
+	for _, descriptor := range manifest.Manifests {
+		if descriptor.Platform != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// verifySignatures looks for a valid signature of the digest, first among
+// its referrers, then under cosign's signature tag.
+func (g *gateway) verifySignatures(r *http.Request, rule *signatureRule, repository, digest string) error {
+	var manifests []ociManifest
+
+	body, err := g.fetchContent(r.Context(), "/v2/"+repository+"/referrers/"+digest, r.Header, maxManifestSize)
+	switch {
+	case err == nil:
+		var index ociManifest
+		if err := json.Unmarshal(body, &index); err != nil {
+			return fmt.Errorf("failed to decode referrers: %w", err)
+		}
+		for _, desc := range index.Manifests {
+			if desc.ArtifactType != artifactTypeCosignSignature && desc.ArtifactType != artifactTypeNotationSignature {
+				continue
+			}
+			manifest, err := g.fetchSignatureManifest(r, repository, desc.Digest)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, manifest)
+		}
+	case errors.Is(err, errUpstreamNotFound):
+	default:
+		return err
+	}
+
+	manifest, err := g.fetchSignatureManifest(r, repository, cosignTag(digest))
+	switch {
+	case err == nil:
+		manifests = append(manifests, manifest)
+	case errors.Is(err, errUpstreamNotFound):
+	default:
+		return err
+	}
+
+	if len(manifests) == 0 {
+		return errNoSignatures
+	}
+
+	var lastErr error
+	for _, manifest := range manifests {
+		for _, layer := range manifest.Layers {
+			var err error
+			switch layer.MediaType {
+			case mediaTypeCosignSimpleSigning:
+				err = g.verifyCosignLayer(r, rule, repository, digest, layer)
+			case mediaTypeJWS:
+				err = g.verifyNotationLayer(r, rule, repository, digest, layer)
+			default:
+				continue
+			}
+			if err == nil {
+				return nil
+			}
+			if errors.Is(err, errUpstreamNotFound) || errors.Is(err, errUnexpectedUpstreamStatus) {
+				return err
+			}
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		return errNoSignatures
+	}
+	return fmt.Errorf("%w: %w", errSignatureBad, lastErr)
+}
+
+func (g *gateway) fetchSignatureManifest(r *http.Request, repository, reference string) (ociManifest, error) {
+	body, err := g.fetchManifest(r, repository, reference)
+	if err != nil {
+		return ociManifest{}, err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return ociManifest{}, fmt.Errorf("failed to decode signature manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifyCosignLayer checks a cosign simple signing payload and the
+// signature in its annotation.
+func (g *gateway) verifyCosignLayer(r *http.Request, rule *signatureRule, repository, digest string, layer ociDescriptor) error {
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return errSignatureMalformed
+	}
+	payload, err := g.fetchBlob(r, repository, layer.Digest, maxSignatureSize)
+	if err != nil {
+		return err
+	}
+
+	verified := false
+	for _, key := range rule.keys {
+		if verifyCosignSignature(key, payload, signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errSignatureBad
+	}
+
+	var parsed cosignPayload
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return errSignatureMalformed
+	}
+	if parsed.Critical.Image.DockerManifestDigest != digest {
+		return errSignatureDigestMismatch
+	}
+	return nil
+}
+
+func verifyCosignSignature(key crypto.PublicKey, payload, signature []byte) error {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, sum[:], signature) {
+			return errSignatureBad
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], signature); err != nil {
+			return errSignatureBad
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, signature) {
+			return errSignatureBad
+		}
+	default:
+		return errSignatureUnsupportedKey
+	}
+	return nil
+}
+
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		X5C [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type notationProtectedHeader struct {
+	Alg         string `json:"alg"`
+	Cty         string `json:"cty"`
+	SigningTime string `json:"io.cncf.notary.signingTime"`
+}
+
+type notationPayload struct {
+	TargetArtifact ociDescriptor `json:"targetArtifact"`
+}
+
+// verifyNotationLayer checks a Notation JWS envelope. The signing
+// certificate must be a trusted key or chain to a trusted certificate.
+func (g *gateway) verifyNotationLayer(r *http.Request, rule *signatureRule, repository, digest string, layer ociDescriptor) error {
+	body, err := g.fetchBlob(r, repository, layer.Digest, maxSignatureSize)
+	if err != nil {
+		return err
+	}
+	var envelope jwsEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Header.X5C) == 0 {
+		return errSignatureMalformed
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return errSignatureMalformed
+	}
+	var header notationProtectedHeader
+	if err := json.Unmarshal(protected, &header); err != nil || header.Cty != mediaTypeNotationPayload {
+		return errSignatureMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return errSignatureMalformed
+	}
+
+	certs := make([]*x509.Certificate, 0, len(envelope.Header.X5C))
+	for _, der := range envelope.Header.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errSignatureMalformed
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+
+	verifier := &jwtVerifier{publicKey: leaf.PublicKey}
+	if err := verifier.verifySignature(header.Alg, []byte(envelope.Protected+"."+envelope.Payload), signature); err != nil {
+		return errSignatureBad
+	}
+
+	if !rule.trusts(leaf.PublicKey) {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         rule.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}
+		if signingTime, err := time.Parse(time.RFC3339, header.SigningTime); err == nil {
+			opts.CurrentTime = signingTime
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return fmt.Errorf("%w: %w", errSignatureUntrustedSigner, err)
+		}
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return errSignatureMalformed
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return errSignatureMalformed
+	}
+	if payload.TargetArtifact.Digest != digest {
+		return errSignatureDigestMismatch
+	}
+	return nil
+}
+
+// signatureMiddleware refuses manifest pulls in protected repositories
+// unless the image is signed by a trusted key.
+func signatureMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || t.Kind != kindManifests || t.Action != actionPull {
+				next.ServeHTTP(w, r)
+				return
+			}
+			index, rule := g.signatures.rule(t.Repository)
+			if rule == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			digest := t.Reference
+			if !isDigest(digest) {
+				var exists bool
+				var err error
+				digest, exists, err = g.manifestDigest(r, t.Repository, t.Reference)
+				if err != nil {
+					slog.Error("Failed to resolve tag for signature check", "repository", t.Repository, "tag", t.Reference, "error", err.Error())
+					writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not verify the image's signatures", nil)
+					return
+				}
+				if !exists {
+					next.ServeHTTP(w, r)
+					return
+				}
+				// Serve the digest that was verified, even if the tag
+				// moves in the meantime.
+				r = r.Clone(r.Context())
+				r.URL.Path = strings.TrimSuffix(r.URL.Path, t.Reference) + digest
+				r.URL.RawPath = ""
+			}
+
+			trusted, reason, err := g.trustedDigest(r, index, rule, t.Repository, digest, tagSubject(t.Reference))
+			if err != nil {
+				slog.Error("Failed to verify signatures", "repository", t.Repository, "digest", digest, "error", err.Error())
+				writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not verify the image's signatures", nil)
+				return
+			}
+			if !trusted {
+				slog.Info("Pull denied, image is not signed by a trusted key", "identity", identityName(IdentityFromContext(r.Context())), "repository", t.Repository, "digest", digest, "reason", reason)
+				writeRegistryError(w, http.StatusForbidden, errCodeDenied, "image is not signed by a trusted key", map[string]string{
+					"repository": t.Repository,
+					"digest":     digest,
+					"reason":     reason,
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	emptyConfig     = `{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2}`
+	imageConfig     = `{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:` + "1111111111111111111111111111111111111111111111111111111111111111" + `","size":2}`
+	imageLayer      = `{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:` + "2222222222222222222222222222222222222222222222222222222222222222" + `","size":10}`
+)
+
+func generateSigningKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write PEM: %v", err)
+	}
+	return path
+}
+
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return writePEM(t, "PUBLIC KEY", der)
+}
+
+func testImage(registry *fakeRegistry, repository, tag string) string {
+	return registry.putManifest(repository, tag, ociManifestType,
+		[]byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+`","config":`+imageConfig+`,"layers":[`+imageLayer+`],"annotations":{"repo":"`+repository+`"}}`))
+}
+
+// cosignSign stores a cosign signature of the digest under its signature
+// tag, the way cosign does for registries without the referrers API.
+func cosignSign(t *testing.T, registry *fakeRegistry, key *ecdsa.PrivateKey, repository, digest string) {
+	t.Helper()
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + repository + `"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+	sum := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	payloadDigest := registry.putBlob(payload)
+	manifest, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        json.RawMessage(emptyConfig),
+		"layers": []map[string]any{{
+			"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+			"digest":      payloadDigest,
+			"size":        len(payload),
+			"annotations": map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	registry.putManifest(repository, strings.Replace(digest, ":", "-", 1)+".sig", ociManifestType, manifest)
+}
+
+func signatureTestRouter(t *testing.T, backendURL string, keys ...string) http.Handler {
+	t.Helper()
+	cfg := &config.Config{
+		LogLevel: config.LogLevelInfo,
+		MyURL:    "http://localhost:8080",
+		ZotURL:   backendURL,
+		Signatures: config.Signatures{
+			CacheTTL: 300,
+			Rules:    []config.SignatureRule{{Repositories: []string{"prod/**"}, Keys: keys}},
+		},
+	}
+	return newTestRouter(t, cfg)
+}
+
+func TestSignatures_Cosign(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.referrersAPI = false
+	trusted := generateSigningKey(t)
+	untrusted := generateSigningKey(t)
+
+	signed := testImage(registry, "prod/app", "1.0")
+	cosignSign(t, registry, trusted, "prod/app", signed)
+	testImage(registry, "prod/unsigned", "1.0")
+	forged := testImage(registry, "prod/forged", "1.0")
+	cosignSign(t, registry, untrusted, "prod/forged", forged)
+	testImage(registry, "dev/app", "1.0")
+
+	router := signatureTestRouter(t, backend.URL, writePublicKey(t, trusted))
+
+	rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/1.0")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected signed image to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if registry.requested(http.MethodGet, "/v2/prod/app/manifests/"+signed) != 1 {
+		t.Error("expected the verified digest to be fetched")
+	}
+
+	sigLookups := registry.requested(http.MethodGet, "/v2/prod/app/manifests/sha256-")
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+signed); rec.Code != http.StatusOK {
+		t.Errorf("expected signed digest to be served, got %d", rec.Code)
+	}
+	if registry.requested(http.MethodGet, "/v2/prod/app/manifests/sha256-") != sigLookups {
+		t.Error("expected the verification result to be cached")
+	}
+
+	for _, path := range []string{"/v2/prod/unsigned/manifests/1.0", "/v2/prod/forged/manifests/1.0"} {
+		rec := serve(router, http.MethodGet, path)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"DENIED"`) {
+			t.Errorf("%s: expected 403 DENIED, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := serve(router, http.MethodGet, "/v2/dev/app/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected unprotected repository to be served, got %d", rec.Code)
+	}
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+strings.Replace(signed, ":", "-", 1)+".sig"); rec.Code != http.StatusOK {
+		t.Errorf("expected signature tag to be served, got %d", rec.Code)
+	}
+}
+
+// notationSign stores a Notation JWS signature of the digest as a referrer.
+func notationSign(t *testing.T, registry *fakeRegistry, key *ecdsa.PrivateKey, cert *x509.Certificate, repository, digest string, size int) string {
+	t.Helper()
+	protected, _ := json.Marshal(map[string]any{
+		"alg":                          "ES256",
+		"cty":                          "application/vnd.cncf.notary.payload.v1+json",
+		"crit":                         []string{"io.cncf.notary.signingScheme"},
+		"io.cncf.notary.signingScheme": "notary.x509",
+		"io.cncf.notary.signingTime":   time.Now().UTC().Format(time.RFC3339),
+	})
+	payload, _ := json.Marshal(map[string]any{
+		"targetArtifact": map[string]any{"mediaType": ociManifestType, "digest": digest, "size": size},
+	})
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protected)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	envelope, _ := json.Marshal(map[string]any{
+		"payload":   encodedPayload,
+		"protected": encodedProtected,
+		"header":    map[string]any{"x5c": [][]byte{cert.Raw}},
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+	envelopeDigest := registry.putBlob(envelope)
+	manifest, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"artifactType":  "application/vnd.cncf.notary.signature",
+		"config":        json.RawMessage(emptyConfig),
+		"layers":        []map[string]any{{"mediaType": "application/jose+json", "digest": envelopeDigest, "size": len(envelope)}},
+		"subject":       map[string]any{"mediaType": ociManifestType, "digest": digest, "size": size},
+	})
+	return registry.putManifest(repository, "", ociManifestType, manifest)
+}
+
+func TestSignatures_Notation(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	key := generateSigningKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "release signer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	signed := testImage(registry, "prod/app", "1.0")
+	signedBody := registry.manifests["prod/app@"+signed]
+	signature := notationSign(t, registry, key, cert, "prod/app", signed, len(signedBody))
+	testImage(registry, "prod/unsigned", "1.0")
+
+	router := signatureTestRouter(t, backend.URL, writePEM(t, "CERTIFICATE", der))
+
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected signed image to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+signature); rec.Code != http.StatusOK {
+		t.Errorf("expected signature manifest to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(router, http.MethodGet, "/v2/prod/unsigned/manifests/1.0"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected unsigned image to be refused, got %d", rec.Code)
+	}
+}
+
+func TestSignatures_Artifacts(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	registry.referrersAPI = false
+	key := generateSigningKey(t)
+
+	signed := testImage(registry, "prod/app", "1.0")
+	cosignSign(t, registry, key, "prod/app", signed)
+	unsigned := registry.putManifest("prod/app", "2.0", ociManifestType,
+		[]byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+`","config":`+imageConfig+`,"layers":[`+imageLayer+`],"annotations":{"version":"2.0"}}`))
+
+	withSubject := func(tag, config, layers, subject string) string {
+		return registry.putManifest("prod/app", tag, ociManifestType, []byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+
+			`","config":`+config+`,"layers":[`+layers+`],"subject":{"mediaType":"`+ociManifestType+`","digest":"`+subject+`","size":2}}`))
+	}
+	sbom := `{"mediaType":"application/spdx+json","digest":"sha256:` + strings.Repeat("3", 64) + `","size":10}`
+	withSubject("sbom", emptyConfig, sbom, signed)
+	withSubject("unsigned-sbom", emptyConfig, sbom, unsigned)
+	withSubject("image-with-subject", imageConfig, imageLayer, signed)
+	registry.putManifest("prod/app", "sha256-"+strings.Repeat("4", 64)+".sig", ociManifestType,
+		[]byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+`","config":`+imageConfig+`,"layers":[`+imageLayer+`]}`))
+	chart := `{"schemaVersion":2,"mediaType":"` + ociManifestType + `","config":{"mediaType":"application/vnd.cncf.helm.config.v1+json","digest":"sha256:` + strings.Repeat("5", 64) +
+		`","size":2},"layers":[{"mediaType":"application/vnd.cncf.helm.chart.content.v1.tar+gzip","digest":"sha256:` + strings.Repeat("6", 64) + `","size":10}]}`
+	registry.putManifest("prod/app", "chart", ociManifestType, []byte(chart))
+	registry.putManifest("prod/app", strings.Replace(unsigned, ":", "-", 1)+".att", ociManifestType,
+		[]byte(`{"schemaVersion":2,"mediaType":"`+ociManifestType+`","config":`+emptyConfig+`,"layers":[`+sbom+`]}`))
+
+	router := signatureTestRouter(t, backend.URL, writePublicKey(t, key))
+
+	tests := []struct {
+		name     string
+		tag      string
+		wantCode int
+	}{
+		{name: "artifact of a signed image", tag: "sbom", wantCode: http.StatusOK},
+		{name: "artifact of an unsigned image", tag: "unsigned-sbom", wantCode: http.StatusForbidden},
+		{name: "unsigned image with a subject", tag: "image-with-subject", wantCode: http.StatusForbidden},
+		{name: "unsigned image under a signature tag", tag: "sha256-" + strings.Repeat("4", 64) + ".sig", wantCode: http.StatusForbidden},
+		{name: "unsigned artifact without a subject", tag: "chart", wantCode: http.StatusForbidden},
+		{name: "attestation tag of an unsigned image", tag: strings.Replace(unsigned, ":", "-", 1) + ".att", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			for range 2 {
+				if rec := serve(router, http.MethodGet, "/v2/prod/app/manifests/"+tt.tag); rec.Code != tt.wantCode {
+					t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+var errStorageRedirect = errors.New("failed to follow storage redirect")
+
+// storageRequestHeaders are the client headers sent along when the proxy
+// follows a storage redirect. Credentials stay behind, since presigned URLs
+// carry their own.
+var storageRequestHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} //nolint:gochecknoglobals
+
+// storageResponseHeaders are the headers of a storage response that
+// describe the content the client gets.
+var storageResponseHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "ETag", "Last-Modified"} //nolint:gochecknoglobals
+
+// storageRedirect returns where Zot redirected a blob pull to, when that is
+// somewhere other than Zot itself.
+func (g *gateway) storageRedirect(resp *http.Response) (*url.URL, bool) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	if resp.Request == nil || (resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead) {
+		return nil, false
+	}
+	path, ok := cutPathPrefix(resp.Request.URL.Path, g.upstream.Path)
+	if !ok {
+		return nil, false
+	}
+	if t, ok := parseTarget(&http.Request{URL: &url.URL{Path: path}}); !ok || t.Kind != kindBlobs {
+		return nil, false
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || sameOrigin(location, g.upstream) {
+		return nil, false
+	}
+	return location, true
+}
+
+// handleStorageRedirect applies the storage redirect policy to a response.
+func (g *gateway) handleStorageRedirect(resp *http.Response) error {
+	policy := g.cfg.StorageRedirects.Policy
+	if policy != config.StorageRedirectFollow && policy != config.StorageRedirectRewrite {
+		return nil
+	}
+	location, ok := g.storageRedirect(resp)
+	if !ok {
+		return nil
+	}
+	if policy == config.StorageRedirectFollow {
+		return g.followStorageRedirect(resp, location)
+	}
+
+	endpoint, err := url.Parse(g.cfg.StorageRedirects.RewriteURL)
+	if err != nil {
+		return nil
+	}
+	rewritten := *location
+	rewritten.Scheme = endpoint.Scheme
+	rewritten.Host = endpoint.Host
+	rewritten.User = nil
+	rewritten.Path = strings.TrimSuffix(endpoint.Path, "/") + location.Path
+	rewritten.RawPath = ""
+	slog.Debug("Rewrote storage redirect", "from", location.Host, "to", endpoint.Host, "path", resp.Request.URL.Path)
+	resp.Header.Set("Location", rewritten.String())
+	return nil
+}
+
+// followStorageRedirect replaces a storage redirect with the content it
+// points to, which the reverse proxy then streams to the client. The client
+// keeps Zot's headers, like Docker-Content-Digest, and gets the content
+// headers of the storage response, so range requests work as with Zot.
+func (g *gateway) followStorageRedirect(resp *http.Response, location *url.URL) error {
+	req, err := http.NewRequestWithContext(resp.Request.Context(), resp.Request.Method, location.String(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStorageRedirect, err)
+	}
+	for _, key := range storageRequestHeaders {
+		if value := resp.Request.Header.Get(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+	stored, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStorageRedirect, err)
+	}
+	switch {
+	case stored.StatusCode >= http.StatusOK && stored.StatusCode < http.StatusMultipleChoices:
+	case stored.StatusCode == http.StatusNotModified, stored.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+	default:
+		stored.Body.Close()
+		return fmt.Errorf("%w: storage answered %s", errStorageRedirect, stored.Status)
+	}
+
+	slog.Debug("Following storage redirect", "host", location.Host, "path", resp.Request.URL.Path, "status", stored.StatusCode)
+	resp.Body.Close()
+	for _, key := range []string{"Location", "Content-Length", "Content-Type"} {
+		resp.Header.Del(key)
+	}
+	for _, key := range storageResponseHeaders {
+		if values := stored.Header.Values(key); len(values) > 0 {
+			resp.Header[key] = values
+		}
+	}
+	resp.StatusCode, resp.Status = stored.StatusCode, stored.Status
+	resp.ContentLength = stored.ContentLength
+	resp.Body = stored.Body
+	return nil
+}
@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+const storageBlob = "0123456789abcdef"
+
+// newS3StandIn serves storageBlob like a bucket behind presigned URLs:
+// requests need a signature in the query, and S3 refuses requests that
+// also carry an Authorization header.
+func newS3StandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Amz-Signature") == "" || r.Header.Get("Authorization") != "" {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code></Error>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Amz-Request-Id", "stand-in")
+		http.ServeContent(w, r, "", time.Unix(0, 0), bytes.NewReader([]byte(storageBlob)))
+	}))
+	t.Cleanup(storage.Close)
+	return storage
+}
+
+// newRedirectingZot redirects blob pulls to the storage, like Zot with S3
+// storage and redirects enabled. The expired blob gets an unsigned URL.
+func newRedirectingZot(t *testing.T, storageURL string) *httptest.Server {
+	t.Helper()
+	zot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, ok := strings.CutPrefix(r.URL.Path, "/v2/app/blobs/")
+		if !ok {
+			w.Header().Set("Location", "/v2/app/manifests/moved")
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+		location := storageURL + "/bucket/docker/registry/v2/blobs/" + strings.Replace(blob, ":", "/", 1) + "/data"
+		if blob != "sha256:expired" {
+			location += "?X-Amz-Expires=60&X-Amz-Signature=abc"
+		}
+		w.Header().Set("Docker-Content-Digest", blob)
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(zot.Close)
+	return zot
+}
+
+func storageTestRouter(t *testing.T, zotURL string, redirects config.StorageRedirects) http.Handler {
+	t.Helper()
+	return newTestRouter(t, &config.Config{
+		LogLevel:         config.LogLevelInfo,
+		MyURL:            "http://localhost:8080",
+		ZotURL:           zotURL,
+		StorageRedirects: redirects,
+	})
+}
+
+func TestStorageRedirects_Passthrough(t *testing.T) {
+	t.Parallel()
+
+	storage := newS3StandIn(t)
+	router := storageTestRouter(t, newRedirectingZot(t, storage.URL).URL, config.StorageRedirects{})
+	alice := withHeader("Authorization", basicAuth("alice", "hunter2"))
+
+	rec := serve(router, http.MethodGet, "/v2/app/blobs/sha256:abc", alice)
+	if rec.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(rec.Header().Get("Location"), storage.URL+"/bucket/") {
+		t.Errorf("expected the storage redirect to reach the client, got %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestStorageRedirects_Follow(t *testing.T) {
+	t.Parallel()
+
+	storage := newS3StandIn(t)
+	router := storageTestRouter(t, newRedirectingZot(t, storage.URL).URL, config.StorageRedirects{Policy: config.StorageRedirectFollow})
+	alice := withHeader("Authorization", basicAuth("alice", "hunter2"))
+
+	rec := serve(router, http.MethodGet, "/v2/app/blobs/sha256:abc", alice)
+	if rec.Code != http.StatusOK || rec.Body.String() != storageBlob {
+		t.Fatalf("expected the blob from storage, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Docker-Content-Digest") != "sha256:abc" || rec.Header().Get("Location") != "" || rec.Header().Get("X-Amz-Request-Id") != "" {
+		t.Errorf("expected Zot's headers without the redirect or storage internals, got %v", rec.Header())
+	}
+
+	partial := serve(router, http.MethodGet, "/v2/app/blobs/sha256:abc", alice, withHeader("Range", "bytes=2-5"))
+	if partial.Code != http.StatusPartialContent || partial.Body.String() != storageBlob[2:6] || partial.Header().Get("Content-Range") != "bytes 2-5/16" {
+		t.Errorf("expected a range of the blob, got %d %v: %s", partial.Code, partial.Header(), partial.Body.String())
+	}
+
+	expired := serve(router, http.MethodGet, "/v2/app/blobs/sha256:expired", alice)
+	var body errorBody
+	if expired.Code != http.StatusBadGateway || json.Unmarshal(expired.Body.Bytes(), &body) != nil || len(body.Errors) != 1 || body.Errors[0].Code != "UNAVAILABLE" {
+		t.Errorf("expected a refused storage request to be a 502 UNAVAILABLE, got %d: %s", expired.Code, expired.Body.String())
+	}
+
+	if manifest := serve(router, http.MethodGet, "/v2/app/manifests/1.0", alice); manifest.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected redirects of other requests to be left alone, got %d", manifest.Code)
+	}
+}
+
+func TestStorageRedirects_Rewrite(t *testing.T) {
+	t.Parallel()
+
+	storage := newS3StandIn(t)
+	router := storageTestRouter(t, newRedirectingZot(t, storage.URL).URL, config.StorageRedirects{Policy: config.StorageRedirectRewrite, RewriteURL: "http://minio.internal:9000/s3"})
+	alice := withHeader("Authorization", basicAuth("alice", "hunter2"))
+
+	rec := serve(router, http.MethodGet, "/v2/app/blobs/sha256:abc", alice)
+	want := "http://minio.internal:9000/s3/bucket/docker/registry/v2/blobs/sha256/abc/data?X-Amz-Expires=60&X-Amz-Signature=abc"
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != want {
+		t.Errorf("expected a redirect to %s, got %d to %s", want, rec.Code, rec.Header().Get("Location"))
+	}
+}
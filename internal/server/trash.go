@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	trashTimeFormat = "20060102T150405Z"
+	maxTagLength    = 128
+)
+
+var (
+	errNotTrashed         = errors.New("not a trashed manifest")
+	errSoftDeleteDisabled = errors.New("soft delete is not enabled")
+)
+
+// trashEntry is a trashed manifest, as reported by the admin API.
+type trashEntry struct {
+	Repository      string    `json:"repository"`
+	TrashRepository string    `json:"trash-repository"`
+	Tag             string    `json:"tag"`
+	OriginalTag     string    `json:"original-tag,omitempty"`
+	Digest          string    `json:"digest,omitempty"`
+	DeletedAt       time.Time `json:"deleted-at"`
+}
+
+func (g *gateway) trashRepository(repository string) string {
+	return g.cfg.SoftDelete.TrashPrefix + "/" + repository
+}
+
+func (g *gateway) isTrashRepository(repository string) bool {
+	return strings.HasPrefix(repository, g.cfg.SoftDelete.TrashPrefix+"/")
+}
+
+// trashTag names a trashed manifest after its deletion time and original
+// tag. Manifests deleted by digest with no tags keep their digest instead.
+func trashTag(deletedAt time.Time, original string) string {
+	return deletedAt.UTC().Format(trashTimeFormat) + "_" + strings.Replace(original, ":", "-", 1)
+}
+
+// parseTrashTag reads the deletion time and the original tag or digest
+// back from a trash tag.
+func parseTrashTag(tag string) (time.Time, string, string, bool) {
+	stamp, original, ok := strings.Cut(tag, "_")
+	if !ok || original == "" {
+		return time.Time{}, "", "", false
+	}
+	deletedAt, err := time.Parse(trashTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}, "", "", false
+	}
+	if hex, ok := strings.CutPrefix(original, "sha256-"); ok && len(hex) == 64 {
+		return deletedAt, "", "sha256:" + hex, true
+	}
+	return deletedAt, original, "", true
+}
+
+// tagsOf lists the tags of a repository that point to a digest.
+func (g *gateway) tagsOf(ctx context.Context, header http.Header, repository, digest string) ([]string, error) {
+	tags, err := g.listAll(ctx, header, "/v2/"+repository+"/tags/list", "tags")
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, tag := range tags {
+		current, exists, err := g.headManifest(ctx, header, repository, tag)
+		if err != nil {
+			return nil, err
+		}
+		if exists && current == digest {
+			matching = append(matching, tag)
+		}
+	}
+	return matching, nil
+}
+
+// trashManifest copies a manifest into the trash, once for every tag that
+// points to it, and returns the trash tags it created.
+func (g *gateway) trashManifest(ctx context.Context, repository, reference string) ([]string, error) {
+	header := g.serviceHeader()
+	originals := []string{reference}
+	if isDigest(reference) {
+		tags, err := g.tagsOf(ctx, header, repository, reference)
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) > 0 {
+			originals = tags
+		}
+	}
+
+	now := time.Now()
+	trash := g.trashRepository(repository)
+	var created []string
+	for _, original := range originals {
+		tag := trashTag(now, original)
+		if len(tag) > maxTagLength {
+			// Long tags do not fit next to the timestamp, so keep the
+			// digest instead.
+			digest, exists, err := g.headManifest(ctx, header, repository, reference)
+			if err != nil {
+				return created, err
+			}
+			if !exists {
+				return created, errUpstreamNotFound
+			}
+			tag = trashTag(now, digest)
+		}
+		if err := g.copyManifest(ctx, header, repository, trash, reference, tag); err != nil {
+			return created, err
+		}
+		created = append(created, tag)
+	}
+	return created, nil
+}
+
+// removeTrashTags undoes trashManifest, for deletes Zot refused.
+func (g *gateway) removeTrashTags(ctx context.Context, repository string, tags []string) {
+	for _, tag := range tags {
+		if err := g.deleteManifest(ctx, g.serviceHeader(), g.trashRepository(repository), tag); err != nil {
+			slog.Error("Failed to remove trash copy", "repository", repository, "tag", tag, "error", err.Error())
+		}
+	}
+}
+
+// softDeleteMiddleware copies manifests into the trash before deletes are
+// forwarded to Zot.
+func softDeleteMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || !g.cfg.SoftDelete.Enabled || r.Method != http.MethodDelete || t.Kind != kindManifests || g.isTrashRepository(t.Repository) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			tags, err := g.trashManifest(r.Context(), t.Repository, t.Reference)
+			if errors.Is(err, errUpstreamNotFound) && len(tags) == 0 {
+				// Let Zot answer deletes of missing manifests.
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				g.removeTrashTags(r.Context(), t.Repository, tags)
+				slog.Error("Failed to move manifest to the trash", "repository", t.Repository, "reference", t.Reference, "error", err.Error())
+				writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not move the manifest to the trash, it was not deleted", nil)
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			if ww.Status() >= http.StatusMultipleChoices {
+				g.removeTrashTags(r.Context(), t.Repository, tags)
+				return
+			}
+			slog.Info("Moved deleted manifest to the trash", "identity", identityName(IdentityFromContext(r.Context())), "repository", t.Repository, "reference", t.Reference, "trash", g.trashRepository(t.Repository), "tags", tags)
+		})
+	}
+}
+
+// listTrash lists every trashed manifest.
+func (g *gateway) listTrash(ctx context.Context) ([]trashEntry, error) {
+	header := g.serviceHeader()
+	repositories, err := g.listAll(ctx, header, "/v2/_catalog", "repositories")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	entries := []trashEntry{}
+	for _, trash := range repositories {
+		if !g.isTrashRepository(trash) {
+			continue
+		}
+		tags, err := g.listAll(ctx, header, "/v2/"+trash+"/tags/list", "tags")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", trash, err)
+		}
+		for _, tag := range tags {
+			deletedAt, originalTag, digest, ok := parseTrashTag(tag)
+			if !ok {
+				continue
+			}
+			entries = append(entries, trashEntry{
+				Repository:      strings.TrimPrefix(trash, g.cfg.SoftDelete.TrashPrefix+"/"),
+				TrashRepository: trash,
+				Tag:             tag,
+				OriginalTag:     originalTag,
+				Digest:          digest,
+				DeletedAt:       deletedAt,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// restoreTrash copies a trashed manifest back to its repository, under its
+// original tag or digest, and removes it from the trash.
+func (g *gateway) restoreTrash(ctx context.Context, repository, tag string) (trashEntry, error) {
+	deletedAt, originalTag, digest, ok := parseTrashTag(tag)
+	if !ok {
+		return trashEntry{}, fmt.Errorf("%w: %s", errNotTrashed, tag)
+	}
+	trash := g.trashRepository(repository)
+	target := originalTag
+	if target == "" {
+		target = digest
+	}
+	header := g.serviceHeader()
+	if err := g.copyManifest(ctx, header, trash, repository, tag, target); err != nil {
+		return trashEntry{}, err
+	}
+	if err := g.deleteManifest(ctx, header, trash, tag); err != nil {
+		return trashEntry{}, err
+	}
+	slog.Info("Restored manifest from the trash", "repository", repository, "reference", target, "tag", tag)
+	return trashEntry{Repository: repository, TrashRepository: trash, Tag: tag, OriginalTag: originalTag, Digest: digest, DeletedAt: deletedAt}, nil
+}
+
+// purgeTrash deletes the trashed manifests older than the retention
+// period and returns them.
+func (g *gateway) purgeTrash(ctx context.Context) ([]trashEntry, error) {
+	purged := []trashEntry{}
+	if g.cfg.SoftDelete.Retention <= 0 {
+		return purged, nil
+	}
+	entries, err := g.listTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-time.Duration(g.cfg.SoftDelete.Retention) * time.Second)
+	for _, entry := range entries {
+		if entry.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := g.deleteManifest(ctx, g.serviceHeader(), entry.TrashRepository, entry.Tag); err != nil {
+			return purged, err
+		}
+		purged = append(purged, entry)
+	}
+	if len(purged) > 0 {
+		slog.Info("Purged expired trash", "manifests", len(purged))
+	}
+	return purged, nil
+}
+
+// runTrashPurger purges expired trash periodically until the context ends.
+func (g *gateway) runTrashPurger(ctx context.Context) {
+	if !g.cfg.SoftDelete.Enabled || g.cfg.SoftDelete.Retention <= 0 || g.cfg.SoftDelete.PurgeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(g.cfg.SoftDelete.PurgeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := g.purgeTrash(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Failed to purge expired trash", "error", err.Error())
+			}
+		}
+	}
+}
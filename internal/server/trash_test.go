@@ -0,0 +1,278 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+type trashEntry struct {
+	Repository      string `json:"repository"`
+	TrashRepository string `json:"trash-repository"`
+	Tag             string `json:"tag"`
+	OriginalTag     string `json:"original-tag"`
+	Digest          string `json:"digest"`
+}
+
+func trashTestRouter(t *testing.T, backendURL string, softDelete config.SoftDelete) http.Handler {
+	t.Helper()
+	cfg := &config.Config{
+		LogLevel:   config.LogLevelInfo,
+		MyURL:      "http://localhost:8080",
+		ZotURL:     backendURL,
+		Admin:      config.Admin{Token: "admin-secret"},
+		SoftDelete: softDelete,
+	}
+	return newTestRouter(t, cfg)
+}
+
+func enabledSoftDelete() config.SoftDelete {
+	return config.SoftDelete{Enabled: true, TrashPrefix: "trash", Retention: 3600}
+}
+
+// pushTrashableImage stores an image whose blobs exist, so it can be copied
+// into the trash.
+func pushTrashableImage(registry *fakeRegistry, repository, tag string) string {
+	config := registry.putBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := registry.putBlob([]byte("layer for " + repository + ":" + tag))
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + config + `","size":37},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"` + layer + `","size":10}]}`
+	return registry.putManifest(repository, tag, "application/vnd.oci.image.manifest.v1+json", []byte(manifest))
+}
+
+func listTrash(t *testing.T, router http.Handler) []trashEntry {
+	t.Helper()
+	rec := serve(router, http.MethodGet, "/_proxy/admin/trash", asAdmin())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 listing the trash, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var entries []trashEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("failed to decode trash: %v", err)
+	}
+	return entries
+}
+
+func TestSoftDelete_TagRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	digest := pushTrashableImage(registry, "team/app", "1.0")
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	rec := serve(router, http.MethodDelete, "/v2/team/app/manifests/1.0")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for delete, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(router, http.MethodHead, "/v2/team/app/manifests/1.0"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected the tag to be deleted, got %d", rec.Code)
+	}
+
+	entries := listTrash(t, router)
+	if len(entries) != 1 {
+		t.Fatalf("expected one trashed manifest, got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Repository != "team/app" || entry.TrashRepository != "trash/team/app" || entry.OriginalTag != "1.0" || !strings.HasSuffix(entry.Tag, "_1.0") {
+		t.Fatalf("unexpected trash entry %+v", entry)
+	}
+
+	rec = serve(router, http.MethodPost, "/_proxy/admin/trash/restore", withManifest(`{"repository":"team/app","tag":"`+entry.Tag+`"}`), asAdmin())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for restore, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(router, http.MethodHead, "/v2/team/app/manifests/1.0")
+	if rec.Code != http.StatusOK || rec.Header().Get("Docker-Content-Digest") != digest {
+		t.Fatalf("expected the tag to be restored to %s, got %d %s", digest, rec.Code, rec.Header().Get("Docker-Content-Digest"))
+	}
+	if entries := listTrash(t, router); len(entries) != 0 {
+		t.Fatalf("expected the trash to be empty after restoring, got %+v", entries)
+	}
+}
+
+func TestSoftDelete_DigestKeepsEveryTag(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	digest := pushTrashableImage(registry, "app", "1.0")
+	registry.putManifest("app", "latest", "application/vnd.oci.image.manifest.v1+json", registry.manifests["app@"+digest])
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	rec := serve(router, http.MethodDelete, "/v2/app/manifests/"+digest)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for delete, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	originals := map[string]bool{}
+	for _, entry := range listTrash(t, router) {
+		originals[entry.OriginalTag] = true
+	}
+	if len(originals) != 2 || !originals["1.0"] || !originals["latest"] {
+		t.Fatalf("expected both tags in the trash, got %v", originals)
+	}
+}
+
+func TestSoftDelete_UntaggedDigest(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	digest := pushTrashableImage(registry, "app", "")
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	if rec := serve(router, http.MethodDelete, "/v2/app/manifests/"+digest); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for delete, got %d: %s", rec.Code, rec.Body.String())
+	}
+	entries := listTrash(t, router)
+	if len(entries) != 1 || entries[0].Digest != digest || entries[0].OriginalTag != "" {
+		t.Fatalf("expected the digest in the trash, got %+v", entries)
+	}
+
+	rec := serve(router, http.MethodPost, "/_proxy/admin/trash/restore", withManifest(`{"repository":"app","tag":"`+entries[0].Tag+`"}`), asAdmin())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for restore, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(router, http.MethodHead, "/v2/app/manifests/"+digest); rec.Code != http.StatusOK {
+		t.Fatalf("expected the digest to be restored, got %d", rec.Code)
+	}
+}
+
+func TestSoftDelete_CopyFailureKeepsManifest(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	// The layer blob is missing, so the manifest cannot be copied.
+	registry.putManifest("app", "1.0", "application/vnd.oci.image.manifest.v1+json", []byte(imageWithLayers("10")))
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	rec := serve(router, http.MethodDelete, "/v2/app/manifests/1.0")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "UNAVAILABLE") {
+		t.Fatalf("expected 503 UNAVAILABLE, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if registry.requested(http.MethodDelete, "/v2/app/manifests/") != 0 {
+		t.Fatal("expected the delete not to be forwarded")
+	}
+}
+
+func TestSoftDelete_Passthrough(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		softDelete config.SoftDelete
+		path       string
+	}{
+		{name: "disabled", softDelete: config.SoftDelete{TrashPrefix: "trash"}, path: "/v2/app/manifests/1.0"},
+		{name: "trash repository", softDelete: enabledSoftDelete(), path: "/v2/trash/app/manifests/1.0"},
+		{name: "missing manifest", softDelete: enabledSoftDelete(), path: "/v2/app/manifests/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry, backend := newFakeRegistry(t)
+			pushTrashableImage(registry, "app", "1.0")
+			pushTrashableImage(registry, "trash/app", "1.0")
+			router := trashTestRouter(t, backend.URL, tt.softDelete)
+
+			serve(router, http.MethodDelete, tt.path)
+			if registry.requested(http.MethodDelete, "/v2/") != 1 {
+				t.Fatal("expected the delete to be forwarded once")
+			}
+			if registry.requested(http.MethodPut, "/v2/trash/") != 0 {
+				t.Fatal("expected nothing to be copied into the trash")
+			}
+		})
+	}
+}
+
+func TestSoftDelete_Purge(t *testing.T) {
+	t.Parallel()
+
+	registry, backend := newFakeRegistry(t)
+	pushTrashableImage(registry, "trash/app", "20200101T000000Z_old")
+	pushTrashableImage(registry, "trash/app", "29990101T000000Z_new")
+	pushTrashableImage(registry, "trash/app", "not-trash")
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	rec := serve(router, http.MethodPost, "/_proxy/admin/trash/purge", asAdmin())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for purge, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var purged []trashEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &purged); err != nil {
+		t.Fatalf("failed to decode purge response: %v", err)
+	}
+	if len(purged) != 1 || purged[0].OriginalTag != "old" {
+		t.Fatalf("expected only the expired manifest to be purged, got %+v", purged)
+	}
+	entries := listTrash(t, router)
+	if len(entries) != 1 || entries[0].OriginalTag != "new" {
+		t.Fatalf("expected the recent manifest to be kept, got %+v", entries)
+	}
+}
+
+func TestSoftDelete_AdminDisabled(t *testing.T) {
+	t.Parallel()
+
+	_, backend := newFakeRegistry(t)
+	router := trashTestRouter(t, backend.URL, config.SoftDelete{TrashPrefix: "trash"})
+
+	rec := serve(router, http.MethodGet, "/_proxy/admin/trash", asAdmin())
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when soft delete is disabled, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_ErrorBodies(t *testing.T) {
+	t.Parallel()
+
+	_, backend := newFakeRegistry(t)
+	router := trashTestRouter(t, backend.URL, enabledSoftDelete())
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		token    string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "missing token", method: http.MethodGet, path: "/_proxy/admin/trash", wantCode: http.StatusUnauthorized, wantErr: "UNAUTHORIZED"},
+		{name: "wrong token", method: http.MethodGet, path: "/_proxy/admin/trash", token: "wrong", wantCode: http.StatusUnauthorized, wantErr: "UNAUTHORIZED"},
+		{name: "invalid mode", method: http.MethodPut, path: "/_proxy/admin/read-only", body: `{"enabled":`, wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "invalid mode pattern", method: http.MethodPut, path: "/_proxy/admin/maintenance", body: `{"repositories":["team/***"]}`, wantCode: http.StatusBadRequest, wantErr: "UNSUPPORTED"},
+		{name: "invalid restore repository", method: http.MethodPost, path: "/_proxy/admin/trash/restore", body: `{"repository":"Team/App","tag":"x"}`, wantCode: http.StatusBadRequest, wantErr: "NAME_INVALID"},
+		{name: "missing restore tag", method: http.MethodPost, path: "/_proxy/admin/trash/restore", body: `{"repository":"team/app"}`, wantCode: http.StatusBadRequest, wantErr: "TAG_INVALID"},
+		{name: "not a trash tag", method: http.MethodPost, path: "/_proxy/admin/trash/restore", body: `{"repository":"team/app","tag":"1.0"}`, wantCode: http.StatusBadRequest, wantErr: "TAG_INVALID"},
+		{name: "trashed manifest missing", method: http.MethodPost, path: "/_proxy/admin/trash/restore", body: `{"repository":"team/app","tag":"20260101T120000Z_1.0"}`, wantCode: http.StatusNotFound, wantErr: "MANIFEST_UNKNOWN"},
+		{name: "unknown endpoint", method: http.MethodGet, path: "/_proxy/admin/unknown", wantCode: http.StatusNotFound, wantErr: "UNSUPPORTED"},
+		{name: "wrong method", method: http.MethodDelete, path: "/_proxy/admin/quotas", wantCode: http.StatusMethodNotAllowed, wantErr: "UNSUPPORTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			options := []requestOption{withBody(tt.body)}
+			switch {
+			case tt.token != "":
+				options = append(options, withHeader("Authorization", "Bearer "+tt.token))
+			case tt.wantCode != http.StatusUnauthorized:
+				options = append(options, asAdmin())
+			}
+			rec := serve(router, tt.method, tt.path, options...)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			var body errorBody
+			if json.Unmarshal(rec.Body.Bytes(), &body) != nil || len(body.Errors) != 1 || body.Errors[0].Code != tt.wantErr {
+				t.Errorf("expected a %s error, got %s", tt.wantErr, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxManifestSize is the largest manifest the proxy reads into memory.
+	// The distribution spec asks registries to accept at least 4 MiB.
+	maxManifestSize = 4 << 20
+
+	upstreamTimeout = 30 * time.Second
+)
+
+var (
+	errManifestTooLarge         = errors.New("manifest is too large")
+	errMissingDigest            = errors.New("upstream response has no Docker-Content-Digest header")
+	errUnexpectedUpstreamStatus = errors.New("unexpected upstream status")
+	errUpstreamNotFound         = errors.New("not found upstream")
+	errUpstreamTooLarge         = errors.New("upstream content is too large")
+	errDigestMismatch           = errors.New("content does not match its digest")
+)
+
+// manifestAccept lists the manifest media types the proxy asks Zot for
+// when it looks up a manifest itself.
+var manifestAccept = strings.Join([]string{ //nolint:gochecknoglobals
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+}, ", ")
+
+// upstreamRequest sends a request of the proxy's own to Zot. The path may
+// carry a query string. The caller's Authorization header is forwarded so
+// Zot applies the same permissions it would to the proxied request.
+func (g *gateway) upstreamRequest(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	u := *g.upstream
+	path, query, _ := strings.Cut(path, "?")
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+	if auth := header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if accept := header.Get("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" && body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close() //nolint:wrapcheck
+}
+
+// manifestDigest looks up the digest a tag points to in Zot.
+func (g *gateway) manifestDigest(r *http.Request, repository, reference string) (string, bool, error) {
+	return g.headManifest(r.Context(), r.Header, repository, reference)
+}
+
+func (g *gateway) headManifest(ctx context.Context, header http.Header, repository, reference string) (string, bool, error) {
+	header = header.Clone()
+	header.Set("Accept", manifestAccept)
+	resp, err := g.upstreamRequest(ctx, http.MethodHead, "/v2/"+repository+"/manifests/"+reference, header, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if digest == "" {
+			return "", false, errMissingDigest
+		}
+		return digest, true, nil
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("%w: %s", errUnexpectedUpstreamStatus, resp.Status)
+	}
+}
+
+// headBlob looks up the size of a blob in Zot.
+func (g *gateway) headBlob(ctx context.Context, header http.Header, repository, digest string) (int64, bool, error) {
+	resp, err := g.upstreamRequest(ctx, http.MethodHead, "/v2/"+repository+"/blobs/"+digest, header, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, resp.ContentLength >= 0, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("%w: %s", errUnexpectedUpstreamStatus, resp.Status)
+	}
+}
+
+// fetchManifest fetches a manifest from Zot.
+func (g *gateway) fetchManifest(r *http.Request, repository, reference string) ([]byte, error) {
+	header := r.Header.Clone()
+	header.Set("Accept", manifestAccept)
+	return g.fetchContent(r.Context(), "/v2/"+repository+"/manifests/"+reference, header, maxManifestSize)
+}
+
+// fetchBlob fetches a small blob from Zot and checks it against its digest.
+func (g *gateway) fetchBlob(r *http.Request, repository, digest string, maxSize int64) ([]byte, error) {
+	body, err := g.fetchContent(r.Context(), "/v2/"+repository+"/blobs/"+digest, r.Header, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if digestOf(body) != digest {
+		return nil, fmt.Errorf("%w: %s", errDigestMismatch, digest)
+	}
+	return body, nil
+}
+
+// fetchContent fetches a bounded response body from Zot.
+func (g *gateway) fetchContent(ctx context.Context, path string, header http.Header, maxSize int64) ([]byte, error) {
+	resp, err := g.upstreamRequest(ctx, http.MethodGet, path, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errUpstreamNotFound
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnexpectedUpstreamStatus, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %w", err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errUpstreamTooLarge
+	}
+	return body, nil
+}
+
+// getManifest fetches a manifest and its media type from Zot.
+func (g *gateway) getManifest(ctx context.Context, header http.Header, repository, reference string) ([]byte, string, error) {
+	header = header.Clone()
+	header.Set("Accept", manifestAccept)
+	resp, err := g.upstreamRequest(ctx, http.MethodGet, "/v2/"+repository+"/manifests/"+reference, header, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", errUpstreamNotFound
+	default:
+		return nil, "", fmt.Errorf("%w: %s", errUnexpectedUpstreamStatus, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", errManifestTooLarge
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// putManifest pushes a manifest to Zot.
+func (g *gateway) putManifest(ctx context.Context, header http.Header, repository, reference, mediaType string, body []byte) error {
+	header = header.Clone()
+	header.Set("Content-Type", mediaType)
+	resp, err := g.upstreamRequest(ctx, http.MethodPut, "/v2/"+repository+"/manifests/"+reference, header, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%w: pushing %s:%s: %s", errUnexpectedUpstreamStatus, repository, reference, resp.Status)
+	}
+	return nil
+}
+
+// deleteManifest deletes a manifest or tag from Zot. Missing manifests are
+// not an error.
+func (g *gateway) deleteManifest(ctx context.Context, header http.Header, repository, reference string) error {
+	resp, err := g.upstreamRequest(ctx, http.MethodDelete, "/v2/"+repository+"/manifests/"+reference, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%w: deleting %s:%s: %s", errUnexpectedUpstreamStatus, repository, reference, resp.Status)
+	}
+	return nil
+}
+
+// mountBlob makes a blob from one repository available in another with a
+// cross-repository mount.
+func (g *gateway) mountBlob(ctx context.Context, header http.Header, from, to, digest string) error {
+	query := url.Values{"mount": {digest}, "from": {from}}
+	resp, err := g.upstreamRequest(ctx, http.MethodPost, "/v2/"+to+"/blobs/uploads/?"+query.Encode(), header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%w: mounting %s from %s into %s: %s", errUnexpectedUpstreamStatus, digest, from, to, resp.Status)
+	}
+	return nil
+}
+
+// copyManifest copies a manifest, and the blobs and manifests it
+// references, between repositories.
+func (g *gateway) copyManifest(ctx context.Context, header http.Header, from, to, reference, target string) error {
+	body, mediaType, err := g.getManifest(ctx, header, from, reference)
+	if err != nil {
+		return err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("failed to decode manifest %s:%s: %w", from, reference, err)
+	}
+	if manifest.Config != nil && manifest.Config.Digest != "" {
+		if err := g.mountBlob(ctx, header, from, to, manifest.Config.Digest); err != nil {
+			return err
+		}
+	}
+	for _, layer := range manifest.Layers {
+		if err := g.mountBlob(ctx, header, from, to, layer.Digest); err != nil {
+			return err
+		}
+	}
+	for _, child := range manifest.Manifests {
+		if err := g.copyManifest(ctx, header, from, to, child.Digest, child.Digest); err != nil {
+			return err
+		}
+	}
+	return g.putManifest(ctx, header, to, target, mediaType, body)
+}
+
+// readManifest reads the manifest being pushed and puts the body back so it
+// can still be proxied.
+func readManifest(r *http.Request) ([]byte, error) {
+	if r.ContentLength > maxManifestSize {
+		return nil, errManifestTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(body) > maxManifestSize {
+		return nil, errManifestTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// writeManifestReadError answers a push whose manifest could not be read.
+func writeManifestReadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errManifestTooLarge) {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, errCodeManifestInvalid, err.Error(), nil)
+		return
+	}
+	slog.Error("Failed to read manifest", "error", err.Error())
+	writeRegistryError(w, http.StatusBadRequest, errCodeManifestInvalid, "failed to read manifest", nil)
+}
+
+// digestOf returns the sha256 digest of a manifest.
+func digestOf(manifest []byte) string {
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// isDigest reports whether a manifest reference is a digest rather than a
+// tag. Tags cannot contain a colon.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
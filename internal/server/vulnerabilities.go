@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/glob"
+)
+
+const (
+	searchPath = "/v2/_zot/ext/search"
+
+	cveListQuery = `{ CVEListForImage(image: %q) { Tag CVEList { Id Severity Title } } }`
+
+	// maxReportedCVEs bounds the CVE IDs listed in a denial.
+	maxReportedCVEs = 20
+)
+
+var errSearchFailed = errors.New("search extension returned errors")
+
+type cve struct {
+	ID       string `json:"Id"`
+	Severity string `json:"Severity"`
+	Title    string `json:"Title"`
+}
+
+type cveListResponse struct {
+	Data struct {
+		CVEListForImage struct {
+			CVEList []cve `json:"CVEList"`
+		} `json:"CVEListForImage"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// vulnerabilityGate denies pulls of images with vulnerabilities Zot's
+// scanner found.
+type vulnerabilityGate struct {
+	cfg   config.VulnerabilityGate
+	cache *ttlCache[[]cve]
+}
+
+func newVulnerabilityGate(cfg config.VulnerabilityGate) *vulnerabilityGate {
+	return &vulnerabilityGate{
+		cfg:   cfg,
+		cache: newTTLCache[[]cve](time.Duration(cfg.CacheTTL) * time.Second),
+	}
+}
+
+// blocking returns the vulnerabilities that deny a pull.
+func (v *vulnerabilityGate) blocking(cves []cve) []cve {
+	threshold := v.cfg.Severity.Rank()
+	blocking := []cve{}
+	for _, c := range cves {
+		if config.Severity(strings.ToUpper(c.Severity)).Rank() < threshold {
+			continue
+		}
+		if slices.Contains(v.cfg.AllowedCVEs, c.ID) {
+			continue
+		}
+		blocking = append(blocking, c)
+	}
+	return blocking
+}
+
+// imageReference names an image the way the search extension expects.
+func imageReference(repository, reference string) string {
+	if isDigest(reference) {
+		return repository + "@" + reference
+	}
+	return repository + ":" + reference
+}
+
+// imageCVEs fetches the vulnerabilities of an image from Zot's search
+// extension. Tags are resolved to their digest first, so results are cached
+// by digest and a tag moved to another image is checked again.
+func (g *gateway) imageCVEs(r *http.Request, repository, reference string) ([]cve, error) {
+	digest := reference
+	if !isDigest(reference) {
+		current, exists, err := g.manifestDigest(r, repository, reference)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			// Zot answers the pull with its own 404.
+			return nil, nil
+		}
+		digest = current
+	}
+	image := imageReference(repository, digest)
+	if cves, ok := g.vulnerabilities.cache.get(image); ok {
+		return cves, nil
+	}
+
+	query := url.Values{"query": {fmt.Sprintf(cveListQuery, image)}}
+	resp, err := g.upstreamRequest(r.Context(), http.MethodGet, searchPath+"?"+query.Encode(), r.Header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errUnexpectedUpstreamStatus, resp.Status)
+	}
+	var result cveListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("%w: %s", errSearchFailed, result.Errors[0].Message)
+	}
+
+	cves := result.Data.CVEListForImage.CVEList
+	g.vulnerabilities.cache.set(image, cves)
+	return cves, nil
+}
+
+// vulnerabilityMiddleware checks manifest pulls against the vulnerability
+// gate.
+func vulnerabilityMiddleware(g *gateway) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTarget(r)
+			if !ok || !g.vulnerabilities.cfg.Enabled || t.Kind != kindManifests || t.Action != actionPull ||
+				glob.MatchAny(g.vulnerabilities.cfg.AllowedRepositories, t.Repository) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cves, err := g.imageCVEs(r, t.Repository, t.Reference)
+			if err != nil {
+				if g.vulnerabilities.cfg.FailOpen {
+					slog.Warn("Failed to fetch vulnerabilities, allowing pull", "repository", t.Repository, "reference", t.Reference, "error", err.Error())
+					next.ServeHTTP(w, r)
+					return
+				}
+				slog.Error("Failed to fetch vulnerabilities, denying pull", "repository", t.Repository, "reference", t.Reference, "error", err.Error())
+				writeRegistryError(w, http.StatusServiceUnavailable, errCodeUnavailable, "could not verify the image's vulnerability scan", nil)
+				return
+			}
+
+			blocking := g.vulnerabilities.blocking(cves)
+			if len(blocking) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ids := make([]string, 0, min(len(blocking), maxReportedCVEs))
+			for _, c := range blocking[:min(len(blocking), maxReportedCVEs)] {
+				ids = append(ids, c.ID)
+			}
+			image := imageReference(t.Repository, t.Reference)
+			slog.Info("Pull denied by vulnerability gate", "identity", identityName(IdentityFromContext(r.Context())), "image", image, "vulnerabilities", len(blocking))
+			writeRegistryError(w, http.StatusForbidden, errCodeDenied,
+				fmt.Sprintf("image %s has %d vulnerabilities at or above %s severity", image, len(blocking), g.vulnerabilities.cfg.Severity),
+				map[string]any{
+					"repository": t.Repository,
+					"reference":  t.Reference,
+					"severity":   g.vulnerabilities.cfg.Severity,
+					"cves":       ids,
+				})
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/USA-RedDragon/zot-docker-proxy/internal/config"
+)
+
+const (
+	cleanDigest      = "sha256:clean"
+	vulnerableDigest = "sha256:vulnerable"
+)
+
+// searchBackend resolves tags to digests and answers CVE queries by digest:
+// vulnerableDigest has a critical and a low vulnerability, other digests
+// none. Queries for team/broken fail.
+type searchBackend struct {
+	searches atomic.Int32
+	// tags maps repository:tag to a digest. Other tags point to
+	// cleanDigest.
+	tags sync.Map
+}
+
+func createSearchBackend(t *testing.T) (*searchBackend, *httptest.Server) {
+	t.Helper()
+	search := &searchBackend{}
+	search.tags.Store("team/vulnerable:1.0", vulnerableDigest)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_zot/ext/search" {
+			if repository, tag, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/"); ok {
+				digest := cleanDigest
+				if moved, ok := search.tags.Load(repository + ":" + tag); ok {
+					digest, _ = moved.(string)
+				}
+				w.Header().Set("Docker-Content-Digest", digest)
+			}
+			w.Header().Set("X-Backend-Called", "true")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		search.searches.Add(1)
+		query := r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(query, `"team/broken@`):
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.Contains(query, "@"+vulnerableDigest+`"`):
+			_, _ = w.Write([]byte(`{"data":{"CVEListForImage":{"Tag":"1.0","CVEList":[` +
+				`{"Id":"CVE-2024-0001","Severity":"CRITICAL","Title":"bad"},` +
+				`{"Id":"CVE-2024-0002","Severity":"LOW","Title":"meh"}]}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"data":{"CVEListForImage":{"Tag":"1.0","CVEList":[]}}}`))
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return search, backend
+}
+
+func vulnerabilityTestRouter(t *testing.T, backendURL string, gate config.VulnerabilityGate) http.Handler {
+	t.Helper()
+	cfg := &config.Config{
+		LogLevel:          config.LogLevelInfo,
+		MyURL:             "http://localhost:8080",
+		ZotURL:            backendURL,
+		VulnerabilityGate: gate,
+	}
+	return newTestRouter(t, cfg)
+}
+
+func TestVulnerabilityGate_DeniesAndCaches(t *testing.T) {
+	t.Parallel()
+
+	search, backend := createSearchBackend(t)
+
+	router := vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityHigh, CacheTTL: 300})
+
+	for range 2 {
+		rec := serve(router, http.MethodGet, "/v2/team/vulnerable/manifests/1.0")
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "CVE-2024-0001") || strings.Contains(rec.Body.String(), "CVE-2024-0002") {
+			t.Errorf("expected only the critical CVE to be reported, got %s", rec.Body.String())
+		}
+	}
+	if search.searches.Load() != 1 {
+		t.Errorf("expected 1 search, got %d", search.searches.Load())
+	}
+
+	rec := serve(router, http.MethodGet, "/v2/team/clean/manifests/1.0")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Called") != "true" {
+		t.Errorf("expected clean image to be proxied, got %d", rec.Code)
+	}
+
+	rec = serve(router, http.MethodGet, "/v2/team/vulnerable/blobs/sha256:abc")
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected blob pulls to be proxied, got %d", rec.Code)
+	}
+}
+
+func TestVulnerabilityGate_AllowLists(t *testing.T) {
+	t.Parallel()
+
+	search, backend := createSearchBackend(t)
+
+	router := vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityLow, AllowedCVEs: []string{"CVE-2024-0001", "CVE-2024-0002"}})
+	if rec := serve(router, http.MethodGet, "/v2/team/vulnerable/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected allow-listed CVEs to be ignored, got %d", rec.Code)
+	}
+
+	router = vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityLow, AllowedRepositories: []string{"team/*"}})
+	before := search.searches.Load()
+	if rec := serve(router, http.MethodGet, "/v2/team/vulnerable/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected allow-listed repository to be proxied, got %d", rec.Code)
+	}
+	if search.searches.Load() != before {
+		t.Error("expected no search for an allow-listed repository")
+	}
+}
+
+func TestVulnerabilityGate_SearchFailure(t *testing.T) {
+	t.Parallel()
+
+	_, backend := createSearchBackend(t)
+
+	router := vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityCritical})
+	if rec := serve(router, http.MethodGet, "/v2/team/broken/manifests/1.0"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when failing closed, got %d", rec.Code)
+	}
+
+	router = vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityCritical, FailOpen: true})
+	if rec := serve(router, http.MethodGet, "/v2/team/broken/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 when failing open, got %d", rec.Code)
+	}
+}
+
+func TestVulnerabilityGate_MovedTag(t *testing.T) {
+	t.Parallel()
+
+	search, backend := createSearchBackend(t)
+	router := vulnerabilityTestRouter(t, backend.URL, config.VulnerabilityGate{Enabled: true, Severity: config.SeverityHigh, CacheTTL: 300})
+
+	if rec := serve(router, http.MethodGet, "/v2/team/app/manifests/1.0"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the clean image to be pulled, got %d", rec.Code)
+	}
+	search.tags.Store("team/app:1.0", vulnerableDigest)
+	if rec := serve(router, http.MethodGet, "/v2/team/app/manifests/1.0"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the moved tag to be checked again, got %d", rec.Code)
+	}
+	if rec := serve(router, http.MethodGet, "/v2/team/app/manifests/"+vulnerableDigest); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the vulnerable digest to be denied, got %d", rec.Code)
+	}
+	if search.searches.Load() != 2 {
+		t.Errorf("expected one search per digest, got %d", search.searches.Load())
+	}
+}
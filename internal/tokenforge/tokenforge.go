@@ -6,6 +6,7 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 	"runtime"
@@ -16,12 +17,56 @@ import (
 
 const (
 	tokenVersion  byte   = 1
+	claimsVersion byte   = 2
 	defaultTime   uint32 = 4
 	defaultMemory uint32 = 64 * 1024 // 64 MB
 	kdfSaltLength        = 64
 )
 
+// Access is a single grant carried by a token, following the Docker
+// registry token specification.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// Claims are the signed contents of a token.
+type Claims struct {
+	Subject string   `json:"sub,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Access  []Access `json:"access,omitempty"`
+}
+
+// Allows reports whether the claims grant the action on the named resource.
+func (c *Claims) Allows(typ, name, action string) bool {
+	for _, access := range c.Access {
+		if access.Type != typ || access.Name != name {
+			continue
+		}
+		for _, a := range access.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func MakeToken(secret string, ttl time.Duration) (string, error) {
+	return makeToken(secret, ttl, tokenVersion, nil)
+}
+
+// MakeTokenWithClaims creates a token that carries the given claims.
+func MakeTokenWithClaims(secret string, ttl time.Duration, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("claims: %w", err)
+	}
+	return makeToken(secret, ttl, claimsVersion, payload)
+}
+
+func makeToken(secret string, ttl time.Duration, version byte, payload []byte) (string, error) {
 	uniq := make([]byte, 32)
 	var err error
 	var bytesRead int
@@ -48,7 +93,7 @@ func MakeToken(secret string, ttl time.Duration) (string, error) {
 	}
 
 	// Build header
-	buf := []byte{tokenVersion}
+	buf := []byte{version}
 	buf = append(buf, uniq...)
 	buf = append(buf, expBytes...)
 
@@ -68,6 +113,16 @@ func MakeToken(secret string, ttl time.Duration) (string, error) {
 	buf = append(buf, parallel)
 	buf = append(buf, kdfSalt...)
 
+	if version == claimsVersion {
+		if len(payload) > math.MaxUint32 {
+			return "", fmt.Errorf("claims: too large")
+		}
+		lenBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(payload)))
+		buf = append(buf, lenBytes...)
+		buf = append(buf, payload...)
+	}
+
 	// Derive key
 	key := argon2.IDKey([]byte(secret), kdfSalt, defaultTime, defaultMemory, parallel, 64)
 
@@ -87,18 +142,27 @@ func MakeToken(secret string, ttl time.Duration) (string, error) {
 }
 
 func VerifyToken(secret, token string) (bool, error) {
+	if _, err := ParseToken(secret, token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ParseToken verifies the token and returns its claims. Tokens created
+// without claims return nil claims.
+func ParseToken(secret, token string) (*Claims, error) {
 	decoded, err := base64.RawURLEncoding.DecodeString(token)
 	if err != nil {
-		return false, fmt.Errorf("decode: %w", err)
+		return nil, fmt.Errorf("decode: %w", err)
 	}
 	minLen := 1 + 32 + 8 + 4 + 4 + 1 + kdfSaltLength + 64
 	if len(decoded) < minLen {
-		return false, fmt.Errorf("too short")
+		return nil, fmt.Errorf("too short")
 	}
 
 	ver := decoded[0]
-	if ver != tokenVersion {
-		return false, fmt.Errorf("unsupported version %d", ver)
+	if ver != tokenVersion && ver != claimsVersion {
+		return nil, fmt.Errorf("unsupported version %d", ver)
 	}
 
 	// uniq := decoded[1:33]
@@ -107,36 +171,59 @@ func VerifyToken(secret, token string) (bool, error) {
 	memCost := binary.BigEndian.Uint32(decoded[45:49])
 	parallelism := decoded[49]
 	kdfSalt := decoded[50 : 50+kdfSaltLength]
-	rxSig := decoded[50+kdfSaltLength:]
+	headerLen := 50 + kdfSaltLength
+
+	var payload []byte
+	if ver == claimsVersion {
+		if len(decoded) < minLen+4 {
+			return nil, fmt.Errorf("too short")
+		}
+		payloadLen := binary.BigEndian.Uint32(decoded[headerLen : headerLen+4])
+		if uint64(len(decoded)) < uint64(minLen)+4+uint64(payloadLen) {
+			return nil, fmt.Errorf("too short")
+		}
+		payload = decoded[headerLen+4 : headerLen+4+int(payloadLen)]
+		headerLen += 4 + int(payloadLen)
+	}
+	rxSig := decoded[headerLen:]
 
 	expUint := binary.BigEndian.Uint64(expBytes)
 	if expUint > math.MaxInt64 {
-		return false, fmt.Errorf("invalid expiration")
+		return nil, fmt.Errorf("invalid expiration")
 	}
 	exp := int64(expUint)
 	if time.Now().Unix() > exp {
-		return false, fmt.Errorf("expired")
+		return nil, fmt.Errorf("expired")
 	}
 
 	// Re-derive key using the params and salt inside the token
 	key := argon2.IDKey([]byte(secret), kdfSalt, timeCost, memCost, parallelism, 64)
 
 	// Verify signature
-	msg := decoded[:50+kdfSaltLength] // everything up to salt
+	msg := decoded[:headerLen] // everything up to the signature
 	h := hmac.New(sha512.New, key)
 	bytesWritten, err := h.Write(msg)
 	if err != nil {
-		return false, fmt.Errorf("hmac: %w", err)
+		return nil, fmt.Errorf("hmac: %w", err)
 	}
 	if bytesWritten != len(msg) {
-		return false, fmt.Errorf("hmac: short write")
+		return nil, fmt.Errorf("hmac: short write")
 	}
 
 	expected := h.Sum(nil)
 
 	if !hmac.Equal(expected, rxSig) {
-		return false, fmt.Errorf("bad signature")
+		return nil, fmt.Errorf("bad signature")
 	}
 
-	return true, nil
+	if ver == tokenVersion {
+		return nil, nil //nolint:nilnil // legacy tokens carry no claims
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+
+	return claims, nil
 }
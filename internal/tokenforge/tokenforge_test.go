@@ -86,3 +86,72 @@ func TestVerifyToken_TooShort(t *testing.T) {
 		t.Errorf("expected too short error, got: %v", err)
 	}
 }
+
+func TestMakeTokenWithClaims_RoundTrip(t *testing.T) {
+	t.Parallel()
+	claims := Claims{
+		Subject: "anonymous",
+		Access: []Access{
+			{Type: "repository", Name: "library/alpine", Actions: []string{"pull"}},
+		},
+	}
+	token, err := MakeTokenWithClaims(testSecret, time.Minute, claims)
+	if err != nil {
+		t.Fatalf("MakeTokenWithClaims failed: %v", err)
+	}
+	ok, err := VerifyToken(testSecret, token)
+	if err != nil || !ok {
+		t.Fatalf("VerifyToken failed: %v", err)
+	}
+	parsed, err := ParseToken(testSecret, token)
+	if err != nil {
+		t.Fatalf("ParseToken failed: %v", err)
+	}
+	if parsed.Subject != "anonymous" {
+		t.Errorf("expected subject anonymous, got %q", parsed.Subject)
+	}
+	if !parsed.Allows("repository", "library/alpine", "pull") {
+		t.Error("expected pull on library/alpine to be allowed")
+	}
+	if parsed.Allows("repository", "library/alpine", "push") {
+		t.Error("expected push on library/alpine to be denied")
+	}
+	if parsed.Allows("repository", "library/busybox", "pull") {
+		t.Error("expected pull on library/busybox to be denied")
+	}
+}
+
+func TestParseToken_TamperedClaims(t *testing.T) {
+	t.Parallel()
+	token, err := MakeTokenWithClaims(testSecret, time.Minute, Claims{
+		Access: []Access{{Type: "repository", Name: "a", Actions: []string{"pull"}}},
+	})
+	if err != nil {
+		t.Fatalf("MakeTokenWithClaims failed: %v", err)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	// Flip a byte inside the claims payload
+	decoded[1+32+8+4+4+1+kdfSaltLength+4+2] ^= 0xff
+	_, err = ParseToken(testSecret, base64.RawURLEncoding.EncodeToString(decoded))
+	if err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("expected bad signature error, got: %v", err)
+	}
+}
+
+func TestParseToken_LegacyTokenHasNoClaims(t *testing.T) {
+	t.Parallel()
+	token, err := MakeToken(testSecret, time.Minute)
+	if err != nil {
+		t.Fatalf("MakeToken failed: %v", err)
+	}
+	claims, err := ParseToken(testSecret, token)
+	if err != nil {
+		t.Fatalf("ParseToken failed: %v", err)
+	}
+	if claims != nil {
+		t.Errorf("expected nil claims, got %+v", claims)
+	}
+}